@@ -4,10 +4,12 @@
 package csn
 
 import (
+	"CloudStorm/raft"
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"sync"
 	"time"
 )
 
@@ -117,3 +119,62 @@ func UnmarshalReservation(data []byte) (*Reservation, error) {
 	}
 	return &res, nil
 }
+
+// ------------------------------------------------------------------------
+// Raft replication of committed reservations
+// ------------------------------------------------------------------------
+
+// CmdCommitReservation records a Reservation in the replicated CSN registry.
+const CmdCommitReservation = "csn.reservation.commit"
+
+var registry = struct {
+	sync.Mutex
+	byAddress map[string]Reservation
+}{byAddress: make(map[string]Reservation)}
+
+func init() {
+	raft.RegisterCommand(CmdCommitReservation, applyCommitReservation)
+	raft.RegisterSnapshotter("csn", raft.Snapshotter{
+		Save:    marshalRegistry,
+		Restore: unmarshalRegistry,
+	})
+}
+
+func applyCommitReservation(entry raft.LogEntry) (interface{}, error) {
+	res, err := UnmarshalReservation(entry.Command)
+	if err != nil {
+		return nil, err
+	}
+	if res.Settings.CSNAddress == "" {
+		return nil, errors.New("reservation without CSN address")
+	}
+	registry.Lock()
+	defer registry.Unlock()
+	registry.byAddress[res.Settings.CSNAddress] = *res
+	return res, nil
+}
+
+// LookupReservation returns the committed reservation for a CSN address, if any.
+func LookupReservation(csnAddress string) (Reservation, bool) {
+	registry.Lock()
+	defer registry.Unlock()
+	res, ok := registry.byAddress[csnAddress]
+	return res, ok
+}
+
+func marshalRegistry() ([]byte, error) {
+	registry.Lock()
+	defer registry.Unlock()
+	return json.Marshal(registry.byAddress)
+}
+
+func unmarshalRegistry(data []byte) error {
+	byAddress := make(map[string]Reservation)
+	if err := json.Unmarshal(data, &byAddress); err != nil {
+		return err
+	}
+	registry.Lock()
+	defer registry.Unlock()
+	registry.byAddress = byAddress
+	return nil
+}
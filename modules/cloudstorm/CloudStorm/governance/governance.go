@@ -4,6 +4,7 @@
 package governance
 
 import (
+	"CloudStorm/raft"
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
@@ -132,6 +133,13 @@ func RemoveFromWhitelist(serviceID string) {
 	delete(state.Whitelist, serviceID)
 }
 
+// IsWhitelisted reports whether serviceID is on the governance whitelist.
+func IsWhitelisted(serviceID string) bool {
+	state.Mutex.Lock()
+	defer state.Mutex.Unlock()
+	return state.Whitelist[serviceID]
+}
+
 // GetWhitelist returns the currently whitelisted serviceIDs.
 func GetWhitelist() []string {
 	state.Mutex.Lock()
@@ -147,12 +155,55 @@ func GetWhitelist() []string {
 func MarshalGovernanceState() ([]byte, error) {
 	state.Mutex.Lock()
 	defer state.Mutex.Unlock()
-	return json.Marshal(state)
+	return json.Marshal(&state)
 }
 
-// UnmarshalGovernanceState loads the entire governance state from JSON.
+// UnmarshalGovernanceState replaces the entire governance state with the one in JSON.
 func UnmarshalGovernanceState(data []byte) error {
 	state.Mutex.Lock()
 	defer state.Mutex.Unlock()
+	state.PoolRates = make(map[string]float64)
+	state.Whitelist = make(map[string]bool)
+	state.Proposals = make(map[string]*Proposal)
 	return json.Unmarshal(data, &state)
 }
+
+// ------------------------------------------------------------------------
+// Raft replication of the whitelist
+// ------------------------------------------------------------------------
+
+// Raft command types for whitelist changes; the payload is a WhitelistChange.
+const (
+	CmdWhitelistAdd    = "governance.whitelist.add"
+	CmdWhitelistRemove = "governance.whitelist.remove"
+)
+
+// WhitelistChange is the payload of CmdWhitelistAdd and CmdWhitelistRemove.
+type WhitelistChange struct {
+	ServiceID string `json:"service_id"`
+}
+
+func init() {
+	raft.RegisterCommand(CmdWhitelistAdd, applyWhitelistChange)
+	raft.RegisterCommand(CmdWhitelistRemove, applyWhitelistChange)
+	raft.RegisterSnapshotter("governance", raft.Snapshotter{
+		Save:    MarshalGovernanceState,
+		Restore: UnmarshalGovernanceState,
+	})
+}
+
+func applyWhitelistChange(entry raft.LogEntry) (interface{}, error) {
+	var change WhitelistChange
+	if err := json.Unmarshal(entry.Command, &change); err != nil {
+		return nil, err
+	}
+	if change.ServiceID == "" {
+		return nil, errors.New("whitelist change without serviceID")
+	}
+	if entry.Type == CmdWhitelistAdd {
+		AddToWhitelist(change.ServiceID)
+	} else {
+		RemoveFromWhitelist(change.ServiceID)
+	}
+	return change, nil
+}
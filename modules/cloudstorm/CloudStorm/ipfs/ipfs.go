@@ -20,6 +20,7 @@ type LedgerBlock struct {
 	Records      map[string]interface{} `json:"records"`
 	Certificates map[string]interface{} `json:"certificates"`
 	Term         int                    `json:"term"`
+	Signer       string                 `json:"signer,omitempty"` // node whose key made CommitSig
 	CommitSig    string                 `json:"commit_sig"`
 }
 
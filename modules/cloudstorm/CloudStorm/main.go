@@ -1,15 +1,21 @@
 package main
 
 import (
+	_ "CloudStorm/csn" // registers raft command handlers
 	"CloudStorm/fswatch"
+	"CloudStorm/governance"
 	"CloudStorm/ipfs"
 	jwtutil "CloudStorm/jwt"
+	"CloudStorm/nft"
 	"CloudStorm/raft"
 	trinity "CloudStorm/trinitygo"
 	"CloudStorm/wallet"
 	"CloudStorm/ws"
 
+	"context"
+	"crypto/ed25519"
 	"crypto/tls"
+	"encoding/hex"
 	"flag"
 	"fmt"
 	"log"
@@ -17,6 +23,7 @@ import (
 	"os"
 	"os/exec"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -37,6 +44,28 @@ func startNodeServer() {
 	}()
 }
 
+// onboardNode runs a NodeOnboarding job on the node it was assigned to: it checks the
+// issuer's license and Ripple address and stores the onboarding record on IPFS. Once the
+// job completes, the group admits the host at job.NodeAddr, if set, as a learner.
+func onboardNode(ipfsClient *ipfs.IPFSClient) raft.JobHandler {
+	return func(ctx context.Context, job raft.Job) (string, error) {
+		if !nft.VerifyNFTLicense(job.LicenseNFTCID, job.Issuer) {
+			return "", fmt.Errorf("license %s is not held by %s", job.LicenseNFTCID, job.Issuer)
+		}
+		if job.RippleAddress != "" && !nft.VerifyRippleAddressOwnership(job.RippleAddress, job.Issuer) {
+			return "", fmt.Errorf("ripple address %s is not owned by %s", job.RippleAddress, job.Issuer)
+		}
+		return ipfsClient.StoreRecord(map[string]string{
+			"job":            job.ID,
+			"issuer":         job.Issuer,
+			"license_cid":    job.LicenseNFTCID,
+			"ripple_address": job.RippleAddress,
+			"node_addr":      job.NodeAddr,
+			"onboarded_at":   time.Now().UTC().Format(time.RFC3339),
+		})
+	}
+}
+
 func main() {
 	startNodeServer()
 
@@ -45,7 +74,12 @@ func main() {
 	peersArg := flag.String("peers", "", "Comma-separated list of peer addresses")
 	dbPath := flag.String("db", "cloudstorm.db", "Local BoltDB path")
 	nodeID := flag.String("nodeid", "NodeA", "Unique Raft node ID")
+	advertise := flag.String("advertise", "", "Address peers use to reach this node, as listed in their -peers (required with -peers)")
 	useIBTAllPorts := flag.Bool("allports", false, "Use all-port IBT routing")
+	adminAddr := flag.String("admin", "127.0.0.1:3002", "Listen address for the raft admin API")
+	peerKeysArg := flag.String("peerkeys", "", "Comma-separated id=hexkey public keys of the peers' consensus proofs")
+	insecure := flag.Bool("insecure", false, "Accept peers without a -peerkeys entry unverified (development only)")
+	maxJobs := flag.Int("maxjobs", 4, "Jobs this node runs at once, per raft group")
 
 	dims := []raft.IBTDimension{
 		{Size: 32, BypassSchemes: []int{8, 12}},
@@ -54,7 +88,6 @@ func main() {
 	flag.Parse()
 
 	ipfsClient := ipfs.NewClient(*ipfsAddr)
-	_ = ipfsClient
 
 	address, recovery, err := wallet.GenerateRippleWallet()
 	if err != nil {
@@ -69,18 +102,72 @@ func main() {
 	}
 	fmt.Println("Initial ServiceID:", serviceID)
 
+	_, proofKeyHash, err := trinity.FetchLocalConsensus("localhost", 7501)
+	if err != nil {
+		log.Printf("Trinity unavailable, using a fresh proof key: %v", err)
+		if proofKeyHash, err = trinity.GenerateProofKeyHash(); err != nil {
+			log.Fatalf("Failed to generate proof key: %v", err)
+		}
+	}
+
 	var peers []string
 	if *peersArg != "" {
 		peers = strings.Split(*peersArg, ",")
 	}
+	if len(peers) > 0 && *advertise == "" {
+		log.Fatal("-advertise is required with -peers")
+	}
 	tlsCfg := (*tls.Config)(nil)
 
-	node, err := raft.NewRaftNode(*nodeID, peers, *dbPath, tlsCfg, dims, *useIBTAllPorts)
+	peerKeys := make(map[string]ed25519.PublicKey)
+	if *peerKeysArg != "" {
+		for _, pair := range strings.Split(*peerKeysArg, ",") {
+			id, hexKey, ok := strings.Cut(pair, "=")
+			key, err := hex.DecodeString(hexKey)
+			if !ok || err != nil || len(key) != ed25519.PublicKeySize {
+				log.Fatalf("Invalid peer key %q", pair)
+			}
+			peerKeys[id] = ed25519.PublicKey(key)
+		}
+	}
+	if len(peers) > 0 && len(peerKeys) == 0 && !*insecure {
+		log.Fatal("-peerkeys is required with -peers; pass -insecure to run without verifying peers")
+	}
+
+	// One raft group per network, next to the meta group that owns the networks.
+	groups, err := raft.NewGroupManager(*nodeID, peers, *dbPath, tlsCfg, dims, *useIBTAllPorts)
 	if err != nil {
 		log.Fatalf("Raft node init failed: %v", err)
 	}
+
+	// Peers must run this node's service tree or a whitelisted one, and sign their RPCs.
+	var currentSID atomic.Value
+	currentSID.Store(serviceID)
+	groups.Configure(func(_ string, rn *raft.RaftNode) {
+		if *advertise != "" {
+			rn.SetAdvertiseAddr(*advertise)
+		}
+		rn.SetConsensusIdentity(currentSID.Load().(string), proofKeyHash)
+		rn.SetServiceIDVerifier(func(sid string) bool {
+			return sid == currentSID.Load().(string) || governance.IsWhitelisted(sid)
+		})
+		for id, key := range peerKeys {
+			rn.SetPeerKey(id, key)
+		}
+		rn.SetInsecureProofs(*insecure)
+
+		// Run the jobs the group assigns to this node.
+		worker := raft.NewWorker(rn)
+		worker.SetConcurrency(*maxJobs)
+		worker.Handle("NodeOnboarding", onboardNode(ipfsClient))
+		worker.Start()
+	})
+	node := groups.Meta()
+	fmt.Println("Consensus public key:", hex.EncodeToString(node.PublicKey()))
 	raft.SetGlobalNode(node)
-	node.Start()
+	if err := groups.Start(); err != nil {
+		log.Fatalf("Raft node start failed: %v", err)
+	}
 
 	http.HandleFunc("/api/token", func(w http.ResponseWriter, r *http.Request) {
 		token, err := jwtutil.GenerateToken("user")
@@ -93,11 +180,42 @@ func main() {
 
 	http.HandleFunc("/ws", ws.WsHandler)
 
+	raftHandler := groups.Handler()
+	http.Handle("/requestVote", raftHandler)
+	http.Handle("/appendEntries", raftHandler)
+	http.Handle("/installSnapshot", raftHandler)
+	http.Handle("/timeoutNow", raftHandler)
+	http.Handle("/forwardJob", raftHandler)
+
+	queryHandler := node.QueryHandler()
+	http.Handle("/api/networks", queryHandler)
+	http.Handle("/api/networks/", queryHandler)
+	http.Handle("/api/jobs", queryHandler)
+	http.Handle("/api/jobs/", queryHandler)
+	http.Handle("/api/containers/", queryHandler)
+
 	updateChan := make(chan string)
 	go fswatch.WatchForUpdates(*baseDir, updateChan)
 	go func() {
 		for newSID := range updateChan {
 			fmt.Println("ServiceID updated:", newSID)
+			currentSID.Store(newSID)
+			for _, id := range append([]string{""}, groups.Groups()...) {
+				if rn, ok := groups.Group(id); ok {
+					rn.SetConsensusIdentity(newSID, proofKeyHash)
+				}
+			}
+		}
+	}()
+
+	// The admin API, with the metrics of every raft group rather than only the meta group's.
+	adminMux := http.NewServeMux()
+	adminMux.Handle("/", node.AdminHandler())
+	adminMux.Handle("GET /metrics", groups.MetricsHandler())
+	go func() {
+		log.Printf("Admin API listening on %s", *adminAddr)
+		if err := http.ListenAndServe(*adminAddr, adminMux); err != nil {
+			log.Fatal(err)
 		}
 	}()
 
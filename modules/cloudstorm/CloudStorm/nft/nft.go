@@ -5,8 +5,10 @@
 package nft
 
 import (
+	"CloudStorm/raft"
 	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
 	"image"
 	"image/color"
 	"log"
@@ -129,3 +131,19 @@ func IssueNFT(issuer, licenseCID string) error {
 	log.Printf("NFT minted for issuer=%s with licenseCID=%s", issuer, licenseCID)
 	return nil
 }
+
+// ------------------------------------------------------------------------
+// Raft command: license NFT issuance for onboarded nodes
+// ------------------------------------------------------------------------
+
+func init() {
+	raft.RegisterCommand(raft.CmdIssueLicenseNFT, applyIssueNFT)
+}
+
+func applyIssueNFT(entry raft.LogEntry) (interface{}, error) {
+	var issue raft.LicenseIssue
+	if err := json.Unmarshal(entry.Command, &issue); err != nil {
+		return nil, err
+	}
+	return issue, IssueNFT(issue.Issuer, issue.LicenseCID)
+}
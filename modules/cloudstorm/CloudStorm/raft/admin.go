@@ -0,0 +1,183 @@
+// -------------------- raft/admin.go --------------------
+package raft
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+)
+
+// ------------------------------------------------------------------------
+// Admin HTTP Handler
+// ------------------------------------------------------------------------
+
+// NodeStatus is the admin view of a node's raft state.
+type NodeStatus struct {
+	ID            string        `json:"id"`
+	Addr          string        `json:"addr"`
+	State         string        `json:"state"`
+	Term          int           `json:"term"`
+	Leader        string        `json:"leader"`
+	CommitIndex   int           `json:"commit_index"`
+	LastApplied   int           `json:"last_applied"`
+	LastLogIndex  int           `json:"last_log_index"`
+	SnapshotIndex int           `json:"snapshot_index"`
+	Configuration Configuration `json:"configuration"`
+	PublicKey     string        `json:"public_key"` // verifies this node's consensus proofs
+}
+
+// Status returns a snapshot of the node's raft state.
+func (rn *RaftNode) Status() NodeStatus {
+	rn.mutex.Lock()
+	defer rn.mutex.Unlock()
+	return NodeStatus{
+		ID:            rn.id,
+		Addr:          rn.addr,
+		State:         rn.state.String(),
+		Term:          rn.currentTerm,
+		Leader:        rn.leaderID,
+		CommitIndex:   rn.commitIndex,
+		LastApplied:   rn.lastApplied,
+		LastLogIndex:  rn.lastLogIndex(),
+		SnapshotIndex: rn.snapshotIndex(),
+		Configuration: rn.config.clone(),
+		PublicKey:     hex.EncodeToString(rn.PublicKey()),
+	}
+}
+
+// AdminHandler returns an http.Handler for operating the node:
+//
+//	GET  /admin/status
+//	GET  /admin/log                   committed entries for VerifyLog
+//	GET  /admin/events                stream of Events, one JSON object per line
+//	GET  /metrics                     Prometheus metrics
+//	POST /admin/transfer-leadership   {"target": "<member address>"}; empty picks one
+//	POST /admin/members/add           {"addr": "<member address>"}; joins as a learner,
+//	                                  promoted once caught up (AddPeer)
+//	POST /admin/members/add-learner   {"addr": "<member address>"}; stays a learner
+//	POST /admin/members/promote       {"addr": "<member address>"}; learner to voter
+//	POST /admin/members/remove        {"addr": "<member address>"}; voter or learner
+//	GET  /admin/ibt                   iBT coordinates of every placed node
+//	POST /admin/ibt/rebalance         spread the placed nodes evenly (leader only)
+//
+// It performs no authentication, so serve it on a loopback or otherwise private listener.
+func (rn *RaftNode) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /admin/status", rn.serveStatus)
+	mux.HandleFunc("GET /admin/log", rn.serveLog)
+	mux.HandleFunc("GET /admin/events", rn.serveEvents)
+	mux.Handle("GET /metrics", rn.MetricsHandler())
+	mux.HandleFunc("POST /admin/transfer-leadership", rn.serveTransferLeadership)
+	mux.HandleFunc("POST /admin/members/add", rn.serveMembership(rn.AddPeer))
+	mux.HandleFunc("POST /admin/members/add-learner", rn.serveMembership(rn.AddLearner))
+	mux.HandleFunc("POST /admin/members/promote", rn.serveMembership(rn.PromoteLearner))
+	mux.HandleFunc("POST /admin/members/remove", rn.serveMembership(rn.RemovePeer))
+	mux.HandleFunc("GET /admin/ibt", rn.serveCoordinates)
+	mux.HandleFunc("POST /admin/ibt/rebalance", rn.serveRebalance)
+	return mux
+}
+
+func (rn *RaftNode) serveStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, rn.Status())
+}
+
+func (rn *RaftNode) serveLog(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, rn.ExportLog())
+}
+
+func (rn *RaftNode) serveEvents(w http.ResponseWriter, r *http.Request) {
+	events, cancel := rn.Subscribe(64)
+	defer cancel()
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev := <-events:
+			if err := enc.Encode(ev); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+}
+
+func (rn *RaftNode) serveTransferLeadership(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Target string `json:"target"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil && err != io.EOF {
+		http.Error(w, "invalid transfer request", http.StatusBadRequest)
+		return
+	}
+	err := rn.TransferLeadership(body.Target)
+	switch {
+	case err == nil:
+		writeJSON(w, rn.Status())
+	case errors.Is(err, ErrNotLeader):
+		if leader := rn.Leader(); leader != "" {
+			w.Header().Set("X-Raft-Leader", leader)
+		}
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, ErrLeadershipTransferInProgress):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, ErrTransferTimeout):
+		http.Error(w, err.Error(), http.StatusGatewayTimeout)
+	default:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
+
+// serveMembership handles a membership change of the member named in the request. It
+// answers with the new configuration once the change is proposed; the change takes
+// effect when it commits.
+func (rn *RaftNode) serveMembership(change func(addr string) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Addr string `json:"addr"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Addr == "" {
+			http.Error(w, "invalid membership request: addr is required", http.StatusBadRequest)
+			return
+		}
+		err := change(body.Addr)
+		switch {
+		case err == nil:
+			writeJSON(w, rn.GetConfiguration())
+		case errors.Is(err, ErrNotLeader):
+			if leader := rn.Leader(); leader != "" {
+				w.Header().Set("X-Raft-Leader", leader)
+			}
+			http.Error(w, err.Error(), http.StatusConflict)
+		case errors.Is(err, ErrLeadershipTransferInProgress), errors.Is(err, ErrConfigChangeInProgress):
+			http.Error(w, err.Error(), http.StatusConflict)
+		default:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+	}
+}
+
+func (rn *RaftNode) serveCoordinates(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, rn.NodeCoordinates())
+}
+
+func (rn *RaftNode) serveRebalance(w http.ResponseWriter, r *http.Request) {
+	err := rn.RebalanceIBT()
+	switch {
+	case err == nil:
+		writeJSON(w, rn.NodeCoordinates())
+	case errors.Is(err, ErrNotLeader):
+		if leader := rn.Leader(); leader != "" {
+			w.Header().Set("X-Raft-Leader", leader)
+		}
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,106 @@
+// -------------------- raft/admin_test.go --------------------
+package raft
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// adminPost posts body to path on rn's admin handler.
+func adminPost(rn *RaftNode, path, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	rn.AdminHandler().ServeHTTP(w, httptest.NewRequest(http.MethodPost, path, strings.NewReader(body)))
+	return w
+}
+
+// TestAdminMembership adds a node as a learner, promotes it and removes it again through
+// the admin API.
+func TestAdminMembership(t *testing.T) {
+	ids := []string{"n1", "n2", "n3"}
+	c := newTestCluster(t, ids, nil, nil)
+	leader := c.leader()
+	c.newNode("n4", append(ids, "n4")).Start()
+
+	if w := adminPost(c.follower(leader), "/admin/members/add-learner", `{"addr": "n4"}`); w.Code != http.StatusConflict || w.Header().Get("X-Raft-Leader") != leader.id {
+		t.Fatalf("change on a follower: %d %q, leader header %q", w.Code, w.Body, w.Header().Get("X-Raft-Leader"))
+	}
+	if w := adminPost(leader, "/admin/members/add-learner", `{}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("change without an address: %d %q", w.Code, w.Body)
+	}
+	// A new leader must first commit an entry of its own term.
+	waitFor(t, 5*time.Second, "n4 added as a learner", func() bool {
+		return adminPost(leader, "/admin/members/add-learner", `{"addr": "n4"}`).Code == http.StatusOK
+	})
+	if cfg := leader.GetConfiguration(); !cfg.isLearner("n4") || cfg.contains("n4") {
+		t.Fatalf("configuration after add-learner: %+v", cfg)
+	}
+	if err := leader.PostJob(Job{ID: "j"}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, 5*time.Second, "replication to the learner", func() bool { return c.hasJob("j", "n4") })
+
+	waitFor(t, 5*time.Second, "n4 promoted", func() bool {
+		return adminPost(leader, "/admin/members/promote", `{"addr": "n4"}`).Code == http.StatusOK
+	})
+	if cfg := leader.GetConfiguration(); !cfg.contains("n4") || cfg.isLearner("n4") {
+		t.Fatalf("configuration after promote: %+v", cfg)
+	}
+	if w := adminPost(leader, "/admin/members/add", `{"addr": "n4"}`); w.Code != http.StatusBadRequest && w.Code != http.StatusConflict {
+		t.Fatalf("adding a member twice: %d %q", w.Code, w.Body)
+	}
+
+	waitFor(t, 5*time.Second, "n4 removed", func() bool {
+		return adminPost(leader, "/admin/members/remove", `{"addr": "n4"}`).Code == http.StatusOK
+	})
+	if cfg := leader.GetConfiguration(); cfg.includes("n4") {
+		t.Fatalf("configuration after remove: %+v", cfg)
+	}
+}
+
+// TestOnboardingAdmitsLearner completes a NodeOnboarding job and checks that the host it
+// names joins as a learner and is promoted once caught up.
+func TestOnboardingAdmitsLearner(t *testing.T) {
+	ids := []string{"n1", "n2", "n3"}
+	c := newTestCluster(t, ids, nil, nil)
+	leader := c.leader()
+	c.newNode("n4", append(ids, "n4")).Start()
+
+	job := Job{ID: "onboard-n4", Type: "NodeOnboarding", NodeAddr: "n4", AssignedTo: leader.id}
+	if err := leader.PostJob(job); err != nil {
+		t.Fatal(err)
+	}
+	if cfg := leader.GetConfiguration(); cfg.includes("n4") {
+		t.Fatalf("n4 admitted before its onboarding completed: %+v", cfg)
+	}
+	if err := leader.AcceptJob(job.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := leader.CompleteJob(job.ID, leader.id, "cid"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, 5*time.Second, "n4 promoted to voter", func() bool {
+		return c.nodes["n4"].GetConfiguration().contains("n4") && leader.GetConfiguration().contains("n4")
+	})
+	waitFor(t, 5*time.Second, "the onboarding record cleared", func() bool {
+		for _, id := range ids {
+			rn := c.nodes[id]
+			rn.mutex.Lock()
+			n := len(rn.onboarding)
+			rn.mutex.Unlock()
+			if n != 0 {
+				return false
+			}
+		}
+		return true
+	})
+
+	// Removing the host later does not bring it back.
+	waitFor(t, 5*time.Second, "n4 removed", func() bool { return leader.RemovePeer("n4") == nil })
+	time.Sleep(200 * time.Millisecond)
+	if cfg := leader.GetConfiguration(); cfg.includes("n4") {
+		t.Fatalf("n4 was added back after its removal: %+v", cfg)
+	}
+}
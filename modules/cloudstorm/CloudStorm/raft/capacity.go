@@ -0,0 +1,135 @@
+// -------------------- raft/capacity.go --------------------
+package raft
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"log"
+	"os"
+	"runtime"
+	"strconv"
+	"time"
+)
+
+// CmdNodeCapacity records a node's capacity report. Command is a NodeCapacity.
+const CmdNodeCapacity = "node.capacity"
+
+const (
+	// capacityReportInterval is how often a Worker reports its node's capacity.
+	capacityReportInterval = 10 * time.Second
+	// capacityStaleAfter is how old a report may be before the scheduler stops placing
+	// jobs on its node.
+	capacityStaleAfter = 3 * capacityReportInterval
+)
+
+// ------------------------------------------------------------------------
+// Capacity Reports
+// ------------------------------------------------------------------------
+//
+// Every node running a Worker reports what it has to offer through the log, at start
+// and then every capacityReportInterval, so the leader's scheduler sees the same picture
+// on whichever node it runs. A report doubles as a liveness heartbeat: the scheduler
+// skips nodes whose latest report is older than capacityStaleAfter. Reports are stamped
+// by the leader that proposes them rather than by their nodes, so a node whose clock is
+// off is neither always stale nor never stale.
+
+// NodeCapacity is a node's capacity report.
+type NodeCapacity struct {
+	NodeID      string  `json:"node_id"`
+	CPUCores    int     `json:"cpu_cores"`
+	CPULoad     float64 `json:"cpu_load"` // 1-minute load average
+	MemoryTotal uint64  `json:"memory_total"`
+	MemoryFree  uint64  `json:"memory_free"` // available to new jobs
+	DiskFree    uint64  `json:"disk_free"`
+	Jobs        int     `json:"jobs"`     // jobs the node's worker is running
+	MaxJobs     int     `json:"max_jobs"` // the worker's concurrency limit
+	At          int64   `json:"at"`       // proposing leader's clock, Unix nanoseconds
+}
+
+// CapacityProbe measures the local node's resources. The worker fills in NodeID and the
+// job counts.
+type CapacityProbe func() (NodeCapacity, error)
+
+// SystemCapacity is the default CapacityProbe: the CPU count, and the load, memory and
+// free disk space of the working directory where the platform exposes them.
+func SystemCapacity() (NodeCapacity, error) {
+	c := NodeCapacity{CPUCores: runtime.NumCPU()}
+	if data, err := os.ReadFile("/proc/loadavg"); err == nil {
+		if fields := bytes.Fields(data); len(fields) > 0 {
+			c.CPULoad, _ = strconv.ParseFloat(string(fields[0]), 64)
+		}
+	}
+	if f, err := os.Open("/proc/meminfo"); err == nil {
+		s := bufio.NewScanner(f)
+		for s.Scan() {
+			fields := bytes.Fields(s.Bytes())
+			if len(fields) < 2 {
+				continue
+			}
+			kb, _ := strconv.ParseUint(string(fields[1]), 10, 64)
+			switch string(fields[0]) {
+			case "MemTotal:":
+				c.MemoryTotal = kb << 10
+			case "MemAvailable:":
+				c.MemoryFree = kb << 10
+			}
+		}
+		f.Close()
+	}
+	free, err := diskFree(".")
+	if err != nil {
+		return c, err
+	}
+	c.DiskFree = free
+	return c, nil
+}
+
+// applyCapacity records a capacity report. Caller holds rn.mutex.
+func (rn *RaftNode) applyCapacity(entry LogEntry) (interface{}, error) {
+	var c NodeCapacity
+	if err := decodeCommand(entry, &c); err != nil {
+		return nil, err
+	}
+	rn.capacities[c.NodeID] = c
+	return c, nil
+}
+
+// NodeCapacities returns the latest capacity report of every node that sent one.
+func (rn *RaftNode) NodeCapacities() map[string]NodeCapacity {
+	rn.mutex.Lock()
+	defer rn.mutex.Unlock()
+	out := make(map[string]NodeCapacity, len(rn.capacities))
+	for id, c := range rn.capacities {
+		out[id] = c
+	}
+	return out
+}
+
+// SetCapacityProbe replaces the probe the worker measures its node with.
+func (w *Worker) SetCapacityProbe(probe CapacityProbe) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.probe = probe
+}
+
+// reportCapacity sends a capacity report for the worker's node and reports whether it was
+// applied.
+func (w *Worker) reportCapacity() bool {
+	w.mutex.Lock()
+	probe, jobs, maxJobs := w.probe, len(w.running), w.limit
+	w.mutex.Unlock()
+
+	c, err := probe()
+	if err != nil {
+		log.Printf("Worker %s: capacity probe incomplete: %v", w.rn.id, err)
+	}
+	c.NodeID, c.Jobs, c.MaxJobs = w.rn.id, jobs, maxJobs
+	if err := w.rn.submit(CmdNodeCapacity, c); err != nil {
+		if !errors.Is(err, ErrNotLeader) {
+			log.Printf("Worker %s could not report capacity: %v", w.rn.id, err)
+		}
+		return false
+	}
+	return true
+}
@@ -0,0 +1,11 @@
+//go:build !linux && !darwin
+
+// -------------------- raft/capacity_other.go --------------------
+package raft
+
+import "errors"
+
+// diskFree is not implemented on this platform.
+func diskFree(path string) (uint64, error) {
+	return 0, errors.New("free disk space not available on this platform")
+}
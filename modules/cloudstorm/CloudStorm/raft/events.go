@@ -0,0 +1,110 @@
+// -------------------- raft/events.go --------------------
+package raft
+
+import (
+	"sync"
+	"time"
+)
+
+// Event types delivered to subscribers.
+const (
+	// EventLeaderChanged: the node learned of a new leader (possibly itself) for Term.
+	EventLeaderChanged = "leader_changed"
+	// EventCommitted: entries up to Index are committed.
+	EventCommitted = "committed"
+	// EventPeerUnreachable: RPCs to Peer have failed peerUnreachableAfter times in a row.
+	EventPeerUnreachable = "peer_unreachable"
+	// EventPeerReachable: Peer answered again after being reported unreachable.
+	EventPeerReachable = "peer_reachable"
+	// EventJobUpdated: the entry at Index posted Job or moved it to another state.
+	EventJobUpdated = "job_updated"
+)
+
+// ------------------------------------------------------------------------
+// State-Change Events
+// ------------------------------------------------------------------------
+//
+// Subscribers receive a node's state changes on a buffered channel. Events are
+// published while the node holds its lock, so delivery never blocks: when a
+// subscriber's buffer is full the event is dropped for that subscriber and counted in
+// cloudstorm_raft_events_dropped_total. Commits are reported once per advance of the
+// commit index, not per entry.
+
+// Event is one state change of a node.
+type Event struct {
+	Type   string    `json:"type"`
+	Node   string    `json:"node"`
+	Group  string    `json:"group,omitempty"`
+	Term   int       `json:"term,omitempty"`
+	Leader string    `json:"leader,omitempty"`
+	Index  int       `json:"index,omitempty"`
+	Peer   string    `json:"peer,omitempty"`
+	Job    string    `json:"job,omitempty"`
+	Error  string    `json:"error,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+// eventBus fans events out to subscribers. It has its own lock since peer events are
+// published without rn.mutex.
+type eventBus struct {
+	mutex sync.Mutex
+	next  int
+	subs  map[int]chan Event
+}
+
+// Subscribe returns a channel of the node's events, buffering up to buffer of them, and
+// a function that cancels the subscription and closes the channel.
+func (rn *RaftNode) Subscribe(buffer int) (<-chan Event, func()) {
+	b := rn.events
+	ch := make(chan Event, buffer)
+	b.mutex.Lock()
+	if b.subs == nil {
+		b.subs = make(map[int]chan Event)
+	}
+	id := b.next
+	b.next++
+	b.subs[id] = ch
+	b.mutex.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			b.mutex.Lock()
+			delete(b.subs, id)
+			b.mutex.Unlock()
+			close(ch)
+		})
+	}
+}
+
+// publish stamps ev with the node's identity and delivers it to every subscriber that
+// has room for it.
+func (b *eventBus) publish(rn *RaftNode, ev Event) {
+	ev.Node, ev.Group, ev.Time = rn.id, rn.groupID, rn.clock()
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for _, ch := range b.subs {
+		select {
+		case ch <- ev:
+		default:
+			rn.metrics.mutex.Lock()
+			rn.metrics.droppedEvents++
+			rn.metrics.mutex.Unlock()
+		}
+	}
+}
+
+// setLeader records the leader of the current term and, if given, its address,
+// announcing a newly known leader. Caller holds rn.mutex.
+func (rn *RaftNode) setLeader(id, addr string) {
+	if addr != "" || id != rn.leaderID {
+		rn.leaderAddr = addr
+	}
+	if id == rn.leaderID {
+		return
+	}
+	rn.leaderID = id
+	if id != "" {
+		rn.events.publish(rn, Event{Type: EventLeaderChanged, Term: rn.currentTerm, Leader: id})
+	}
+}
@@ -0,0 +1,331 @@
+// -------------------- raft/fsm.go --------------------
+package raft
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Command types for the state the RaftNode itself replicates. Every LogEntry carries
+// its type explicitly, so applying an entry never depends on guessing its payload shape.
+const (
+	CmdCreateNetwork   = "network.create"   // Command is a Network
+	CmdPostJob         = "job.post"         // Command is a Job
+	CmdAcceptJob       = "job.accept"       // Command is a JobTransition
+	CmdUpdateContainer = "container.update" // Command is a ContainerConsensus
+
+	// CmdIssueLicenseNFT is applied for each onboarded node when a handler is registered
+	// for it (the nft package does so). Command is a LicenseIssue.
+	CmdIssueLicenseNFT = "nft.issue"
+)
+
+// Errors the built-in commands are rejected with, both on apply and by the client calls
+// checks against local state. Apply wraps them with the job or network ID.
+var (
+	ErrNetworkExists = errors.New("network already exists")
+	ErrJobExists     = errors.New("job already exists")
+	ErrJobNotFound   = errors.New("job not found")
+	ErrJobNotQueued  = errors.New("job is not in a queued state")
+)
+
+// LicenseIssue is the payload of CmdIssueLicenseNFT.
+type LicenseIssue struct {
+	Issuer     string `json:"issuer"`
+	LicenseCID string `json:"license_cid"`
+}
+
+// ------------------------------------------------------------------------
+// FSM Interface
+// ------------------------------------------------------------------------
+
+// FSM is the replicated state machine a RaftNode applies committed entries to. Apply
+// must be deterministic: every node applies the same entries in the same order and must
+// end up in the same state. All methods are called with the node's lock held.
+type FSM interface {
+	Apply(entry LogEntry) (interface{}, error)
+	Snapshot() (json.RawMessage, error)
+	Restore(data json.RawMessage) error
+}
+
+// SetFSM replaces the state machine committed entries are applied to and loads the
+// latest snapshot into it. Call before Start.
+func (rn *RaftNode) SetFSM(fsm FSM) error {
+	rn.mutex.Lock()
+	defer rn.mutex.Unlock()
+	snap, ok, err := rn.loadSnapshot()
+	if err != nil {
+		return err
+	}
+	if ok {
+		if err := fsm.Restore(snap.State); err != nil {
+			return fmt.Errorf("failed to restore snapshot into FSM: %w", err)
+		}
+	}
+	rn.fsm = fsm
+	return nil
+}
+
+// ------------------------------------------------------------------------
+// Command Registry
+// ------------------------------------------------------------------------
+
+// CommandHandler applies one committed entry of a registered command type. It runs on
+// every node, under the node's lock, and must not call back into the RaftNode.
+type CommandHandler func(entry LogEntry) (interface{}, error)
+
+// Snapshotter captures and restores package-level state maintained by command handlers,
+// so it survives log compaction along with the node's own state.
+type Snapshotter struct {
+	Save    func() ([]byte, error)
+	Restore func(data []byte) error
+}
+
+var (
+	registryMutex sync.RWMutex
+	commandTable  = make(map[string]CommandHandler)
+	snapshotTable = make(map[string]Snapshotter)
+)
+
+// RegisterCommand installs the handler for cmdType. Packages call it from init; it
+// panics on a duplicate or reserved type, like http.Handle.
+func RegisterCommand(cmdType string, handler CommandHandler) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+	if cmdType == "" || strings.HasPrefix(cmdType, "raft.") || isBuiltinCommand(cmdType) {
+		panic("raft: reserved command type " + cmdType)
+	}
+	if _, dup := commandTable[cmdType]; dup {
+		panic("raft: RegisterCommand called twice for " + cmdType)
+	}
+	commandTable[cmdType] = handler
+}
+
+// RegisterSnapshotter includes a package's state, under name, in every snapshot.
+func RegisterSnapshotter(name string, s Snapshotter) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+	if _, dup := snapshotTable[name]; dup {
+		panic("raft: RegisterSnapshotter called twice for " + name)
+	}
+	snapshotTable[name] = s
+}
+
+func lookupCommand(cmdType string) (CommandHandler, bool) {
+	registryMutex.RLock()
+	defer registryMutex.RUnlock()
+	h, ok := commandTable[cmdType]
+	return h, ok
+}
+
+func isBuiltinCommand(cmdType string) bool {
+	switch cmdType {
+	case CmdCreateNetwork, CmdPostJob, CmdAcceptJob, CmdUpdateContainer,
+		CmdStartJob, CmdHeartbeatJob, CmdCompleteJob, CmdFailJob, CmdExpireJobLease,
+		CmdNodeCapacity, CmdJoinIBT, CmdLeaveIBT, CmdRebalanceIBT:
+		return true
+	}
+	return false
+}
+
+// ------------------------------------------------------------------------
+// Default FSM: the node's Networks, jobs and container consensus
+// ------------------------------------------------------------------------
+
+// nodeFSM applies the built-in commands to the RaftNode's maps and dispatches every
+// other type through the command registry. Registered handlers keep one copy of their
+// state per process, so only one group in a process may use the registry: a plain node
+// or a GroupManager's meta group.
+type nodeFSM struct {
+	rn       *RaftNode
+	registry bool
+}
+
+// fsmState is the applied state captured in a snapshot.
+type fsmState struct {
+	Networks           map[string]Network            `json:"networks"`
+	Jobs               map[string]Job                `json:"jobs"`
+	ContainerConsensus map[string]ContainerConsensus `json:"container_consensus"`
+	Capacities         map[string]NodeCapacity       `json:"capacities,omitempty"`
+	Coordinates        map[string]IBTCoordinates     `json:"coordinates,omitempty"`
+	CoordinateAddrs    map[string]string             `json:"coordinate_addrs,omitempty"`
+	Onboarding         map[string]string             `json:"onboarding,omitempty"`
+	External           map[string]json.RawMessage    `json:"external,omitempty"`
+}
+
+// Apply applies one committed entry; unknown command types are an error, not a no-op.
+func (f *nodeFSM) Apply(entry LogEntry) (interface{}, error) {
+	rn := f.rn
+	switch entry.Type {
+	case CmdCreateNetwork:
+		var netw Network
+		if err := decodeCommand(entry, &netw); err != nil {
+			return nil, err
+		}
+		if _, exists := rn.Networks[netw.ID]; exists {
+			return nil, fmt.Errorf("network %s: %w", netw.ID, ErrNetworkExists)
+		}
+		rn.Networks[netw.ID] = netw
+		log.Printf("New CloudStorm Network '%s' created, XRPL Issuer: %s, Master License: %s",
+			netw.ID, netw.TokenIssuerAddr, netw.MasterLicenseID)
+		return netw, nil
+
+	case CmdPostJob:
+		var job Job
+		if err := decodeCommand(entry, &job); err != nil {
+			return nil, err
+		}
+		if _, exists := rn.jobQueue[job.ID]; exists {
+			return nil, fmt.Errorf("job %s: %w", job.ID, ErrJobExists)
+		}
+		job.Status = JobQueued
+		rn.setJob(entry, job)
+		if job.Type == "NodeOnboarding" && f.registry {
+			if err := issueLicenseNFT(entry, job); err != nil {
+				return nil, err
+			}
+			log.Printf("Node onboarded with issuer: %s", job.Issuer)
+		}
+		return job, nil
+
+	case CmdAcceptJob, CmdStartJob, CmdHeartbeatJob, CmdCompleteJob, CmdFailJob, CmdExpireJobLease:
+		return rn.applyJobTransition(entry)
+
+	case CmdNodeCapacity:
+		return rn.applyCapacity(entry)
+
+	case CmdJoinIBT, CmdLeaveIBT, CmdRebalanceIBT:
+		return rn.applyPlacement(entry)
+
+	case CmdUpdateContainer:
+		var cons ContainerConsensus
+		if err := decodeCommand(entry, &cons); err != nil {
+			return nil, err
+		}
+		rn.ContainerConsensusDB[cons.ContainerID] = cons
+		log.Printf("Container consensus updated: Container %s, StateHash %s, Timestamp %d",
+			cons.ContainerID, cons.StateHash, cons.Timestamp)
+		return cons, nil
+	}
+
+	handler, ok := lookupCommand(entry.Type)
+	if !ok || !f.registry {
+		return nil, fmt.Errorf("no handler registered for command type %q", entry.Type)
+	}
+	return handler(entry)
+}
+
+// issueLicenseNFT runs the registered CmdIssueLicenseNFT handler for an onboarding job.
+func issueLicenseNFT(entry LogEntry, job Job) error {
+	handler, ok := lookupCommand(CmdIssueLicenseNFT)
+	if !ok {
+		return nil
+	}
+	data, err := json.Marshal(LicenseIssue{Issuer: job.Issuer, LicenseCID: job.LicenseNFTCID})
+	if err != nil {
+		return err
+	}
+	entry.Type, entry.Command = CmdIssueLicenseNFT, data
+	if _, err := handler(entry); err != nil {
+		return fmt.Errorf("failed to issue NFT: %w", err)
+	}
+	return nil
+}
+
+// Snapshot serializes the node's maps plus every registered package's state.
+func (f *nodeFSM) Snapshot() (json.RawMessage, error) {
+	st := fsmState{
+		Networks:           f.rn.Networks,
+		Jobs:               f.rn.jobQueue,
+		ContainerConsensus: f.rn.ContainerConsensusDB,
+		Capacities:         f.rn.capacities,
+		Coordinates:        f.rn.nodeCoords,
+		CoordinateAddrs:    f.rn.nodeAddrs,
+		Onboarding:         f.rn.onboarding,
+		External:           make(map[string]json.RawMessage),
+	}
+	if !f.registry {
+		return json.Marshal(st)
+	}
+	registryMutex.RLock()
+	defer registryMutex.RUnlock()
+	for name, s := range snapshotTable {
+		data, err := s.Save()
+		if err != nil {
+			return nil, fmt.Errorf("snapshot of %s failed: %w", name, err)
+		}
+		st.External[name] = data
+	}
+	return json.Marshal(st)
+}
+
+// Restore replaces the node's maps and registered package state with a snapshot's.
+func (f *nodeFSM) Restore(data json.RawMessage) error {
+	var st fsmState
+	if err := json.Unmarshal(data, &st); err != nil {
+		return err
+	}
+	rn := f.rn
+	rn.Networks = make(map[string]Network)
+	for k, v := range st.Networks {
+		rn.Networks[k] = v
+	}
+	rn.jobQueue = make(map[string]Job)
+	for k, v := range st.Jobs {
+		rn.jobQueue[k] = v
+	}
+	rn.ContainerConsensusDB = make(map[string]ContainerConsensus)
+	for k, v := range st.ContainerConsensus {
+		rn.ContainerConsensusDB[k] = v
+	}
+	rn.capacities = make(map[string]NodeCapacity)
+	for k, v := range st.Capacities {
+		rn.capacities[k] = v
+	}
+	rn.nodeCoords = make(map[string]IBTCoordinates)
+	for k, v := range st.Coordinates {
+		rn.nodeCoords[k] = v
+	}
+	rn.nodeAddrs = make(map[string]string)
+	for k, v := range st.CoordinateAddrs {
+		rn.nodeAddrs[k] = v
+	}
+	rn.onboarding = make(map[string]string)
+	for k, v := range st.Onboarding {
+		rn.onboarding[k] = v
+	}
+	if !f.registry {
+		return nil
+	}
+
+	registryMutex.RLock()
+	defer registryMutex.RUnlock()
+	names := make([]string, 0, len(st.External))
+	for name := range st.External {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		s, ok := snapshotTable[name]
+		if !ok {
+			log.Printf("Snapshot contains state for unregistered %q; skipping", name)
+			continue
+		}
+		if err := s.Restore(st.External[name]); err != nil {
+			return fmt.Errorf("restore of %s failed: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// decodeCommand unmarshals an entry's command payload into v.
+func decodeCommand(entry LogEntry, v interface{}) error {
+	if err := json.Unmarshal(entry.Command, v); err != nil {
+		return fmt.Errorf("invalid %s command at index %d: %w", entry.Type, entry.Index, err)
+	}
+	return nil
+}
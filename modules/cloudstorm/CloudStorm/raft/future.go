@@ -0,0 +1,153 @@
+// -------------------- raft/future.go --------------------
+package raft
+
+import (
+	"errors"
+	"time"
+)
+
+// defaultProposalTimeout bounds how long the blocking proposal helpers (PostJob,
+// CreateNetwork, ...) wait for their entry to be committed and applied.
+const defaultProposalTimeout = 5 * time.Second
+
+var (
+	// ErrNotLeader is returned for proposals made to a node that is not the leader.
+	ErrNotLeader = errors.New("not the leader")
+	// ErrLeadershipLost is returned when the proposing leader steps down before the entry
+	// is applied. The entry may or may not still be committed by the next leader.
+	ErrLeadershipLost = errors.New("leadership lost before the entry was applied")
+	// ErrProposalTimeout is returned when an entry is not applied within the timeout.
+	// As with ErrLeadershipLost, the outcome of the entry is unknown.
+	ErrProposalTimeout = errors.New("timed out waiting for the entry to be applied")
+	// ErrShutdown is returned for proposals still pending when the node is stopped.
+	ErrShutdown = errors.New("raft node stopped")
+)
+
+// ------------------------------------------------------------------------
+// Proposal Futures
+// ------------------------------------------------------------------------
+
+// ApplyFuture tracks a proposed entry until it is applied to the FSM on the leader that
+// proposed it, or until that can no longer happen.
+type ApplyFuture struct {
+	index    int
+	term     int
+	deadline time.Time // zero means no timeout
+	done     chan struct{}
+	response interface{}
+	err      error
+}
+
+// newApplyFuture creates an unresolved future that times out after timeout (if > 0).
+func newApplyFuture(timeout time.Duration) *ApplyFuture {
+	f := &ApplyFuture{done: make(chan struct{})}
+	if timeout > 0 {
+		f.deadline = time.Now().Add(timeout)
+	}
+	return f
+}
+
+// failedFuture returns a future that is already resolved with err.
+func failedFuture(err error) *ApplyFuture {
+	f := newApplyFuture(0)
+	f.respond(nil, err)
+	return f
+}
+
+// respond resolves the future. Caller holds rn.mutex (or owns f exclusively).
+func (f *ApplyFuture) respond(response interface{}, err error) {
+	f.response, f.err = response, err
+	close(f.done)
+}
+
+// Index returns the log index assigned to the entry, or 0 if it was never appended.
+func (f *ApplyFuture) Index() int {
+	return f.index
+}
+
+// Done is closed once the future is resolved (timeouts are only observed by Wait).
+func (f *ApplyFuture) Done() <-chan struct{} {
+	return f.done
+}
+
+// Wait blocks until the entry is applied and returns the FSM's result for it, or the
+// error that prevented it: the FSM's own error, ErrNotLeader, ErrLeadershipLost,
+// ErrLeadershipTransferInProgress, ErrProposalTimeout or ErrShutdown.
+func (f *ApplyFuture) Wait() (interface{}, error) {
+	if f.deadline.IsZero() {
+		<-f.done
+		return f.response, f.err
+	}
+	timer := time.NewTimer(time.Until(f.deadline))
+	defer timer.Stop()
+	select {
+	case <-f.done:
+		return f.response, f.err
+	case <-timer.C:
+		return nil, ErrProposalTimeout
+	}
+}
+
+// SetProposalTimeout sets how long PostJob, AcceptJob, CreateNetwork and
+// UpdateContainerConsensus wait for their entry to be applied, retries after a leader
+// change included. Zero waits indefinitely.
+func (rn *RaftNode) SetProposalTimeout(timeout time.Duration) {
+	rn.mutex.Lock()
+	defer rn.mutex.Unlock()
+	rn.proposalTimeout = timeout
+}
+
+// Propose appends a command of the given type to the log and returns a future that
+// resolves once the entry is committed and applied on this node, with the FSM's result.
+func (rn *RaftNode) Propose(cmdType string, command interface{}, timeout time.Duration) *ApplyFuture {
+	rn.mutex.Lock()
+	defer rn.mutex.Unlock()
+	return rn.propose(cmdType, command, timeout)
+}
+
+// propose is Propose for callers already holding rn.mutex.
+func (rn *RaftNode) propose(cmdType string, command interface{}, timeout time.Duration) *ApplyFuture {
+	return rn.proposeEntry(cmdType, command, "", 0, timeout)
+}
+
+// proposeEntry appends a command, optionally tagged with a client session, and registers
+// a future for it. Caller holds rn.mutex.
+func (rn *RaftNode) proposeEntry(cmdType string, command interface{}, clientID string, seq uint64, timeout time.Duration) *ApplyFuture {
+	if rn.state != Leader {
+		return failedFuture(ErrNotLeader)
+	}
+	if rn.transferTarget != "" {
+		return failedFuture(ErrLeadershipTransferInProgress)
+	}
+	entry, err := rn.appendEntryAs(cmdType, command, clientID, seq)
+	if err != nil {
+		return failedFuture(err)
+	}
+	f := newApplyFuture(timeout)
+	f.index, f.term = entry.Index, entry.Term
+	rn.pending[entry.Index] = f
+	return f
+}
+
+// resolvePending completes the future waiting on entry, if any. An entry at the same
+// index but from another term means ours was overwritten. Caller holds rn.mutex.
+func (rn *RaftNode) resolvePending(entry LogEntry, response interface{}, err error) {
+	f, ok := rn.pending[entry.Index]
+	if !ok {
+		return
+	}
+	delete(rn.pending, entry.Index)
+	if f.term != entry.Term {
+		f.respond(nil, ErrLeadershipLost)
+		return
+	}
+	f.respond(response, err)
+}
+
+// failPending resolves every outstanding future with err. Caller holds rn.mutex.
+func (rn *RaftNode) failPending(err error) {
+	for index, f := range rn.pending {
+		f.respond(nil, err)
+		delete(rn.pending, index)
+	}
+}
@@ -0,0 +1,406 @@
+// -------------------- raft/groups.go --------------------
+package raft
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// ErrUnknownGroup is returned for a command routed to a raft group this process does not
+// run, e.g. a network that has not been created or whose creation is not applied here yet.
+var ErrUnknownGroup = errors.New("unknown raft group")
+
+// ------------------------------------------------------------------------
+// Multi-Raft Group Manager
+// ------------------------------------------------------------------------
+//
+// A GroupManager runs one independent raft group per CloudStorm Network in a single
+// process, next to a meta group. The meta group is what a plain RaftNode is: it keeps
+// the top-level buckets of the database, owns the Networks and runs the registered
+// (process-wide) command handlers. Each network's group has its own log, term, leader
+// and job queue, stored under bucketGroups/<network ID> in the same database.
+//
+// Groups are created through the meta group's log: when a CmdCreateNetwork entry
+// applies, every member of the meta group starts the network's group with the members
+// recorded in Network.Members: the meta group's voters, filled in by the leader that
+// proposes the network, so every node applies the same list and a restart or a snapshot
+// brings the same groups back. Afterwards a group's membership changes on its own, like
+// any RaftNode's.
+//
+// All groups share one outbound Transport, which tags each RPC with its GroupID, and one
+// inbound handler: the manager itself, which dispatches RPCs by GroupID. An RPC for a
+// group not (yet) running here is refused, as if the peer were unreachable.
+
+// GroupManager runs the raft groups of one process.
+type GroupManager struct {
+	mutex     sync.Mutex
+	id        string
+	db        *bolt.DB
+	tlsConfig *tls.Config
+	dims      []IBTDimension
+	allPorts  bool
+	transport Transport
+	meta      *RaftNode
+	groups    map[string]*RaftNode // network groups by Network.ID
+	setup     []func(groupID string, rn *RaftNode)
+	started   bool
+}
+
+// NewGroupManager opens the database at dbPath and creates the meta group, with the same
+// arguments as NewRaftNode. Network groups start once the manager is started.
+func NewGroupManager(
+	id string,
+	peers []string,
+	dbPath string,
+	tlsCfg *tls.Config,
+	dims []IBTDimension,
+	useAllPorts bool,
+) (*GroupManager, error) {
+
+	db, err := bolt.Open(dbPath, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+	meta, err := newRaftNode(id, "", peers, db, tlsCfg, dims, useAllPorts)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	meta.sharedDB = true
+	shared := NewHTTPTransport(tlsCfg, defaultRPCTimeout)
+	meta.transport = meta.instrument(shared)
+	return &GroupManager{
+		id:        id,
+		db:        db,
+		tlsConfig: tlsCfg,
+		dims:      dims,
+		allPorts:  useAllPorts,
+		transport: shared,
+		meta:      meta,
+		groups:    make(map[string]*RaftNode),
+	}, nil
+}
+
+// Configure runs fn on the meta group now and on every network group before it starts,
+// e.g. to set the advertised address or consensus identity. fn must not call back into
+// the manager.
+func (gm *GroupManager) Configure(fn func(groupID string, rn *RaftNode)) {
+	gm.mutex.Lock()
+	gm.setup = append(gm.setup, fn)
+	groups := gm.snapshotGroups()
+	gm.mutex.Unlock()
+	fn("", gm.meta)
+	for id, rn := range groups {
+		fn(id, rn)
+	}
+}
+
+// SetTransport replaces the transport shared by all groups. Call before Start.
+func (gm *GroupManager) SetTransport(t Transport) {
+	gm.mutex.Lock()
+	gm.transport = t
+	groups := gm.snapshotGroups()
+	gm.mutex.Unlock()
+	gm.meta.SetTransport(t)
+	for id, rn := range groups {
+		rn.SetTransport(groupTransport{Transport: t, group: id})
+	}
+}
+
+// snapshotGroups copies the network groups, so they can be called into without holding
+// gm.mutex: the meta group takes its own lock before gm.mutex (see startGroup). Caller
+// holds gm.mutex.
+func (gm *GroupManager) snapshotGroups() map[string]*RaftNode {
+	groups := make(map[string]*RaftNode, len(gm.groups))
+	for id, rn := range gm.groups {
+		groups[id] = rn
+	}
+	return groups
+}
+
+// Start starts the meta group and the network groups it knows of.
+func (gm *GroupManager) Start() error {
+	gm.mutex.Lock()
+	gm.started = true
+	gm.mutex.Unlock()
+	// Restoring the snapshot into the meta FSM starts the groups of its networks.
+	if err := gm.meta.SetFSM(&metaFSM{nodeFSM: nodeFSM{rn: gm.meta, registry: true}, gm: gm}); err != nil {
+		return err
+	}
+	gm.meta.Start()
+	return nil
+}
+
+// Stop stops every group and closes the database.
+func (gm *GroupManager) Stop() {
+	gm.mutex.Lock()
+	gm.started = false
+	groups := gm.snapshotGroups()
+	gm.mutex.Unlock()
+	gm.meta.Stop()
+	for _, rn := range groups {
+		rn.Stop()
+	}
+	gm.db.Close()
+}
+
+// Meta returns the meta group.
+func (gm *GroupManager) Meta() *RaftNode {
+	return gm.meta
+}
+
+// Group returns the group with the given ID; "" is the meta group.
+func (gm *GroupManager) Group(groupID string) (*RaftNode, bool) {
+	if groupID == "" {
+		return gm.meta, true
+	}
+	gm.mutex.Lock()
+	defer gm.mutex.Unlock()
+	rn, ok := gm.groups[groupID]
+	return rn, ok
+}
+
+// Groups returns the IDs of the network groups running here, sorted.
+func (gm *GroupManager) Groups() []string {
+	gm.mutex.Lock()
+	defer gm.mutex.Unlock()
+	ids := make([]string, 0, len(gm.groups))
+	for id := range gm.groups {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// ------------------------------------------------------------------------
+// Command Routing
+// ------------------------------------------------------------------------
+
+// CreateNetwork creates a network, and with it its raft group, through the meta group.
+func (gm *GroupManager) CreateNetwork(networkID, tokenIssuerAddr, xrplTxID string) error {
+	return gm.meta.CreateNetwork(networkID, tokenIssuerAddr, xrplTxID)
+}
+
+// Propose proposes a command to the given group; "" is the meta group.
+func (gm *GroupManager) Propose(groupID, cmdType string, command interface{}, timeout time.Duration) *ApplyFuture {
+	rn, ok := gm.Group(groupID)
+	if !ok {
+		return failedFuture(ErrUnknownGroup)
+	}
+	return rn.Propose(cmdType, command, timeout)
+}
+
+// PostJob queues a job in the group of the network it belongs to.
+func (gm *GroupManager) PostJob(networkID string, job Job) error {
+	rn, ok := gm.Group(networkID)
+	if !ok {
+		return ErrUnknownGroup
+	}
+	return rn.PostJob(job)
+}
+
+// AcceptJob accepts a job in the group of the network it belongs to.
+func (gm *GroupManager) AcceptJob(networkID, jobID string) error {
+	rn, ok := gm.Group(networkID)
+	if !ok {
+		return ErrUnknownGroup
+	}
+	return rn.AcceptJob(jobID)
+}
+
+// GetJob returns the applied job with the given ID from its network's group.
+func (gm *GroupManager) GetJob(networkID, jobID string) (Job, bool) {
+	rn, ok := gm.Group(networkID)
+	if !ok {
+		return Job{}, false
+	}
+	return rn.GetJob(jobID)
+}
+
+// ------------------------------------------------------------------------
+// Group Lifecycle
+// ------------------------------------------------------------------------
+
+// metaFSM is the meta group's state machine: the node's own, plus starting the group of
+// every network it creates or restores.
+type metaFSM struct {
+	nodeFSM
+	gm *GroupManager
+}
+
+// Apply records the group's members in a new network and starts its group.
+func (f *metaFSM) Apply(entry LogEntry) (interface{}, error) {
+	if entry.Type != CmdCreateNetwork {
+		return f.nodeFSM.Apply(entry)
+	}
+	var netw Network
+	if err := decodeCommand(entry, &netw); err != nil {
+		return nil, err
+	}
+	if len(netw.Members) == 0 {
+		// Proposed without members, as by the simulator: every node derives the same
+		// list from the configuration in force at this index.
+		cfg, _ := f.rn.configAt(entry.Index)
+		netw.Members = groupMembers(cfg)
+		data, err := json.Marshal(netw)
+		if err != nil {
+			return nil, err
+		}
+		entry.Command = data
+	}
+	resp, err := f.nodeFSM.Apply(entry)
+	if err == nil {
+		f.gm.startGroup(netw.ID, netw.Members, f.rn.addr)
+	}
+	return resp, err
+}
+
+// groupMembers returns the voters of cfg in sorted order, the members a new network's
+// group starts with. The order of cfg.Members differs between nodes (the bootstrap
+// configuration puts each node's own address first), so it is not replicated as is.
+func groupMembers(cfg Configuration) []string {
+	members := append([]string(nil), cfg.Members...)
+	sort.Strings(members)
+	return members
+}
+
+// Restore starts the group of every network in the snapshot.
+func (f *metaFSM) Restore(data json.RawMessage) error {
+	if err := f.nodeFSM.Restore(data); err != nil {
+		return err
+	}
+	for _, netw := range f.rn.Networks {
+		f.gm.startGroup(netw.ID, netw.Members, f.rn.addr)
+	}
+	return nil
+}
+
+// startGroup starts the group of a network if this process, reached at addr, is one of
+// its members and it is not running yet. Called with the meta group's lock held.
+func (gm *GroupManager) startGroup(groupID string, members []string, addr string) {
+	gm.mutex.Lock()
+	defer gm.mutex.Unlock()
+	if !gm.started || gm.groups[groupID] != nil || groupID == "" {
+		return
+	}
+	var peers []string
+	member := false
+	for _, m := range members {
+		if m == addr {
+			member = true
+		} else {
+			peers = append(peers, m)
+		}
+	}
+	if !member {
+		return
+	}
+	rn, err := newRaftNode(gm.id, groupID, peers, gm.db, gm.tlsConfig, gm.dims, gm.allPorts)
+	if err != nil {
+		log.Printf("Failed to start raft group %s: %v", groupID, err)
+		return
+	}
+	rn.sharedDB = true
+	rn.transport = rn.instrument(groupTransport{Transport: gm.transport, group: groupID})
+	rn.SetAdvertiseAddr(addr)
+	for _, fn := range gm.setup {
+		fn(groupID, rn)
+	}
+	gm.groups[groupID] = rn
+	rn.Start()
+	log.Printf("Raft group %s started with members %v", groupID, members)
+}
+
+// ------------------------------------------------------------------------
+// Shared Transport
+// ------------------------------------------------------------------------
+
+// groupTransport tags the RPCs of one group with its ID.
+type groupTransport struct {
+	Transport
+	group string
+}
+
+func (t groupTransport) RequestVote(peer string, req VoteRequest) (VoteResponse, error) {
+	req.GroupID = t.group
+	return t.Transport.RequestVote(peer, req)
+}
+
+func (t groupTransport) AppendEntries(peer string, req AppendEntriesRequest) (AppendEntriesResponse, error) {
+	req.GroupID = t.group
+	return t.Transport.AppendEntries(peer, req)
+}
+
+func (t groupTransport) InstallSnapshot(peer string, req InstallSnapshotRequest) (InstallSnapshotResponse, error) {
+	req.GroupID = t.group
+	return t.Transport.InstallSnapshot(peer, req)
+}
+
+func (t groupTransport) TimeoutNow(peer string, req TimeoutNowRequest) (TimeoutNowResponse, error) {
+	req.GroupID = t.group
+	return t.Transport.TimeoutNow(peer, req)
+}
+
+func (t groupTransport) ForwardJob(peer string, req JobForwardRequest) (JobForwardResponse, error) {
+	req.GroupID = t.group
+	return t.Transport.ForwardJob(peer, req)
+}
+
+// Handler returns an http.Handler serving the raft RPCs of every group, on the same
+// paths as RaftNode.Handler.
+func (gm *GroupManager) Handler() http.Handler {
+	return rpcHandler(gm)
+}
+
+// HandleVoteRequest dispatches a vote request to its group.
+func (gm *GroupManager) HandleVoteRequest(req VoteRequest) VoteResponse {
+	rn, ok := gm.Group(req.GroupID)
+	if !ok {
+		return VoteResponse{}
+	}
+	return rn.HandleVoteRequest(req)
+}
+
+// HandleAppendEntries dispatches an AppendEntries request to its group.
+func (gm *GroupManager) HandleAppendEntries(req AppendEntriesRequest) AppendEntriesResponse {
+	rn, ok := gm.Group(req.GroupID)
+	if !ok {
+		return AppendEntriesResponse{Rejected: true}
+	}
+	return rn.HandleAppendEntries(req)
+}
+
+// HandleInstallSnapshot dispatches an InstallSnapshot request to its group.
+func (gm *GroupManager) HandleInstallSnapshot(req InstallSnapshotRequest) InstallSnapshotResponse {
+	rn, ok := gm.Group(req.GroupID)
+	if !ok {
+		return InstallSnapshotResponse{Rejected: true}
+	}
+	return rn.HandleInstallSnapshot(req)
+}
+
+// HandleTimeoutNow dispatches a TimeoutNow request to its group.
+func (gm *GroupManager) HandleTimeoutNow(req TimeoutNowRequest) TimeoutNowResponse {
+	rn, ok := gm.Group(req.GroupID)
+	if !ok {
+		return TimeoutNowResponse{}
+	}
+	return rn.HandleTimeoutNow(req)
+}
+
+// HandleForwardJob dispatches a forwarded job transition to its group.
+func (gm *GroupManager) HandleForwardJob(req JobForwardRequest) JobForwardResponse {
+	rn, ok := gm.Group(req.GroupID)
+	if !ok {
+		return forwardResponse(ErrUnknownGroup)
+	}
+	return rn.HandleForwardJob(req)
+}
@@ -0,0 +1,42 @@
+// -------------------- raft/groups_test.go --------------------
+package raft
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// TestNetworkMembersDeterministic applies a network created without members on nodes
+// whose bootstrap configurations list the same voters in different orders, and checks
+// that every node records, and would start the group with, the same members.
+func TestNetworkMembersDeterministic(t *testing.T) {
+	peers := map[string][]string{
+		"n1": {"n2", "n3"},
+		"n2": {"n3", "n1"},
+		"n3": {"n1", "n2"},
+	}
+	want := []string{"n1", "n2", "n3"}
+	for id, p := range peers {
+		gm, err := NewGroupManager(id, p, filepath.Join(t.TempDir(), id+".db"), nil, nil, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(gm.Stop)
+		f := &metaFSM{nodeFSM: nodeFSM{rn: gm.meta, registry: true}, gm: gm}
+
+		gm.meta.mutex.Lock()
+		entry, err := gm.meta.appendEntry(CmdCreateNetwork, Network{ID: "net"})
+		if err == nil {
+			_, err = f.Apply(entry)
+		}
+		netw := gm.meta.Networks["net"]
+		gm.meta.mutex.Unlock()
+		if err != nil {
+			t.Fatalf("%s: %v", id, err)
+		}
+		if !reflect.DeepEqual(netw.Members, want) {
+			t.Errorf("%s recorded members %v, want %v", id, netw.Members, want)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+// -------------------- raft/history.go --------------------
+package raft
+
+import (
+	"errors"
+	"math"
+	"sync"
+)
+
+// Operation kinds recorded by a HistoryRecorder.
+const (
+	OpPostJob       = "post_job"
+	OpAcceptJob     = "accept_job"
+	OpCreateNetwork = "create_network"
+	OpReadJob       = "read_job"
+	OpReadNetwork   = "read_network"
+)
+
+// Operation outcomes. A read's outcome is instead the value it observed: OutcomeAbsent,
+// a job status, or OutcomePresent for a network.
+const (
+	OutcomeOK        = "ok"
+	OutcomeExists    = "exists"
+	OutcomeNotFound  = "not_found"
+	OutcomeNotQueued = "not_queued"
+	OutcomeUnknown   = "unknown" // the call failed in a way that leaves its effect open
+	OutcomeAbsent    = "absent"
+	OutcomePresent   = "present"
+)
+
+// ------------------------------------------------------------------------
+// Operation Histories
+// ------------------------------------------------------------------------
+//
+// A history is what the clients of the cluster observed: each call with its arguments,
+// its outcome, and when it was invoked and returned. Times come from one logical clock
+// shared by every client of a recorder, which is all linearizability needs: whether one
+// operation finished before another started.
+//
+// A call that failed before its command reached the log (ErrNotLeader, a failed read)
+// had no effect and is dropped. A call whose command may or may not be applied (a
+// timeout, lost leadership, shutdown) stays in the history with an unknown outcome and
+// no return time, so the checker may place it anywhere after its invocation.
+
+// Operation is one client call in a history.
+type Operation struct {
+	ClientID int    `json:"client_id"`
+	Kind     string `json:"kind"`
+	Key      string `json:"key"` // job or network ID
+	Outcome  string `json:"outcome"`
+	Call     int64  `json:"call"`
+	Return   int64  `json:"return"` // math.MaxInt64 while the outcome is unknown
+}
+
+// HistoryRecorder records the operations of concurrent clients. It is safe for
+// concurrent use.
+type HistoryRecorder struct {
+	mutex   sync.Mutex
+	clock   int64
+	ops     []Operation
+	dropped map[int]bool
+}
+
+// NewHistoryRecorder returns an empty recorder.
+func NewHistoryRecorder() *HistoryRecorder {
+	return &HistoryRecorder{dropped: make(map[int]bool)}
+}
+
+// Begin records the invocation of an operation and returns its handle for End or Drop.
+func (h *HistoryRecorder) Begin(clientID int, kind, key string) int {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.clock++
+	h.ops = append(h.ops, Operation{
+		ClientID: clientID,
+		Kind:     kind,
+		Key:      key,
+		Outcome:  OutcomeUnknown,
+		Call:     h.clock,
+		Return:   math.MaxInt64,
+	})
+	return len(h.ops) - 1
+}
+
+// End records the outcome of an operation. An unknown outcome leaves it open.
+func (h *HistoryRecorder) End(id int, outcome string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if outcome == OutcomeUnknown {
+		return
+	}
+	h.clock++
+	h.ops[id].Outcome = outcome
+	h.ops[id].Return = h.clock
+}
+
+// Drop removes an operation that is known to have had no effect.
+func (h *HistoryRecorder) Drop(id int) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.dropped[id] = true
+}
+
+// History returns the operations recorded so far. Operations still in progress are
+// included with an unknown outcome.
+func (h *HistoryRecorder) History() []Operation {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	out := make([]Operation, 0, len(h.ops))
+	for id, op := range h.ops {
+		if !h.dropped[id] {
+			out = append(out, op)
+		}
+	}
+	return out
+}
+
+// endWrite records the outcome of a write call that returned err.
+func (h *HistoryRecorder) endWrite(id int, err error) {
+	switch {
+	case err == nil:
+		h.End(id, OutcomeOK)
+	case errors.Is(err, ErrJobExists), errors.Is(err, ErrNetworkExists):
+		h.End(id, OutcomeExists)
+	case errors.Is(err, ErrJobNotFound):
+		h.End(id, OutcomeNotFound)
+	case errors.Is(err, ErrJobNotQueued):
+		h.End(id, OutcomeNotQueued)
+	case errors.Is(err, ErrNotLeader), errors.Is(err, ErrLeadershipTransferInProgress):
+		h.Drop(id) // refused before anything was appended
+	default:
+		h.End(id, OutcomeUnknown)
+	}
+}
+
+// PostJob calls rn.PostJob on behalf of a client and records it.
+func (h *HistoryRecorder) PostJob(clientID int, rn *RaftNode, job Job) error {
+	id := h.Begin(clientID, OpPostJob, job.ID)
+	err := rn.PostJob(job)
+	h.endWrite(id, err)
+	return err
+}
+
+// AcceptJob calls rn.AcceptJob on behalf of a client and records it.
+func (h *HistoryRecorder) AcceptJob(clientID int, rn *RaftNode, jobID string) error {
+	id := h.Begin(clientID, OpAcceptJob, jobID)
+	err := rn.AcceptJob(jobID)
+	h.endWrite(id, err)
+	return err
+}
+
+// CreateNetwork calls rn.CreateNetwork on behalf of a client and records it. A failed
+// license verification is recorded as unknown, which the checker always accepts.
+func (h *HistoryRecorder) CreateNetwork(clientID int, rn *RaftNode, networkID, tokenIssuerAddr, xrplTxID string) error {
+	id := h.Begin(clientID, OpCreateNetwork, networkID)
+	err := rn.CreateNetwork(networkID, tokenIssuerAddr, xrplTxID)
+	h.endWrite(id, err)
+	return err
+}
+
+// ReadJob performs a linearizable read of a job on behalf of a client and records it.
+func (h *HistoryRecorder) ReadJob(clientID int, rn *RaftNode, jobID string) (Job, bool, error) {
+	id := h.Begin(clientID, OpReadJob, jobID)
+	if _, err := rn.ReadIndex(defaultReadTimeout); err != nil {
+		h.Drop(id)
+		return Job{}, false, err
+	}
+	job, ok := rn.GetJob(jobID)
+	h.End(id, jobOutcome(job, ok))
+	return job, ok, nil
+}
+
+// ReadNetwork performs a linearizable read of a network on behalf of a client and
+// records it.
+func (h *HistoryRecorder) ReadNetwork(clientID int, rn *RaftNode, networkID string) (Network, bool, error) {
+	id := h.Begin(clientID, OpReadNetwork, networkID)
+	if _, err := rn.ReadIndex(defaultReadTimeout); err != nil {
+		h.Drop(id)
+		return Network{}, false, err
+	}
+	netw, ok := rn.GetNetwork(networkID)
+	h.End(id, networkOutcome(ok))
+	return netw, ok, nil
+}
+
+// jobOutcome is the outcome recorded for a read that observed job.
+func jobOutcome(job Job, ok bool) string {
+	if !ok {
+		return OutcomeAbsent
+	}
+	return job.Status
+}
+
+// networkOutcome is the outcome recorded for a read of a network.
+func networkOutcome(ok bool) string {
+	if !ok {
+		return OutcomeAbsent
+	}
+	return OutcomePresent
+}
@@ -0,0 +1,234 @@
+// -------------------- raft/jobs.go --------------------
+package raft
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Job statuses.
+const (
+	JobQueued    = "queued"
+	JobAccepted  = "accepted" // leased to Job.Worker, not started yet
+	JobRunning   = "running"
+	JobCompleted = "completed"
+	JobFailed    = "failed" // out of attempts
+)
+
+// Commands driving a job after CmdAcceptJob. Command is a JobTransition.
+const (
+	CmdStartJob       = "job.start"
+	CmdHeartbeatJob   = "job.heartbeat"
+	CmdCompleteJob    = "job.complete"
+	CmdFailJob        = "job.fail"
+	CmdExpireJobLease = "job.expire"
+)
+
+const (
+	// jobLease is how long a worker holds a job without a heartbeat.
+	jobLease = 30 * time.Second
+	// defaultJobMaxAttempts bounds the attempts of a job that sets no MaxAttempts.
+	defaultJobMaxAttempts = 3
+	// jobRetryBackoff is the wait before a job's second attempt; it doubles with every
+	// further attempt, up to jobMaxRetryBackoff.
+	jobRetryBackoff    = time.Second
+	jobMaxRetryBackoff = time.Minute
+	// leaseScanInterval is how often a leader looks for expired leases.
+	leaseScanInterval = time.Second
+)
+
+var (
+	// ErrJobNotActive is returned for a transition of a job that is not accepted or
+	// running.
+	ErrJobNotActive = errors.New("job is not accepted or running")
+	// ErrNotJobWorker is returned for a transition by a worker that does not hold the
+	// job's lease.
+	ErrNotJobWorker = errors.New("job is leased to another worker")
+	// ErrJobBackoff is returned when accepting a failed job before its retry backoff has
+	// passed.
+	ErrJobBackoff = errors.New("job is backing off before its next attempt")
+)
+
+// ------------------------------------------------------------------------
+// Job Lifecycle
+// ------------------------------------------------------------------------
+//
+//	queued --accept--> accepted --start--> running --complete--> completed
+//	   ^                   |                  |
+//	   +-- fail / lease expiry, attempts left-+--- out of attempts --> failed
+//
+// Accepting a job leases it to a worker for jobLease; the worker renews the lease with
+// heartbeats (starting the job renews it too) and gives it up by completing or failing
+// the job. A failure, or a lease that ran out because the worker died, returns the job
+// to the queue until it has used up its attempts, and each retry waits twice as long
+// before it may be accepted again.
+//
+// Every time the state machine compares is taken from the command (JobTransition.At),
+// so all nodes apply a transition alike. The leader stamps it with its own clock when
+// it proposes the transition, whatever the worker's clock said, so leases and backoffs
+// are measured on the clock that expires them: the leader scans for expired leases and
+// proposes CmdExpireJobLease, which only takes effect if the lease it names is still
+// held and still expired.
+
+// jobActive reports whether a job is leased to a worker.
+func jobActive(job Job) bool {
+	return job.Status == JobAccepted || job.Status == JobRunning
+}
+
+// maxAttempts returns how many times a job may be accepted.
+func (job Job) maxAttempts() int {
+	if job.MaxAttempts > 0 {
+		return job.MaxAttempts
+	}
+	return defaultJobMaxAttempts
+}
+
+// retryBackoff returns the wait after a job's attempt-th failed attempt.
+func retryBackoff(attempt int) time.Duration {
+	d := jobRetryBackoff
+	for i := 1; i < attempt && d < jobMaxRetryBackoff; i++ {
+		d *= 2
+	}
+	if d > jobMaxRetryBackoff {
+		d = jobMaxRetryBackoff
+	}
+	return d
+}
+
+// applyJobTransition applies one of the commands moving an existing job.
+// Caller holds rn.mutex.
+func (rn *RaftNode) applyJobTransition(entry LogEntry) (interface{}, error) {
+	var tr JobTransition
+	if err := decodeCommand(entry, &tr); err != nil {
+		return nil, err
+	}
+	job, ok := rn.jobQueue[tr.JobID]
+	if !ok {
+		return nil, fmt.Errorf("job %s: %w", tr.JobID, ErrJobNotFound)
+	}
+	if entry.Type == CmdAcceptJob {
+		if job.Status != JobQueued {
+			return nil, fmt.Errorf("job %s: %w", tr.JobID, ErrJobNotQueued)
+		}
+		if tr.At < job.NotBefore {
+			return nil, fmt.Errorf("job %s: %w", tr.JobID, ErrJobBackoff)
+		}
+		job.Status, job.Worker, job.Error = JobAccepted, tr.Worker, ""
+		job.Attempts++
+		job.renewLease(tr.At)
+		rn.setJob(entry, job)
+		return job, nil
+	}
+
+	if !jobActive(job) {
+		return nil, fmt.Errorf("job %s: %w", tr.JobID, ErrJobNotActive)
+	}
+	if tr.Worker != job.Worker {
+		return nil, fmt.Errorf("job %s: %w", tr.JobID, ErrNotJobWorker)
+	}
+	switch entry.Type {
+	case CmdStartJob:
+		job.Status = JobRunning
+		job.renewLease(tr.At)
+	case CmdHeartbeatJob:
+		job.renewLease(tr.At)
+	case CmdCompleteJob:
+		job.Status, job.ResultCID, job.LeaseExpires = JobCompleted, tr.ResultCID, 0
+		rn.noteOnboarded(job)
+	case CmdFailJob:
+		job.retryOrFail(tr.At, tr.Error)
+	case CmdExpireJobLease:
+		if tr.Attempt != job.Attempts || job.LeaseExpires == 0 || job.LeaseExpires > tr.At {
+			return job, nil // renewed or retried since the leader saw it expire
+		}
+		job.retryOrFail(tr.At, "lease expired")
+	}
+	rn.setJob(entry, job)
+	return job, nil
+}
+
+// setJob stores the state entry moved a job to. Caller holds rn.mutex.
+func (rn *RaftNode) setJob(entry LogEntry, job Job) {
+	rn.jobQueue[job.ID] = job
+	rn.events.publish(rn, Event{Type: EventJobUpdated, Index: entry.Index, Job: job.ID})
+}
+
+// renewLease extends the job's lease from at. Transitions logged without a time (by
+// older nodes) leave the job without a lease.
+func (job *Job) renewLease(at int64) {
+	job.LeaseExpires = 0
+	if at != 0 {
+		job.LeaseExpires = at + int64(jobLease)
+	}
+}
+
+// retryOrFail ends the current attempt at time at with a failure, queueing the job for
+// another attempt after its backoff or failing it for good.
+func (job *Job) retryOrFail(at int64, reason string) {
+	job.Error, job.Worker, job.LeaseExpires = reason, "", 0
+	if job.Attempts >= job.maxAttempts() {
+		job.Status = JobFailed
+		return
+	}
+	job.Status = JobQueued
+	job.NotBefore = at + int64(retryBackoff(job.Attempts))
+}
+
+// StartJob marks a job accepted by worker as running, renewing its lease. Like the other
+// transitions below it is forwarded to the leader when called on a follower, which only
+// accepts it for this node as worker.
+func (rn *RaftNode) StartJob(jobID, worker string) error {
+	return rn.submit(CmdStartJob, rn.jobTransition(jobID, worker))
+}
+
+// HeartbeatJob renews worker's lease on a job.
+func (rn *RaftNode) HeartbeatJob(jobID, worker string) error {
+	return rn.submit(CmdHeartbeatJob, rn.jobTransition(jobID, worker))
+}
+
+// CompleteJob marks a job as completed by worker, recording where its result is stored
+// (e.g. an IPFS CID).
+func (rn *RaftNode) CompleteJob(jobID, worker, resultCID string) error {
+	tr := rn.jobTransition(jobID, worker)
+	tr.ResultCID = resultCID
+	return rn.submit(CmdCompleteJob, tr)
+}
+
+// FailJob reports that worker's attempt at a job failed. The job is queued for a retry
+// unless it has run out of attempts.
+func (rn *RaftNode) FailJob(jobID, worker, reason string) error {
+	tr := rn.jobTransition(jobID, worker)
+	tr.Error = reason
+	return rn.submit(CmdFailJob, tr)
+}
+
+// jobTransition returns a transition by worker stamped with the node's clock, until the
+// leader stamps it with its own.
+func (rn *RaftNode) jobTransition(jobID, worker string) JobTransition {
+	return JobTransition{JobID: jobID, Worker: worker, At: rn.clock().UnixNano()}
+}
+
+// expireJobLeases proposes the expiry of every lease that has run out, at most once per
+// leaseScanInterval and once per attempt.
+func (rn *RaftNode) expireJobLeases() {
+	rn.mutex.Lock()
+	defer rn.mutex.Unlock()
+	now := rn.clock()
+	if rn.state != Leader || now.Sub(rn.lastLeaseScan) < leaseScanInterval {
+		return
+	}
+	rn.lastLeaseScan = now
+	for id, job := range rn.jobQueue {
+		if !jobActive(job) {
+			delete(rn.expiring, id)
+			continue
+		}
+		if job.LeaseExpires == 0 || job.LeaseExpires > now.UnixNano() || rn.expiring[id] == job.Attempts {
+			continue
+		}
+		rn.expiring[id] = job.Attempts
+		tr := JobTransition{JobID: id, Worker: job.Worker, Attempt: job.Attempts, At: now.UnixNano()}
+		rn.propose(CmdExpireJobLease, tr, rn.proposalTimeout)
+	}
+}
@@ -0,0 +1,224 @@
+// -------------------- raft/linearizability.go --------------------
+package raft
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ------------------------------------------------------------------------
+// Linearizability Checking
+// ------------------------------------------------------------------------
+//
+// A history is linearizable if every operation can be placed at a single instant between
+// its invocation and its return such that, in that order, the outcomes match a
+// sequential model. The checker is the Wing & Gong search with Lowe's memoization, as in
+// Porcupine and Knossos: it repeatedly linearizes the first pending call the model
+// accepts, backtracks when it reaches a return whose call it could not place, and skips
+// (linearized set, state) pairs it has already explored. The model's Partition splits a
+// history into independent keys so each is searched on its own.
+
+// Model is a sequential specification to check histories against. States are canonical
+// strings so the checker can memoize them.
+type Model struct {
+	// Partition splits a history into sub-histories that share no state. Nil checks the
+	// history as a whole.
+	Partition func(history []Operation) [][]Operation
+	// Init returns the initial state.
+	Init func() string
+	// Step applies op to state. It reports whether op's outcome is possible from state,
+	// and the state after op.
+	Step func(state string, op Operation) (bool, string)
+}
+
+// JobQueueModel specifies the jobs and networks the RaftNode replicates, one key at a
+// time: a job is absent, queued or accepted, and a network absent or present.
+var JobQueueModel = Model{
+	Partition: partitionByKey,
+	Init:      func() string { return OutcomeAbsent },
+	Step:      jobQueueStep,
+}
+
+// jobQueueStep is the sequential behaviour of PostJob, AcceptJob, CreateNetwork and the
+// reads on a single job or network.
+func jobQueueStep(state string, op Operation) (bool, string) {
+	next, outcome := state, OutcomeOK
+	switch op.Kind {
+	case OpPostJob:
+		if state == OutcomeAbsent {
+			next = JobQueued
+		} else {
+			outcome = OutcomeExists
+		}
+	case OpAcceptJob:
+		switch state {
+		case OutcomeAbsent:
+			outcome = OutcomeNotFound
+		case JobQueued:
+			next = JobAccepted
+		default:
+			outcome = OutcomeNotQueued
+		}
+	case OpCreateNetwork:
+		if state == OutcomeAbsent {
+			next = OutcomePresent
+		} else {
+			outcome = OutcomeExists
+		}
+	case OpReadJob, OpReadNetwork:
+		outcome = state
+	default:
+		return false, state
+	}
+	return op.Outcome == OutcomeUnknown || op.Outcome == outcome, next
+}
+
+// partitionByKey groups operations by the job or network they act on.
+func partitionByKey(history []Operation) [][]Operation {
+	byKey := make(map[string][]Operation)
+	for _, op := range history {
+		key := "job/" + op.Key
+		if op.Kind == OpCreateNetwork || op.Kind == OpReadNetwork {
+			key = "network/" + op.Key
+		}
+		byKey[key] = append(byKey[key], op)
+	}
+	keys := make([]string, 0, len(byKey))
+	for k := range byKey {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	out := make([][]Operation, 0, len(keys))
+	for _, k := range keys {
+		out = append(out, byKey[k])
+	}
+	return out
+}
+
+// LinearizabilityError reports a sub-history that admits no linearization.
+type LinearizabilityError struct {
+	Operations []Operation
+}
+
+func (e *LinearizabilityError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "history of %d operations on %q is not linearizable:", len(e.Operations), e.Operations[0].Key)
+	for _, op := range e.Operations {
+		ret := "?"
+		if op.Outcome != OutcomeUnknown {
+			ret = fmt.Sprint(op.Return)
+		}
+		fmt.Fprintf(&b, "\n  client %d %s -> %s [%d, %s]", op.ClientID, op.Kind, op.Outcome, op.Call, ret)
+	}
+	return b.String()
+}
+
+// CheckLinearizable checks history against m and returns a *LinearizabilityError for
+// the first sub-history that is not linearizable.
+func CheckLinearizable(m Model, history []Operation) error {
+	parts := [][]Operation{history}
+	if m.Partition != nil {
+		parts = m.Partition(history)
+	}
+	for _, ops := range parts {
+		if len(ops) > 0 && !checkOperations(m, ops) {
+			return &LinearizabilityError{Operations: ops}
+		}
+	}
+	return nil
+}
+
+// lzEntry is a call or return event in the checker's doubly linked list.
+type lzEntry struct {
+	op         int // index of the operation
+	call       bool
+	time       int64
+	match      *lzEntry // a call's return event
+	prev, next *lzEntry
+}
+
+// lzFrame records a linearized call so the search can backtrack over it.
+type lzFrame struct {
+	entry *lzEntry
+	state string
+}
+
+// checkOperations searches for a linearization of ops.
+func checkOperations(m Model, ops []Operation) bool {
+	events := make([]*lzEntry, 0, 2*len(ops))
+	for i, op := range ops {
+		ret := &lzEntry{op: i, time: op.Return}
+		events = append(events, &lzEntry{op: i, call: true, time: op.Call, match: ret}, ret)
+	}
+	sort.SliceStable(events, func(a, b int) bool {
+		if events[a].time != events[b].time {
+			return events[a].time < events[b].time
+		}
+		return events[a].call && !events[b].call
+	})
+	head := &lzEntry{}
+	prev := head
+	for _, e := range events {
+		e.prev, prev.next = prev, e
+		prev = e
+	}
+
+	linearized := make([]byte, (len(ops)+7)/8)
+	seen := make(map[string]bool)
+	var stack []lzFrame
+	state := m.Init()
+	entry := head.next
+	for head.next != nil {
+		if entry.call {
+			if ok, next := m.Step(state, ops[entry.op]); ok {
+				linearized[entry.op/8] |= 1 << (entry.op % 8)
+				key := string(linearized) + "\x00" + next
+				if !seen[key] {
+					seen[key] = true
+					stack = append(stack, lzFrame{entry, state})
+					state = next
+					entry.lift()
+					entry = head.next
+					continue
+				}
+				linearized[entry.op/8] &^= 1 << (entry.op % 8)
+			}
+			entry = entry.next
+			continue
+		}
+		// A return whose call has not been placed: undo the latest choice.
+		if len(stack) == 0 {
+			return false
+		}
+		top := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		entry, state = top.entry, top.state
+		linearized[entry.op/8] &^= 1 << (entry.op % 8)
+		entry.unlift()
+		entry = entry.next
+	}
+	return true
+}
+
+// lift removes a call and its return from the list.
+func (e *lzEntry) lift() {
+	e.prev.next = e.next
+	e.next.prev = e.prev // a call is always followed by its return
+	r := e.match
+	r.prev.next = r.next
+	if r.next != nil {
+		r.next.prev = r.prev
+	}
+}
+
+// unlift reinserts a call and its return lifted by lift.
+func (e *lzEntry) unlift() {
+	r := e.match
+	r.prev.next = r
+	if r.next != nil {
+		r.next.prev = r
+	}
+	e.prev.next = e
+	e.next.prev = e
+}
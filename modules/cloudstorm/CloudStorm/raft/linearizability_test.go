@@ -0,0 +1,124 @@
+// -------------------- raft/linearizability_test.go --------------------
+package raft
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"testing"
+)
+
+// histOp builds an operation of a hand-written history; ret < 0 leaves the outcome open.
+func histOp(client int, kind, key, outcome string, call, ret int64) Operation {
+	if ret < 0 {
+		ret = math.MaxInt64
+	}
+	return Operation{ClientID: client, Kind: kind, Key: key, Outcome: outcome, Call: call, Return: ret}
+}
+
+func TestCheckLinearizable(t *testing.T) {
+	tests := []struct {
+		name    string
+		history []Operation
+		ok      bool
+	}{
+		{"sequential post, accept, read", []Operation{
+			histOp(0, OpPostJob, "j", OutcomeOK, 1, 2),
+			histOp(0, OpAcceptJob, "j", OutcomeOK, 3, 4),
+			histOp(1, OpReadJob, "j", JobAccepted, 5, 6),
+		}, true},
+		{"read overlapping the post may miss it", []Operation{
+			histOp(0, OpPostJob, "j", OutcomeOK, 1, 4),
+			histOp(1, OpReadJob, "j", OutcomeAbsent, 2, 3),
+		}, true},
+		{"concurrent accepts, one wins", []Operation{
+			histOp(0, OpPostJob, "j", OutcomeOK, 1, 2),
+			histOp(0, OpAcceptJob, "j", OutcomeNotQueued, 3, 6),
+			histOp(1, OpAcceptJob, "j", OutcomeOK, 4, 5),
+		}, true},
+		{"unknown outcome placed after a later read", []Operation{
+			histOp(0, OpPostJob, "j", OutcomeUnknown, 1, -1),
+			histOp(1, OpReadJob, "j", OutcomeAbsent, 2, 3),
+			histOp(1, OpReadJob, "j", JobQueued, 4, 5),
+		}, true},
+		{"stale read after the post returned", []Operation{
+			histOp(0, OpPostJob, "j", OutcomeOK, 1, 2),
+			histOp(1, OpReadJob, "j", OutcomeAbsent, 3, 4),
+		}, false},
+		{"job posted twice", []Operation{
+			histOp(0, OpPostJob, "j", OutcomeOK, 1, 2),
+			histOp(1, OpPostJob, "j", OutcomeOK, 3, 4),
+		}, false},
+		{"both concurrent accepts win", []Operation{
+			histOp(0, OpPostJob, "j", OutcomeOK, 1, 2),
+			histOp(0, OpAcceptJob, "j", OutcomeOK, 3, 6),
+			histOp(1, OpAcceptJob, "j", OutcomeOK, 4, 5),
+		}, false},
+		{"network reappears absent", []Operation{
+			histOp(0, OpCreateNetwork, "n", OutcomeOK, 1, 4),
+			histOp(1, OpReadNetwork, "n", OutcomePresent, 2, 3),
+			histOp(2, OpReadNetwork, "n", OutcomeAbsent, 5, 6),
+		}, false},
+	}
+	for _, tt := range tests {
+		err := CheckLinearizable(JobQueueModel, tt.history)
+		var lzErr *LinearizabilityError
+		switch {
+		case tt.ok && err != nil:
+			t.Errorf("%s: %v", tt.name, err)
+		case !tt.ok && !errors.As(err, &lzErr):
+			t.Errorf("%s: got %v, want a LinearizabilityError", tt.name, err)
+		}
+	}
+}
+
+// TestCheckLinearizableKeys checks that a violation on one key is reported even when
+// every other key is linearizable.
+func TestCheckLinearizableKeys(t *testing.T) {
+	var history []Operation
+	for i := 0; i < 5; i++ {
+		key := fmt.Sprintf("j%d", i)
+		history = append(history,
+			histOp(i, OpPostJob, key, OutcomeOK, int64(4*i+1), int64(4*i+2)),
+			histOp(i, OpReadJob, key, JobQueued, int64(4*i+3), int64(4*i+4)))
+	}
+	if err := CheckLinearizable(JobQueueModel, history); err != nil {
+		t.Fatal(err)
+	}
+	history = append(history, histOp(9, OpReadJob, "j2", OutcomeAbsent, 100, 101))
+	var lzErr *LinearizabilityError
+	if err := CheckLinearizable(JobQueueModel, history); !errors.As(err, &lzErr) {
+		t.Fatalf("got %v, want a LinearizabilityError", err)
+	} else if lzErr.Operations[0].Key != "j2" {
+		t.Fatalf("reported key %q, want j2", lzErr.Operations[0].Key)
+	}
+}
+
+// TestSimulatedHistories checks that the histories recorded against simulated clusters,
+// faults included, are accepted.
+func TestSimulatedHistories(t *testing.T) {
+	for seed := int64(100); seed < 104; seed++ {
+		s, err := NewSimulator(SimConfig{Seed: seed, Dir: t.TempDir(), FaultRate: 0.005, DropRate: 0.02, ClientRate: 0.5})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Run(1500); err != nil {
+			s.Close()
+			t.Fatal(err)
+		}
+		history := s.History()
+		s.Close()
+		completed := 0
+		for _, o := range history {
+			if o.Outcome != OutcomeUnknown {
+				completed++
+			}
+		}
+		if completed < 50 {
+			t.Fatalf("seed %d: only %d of %d operations completed", seed, completed, len(history))
+		}
+		if err := CheckLinearizable(JobQueueModel, history); err != nil {
+			t.Fatalf("seed %d: %v", seed, err)
+		}
+	}
+}
@@ -0,0 +1,374 @@
+// -------------------- raft/membership.go --------------------
+package raft
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+)
+
+// ErrConfigChangeInProgress is returned for a membership change proposed while the
+// previous one has not committed yet.
+var ErrConfigChangeInProgress = errors.New("a configuration change is already in progress")
+
+// ------------------------------------------------------------------------
+// Cluster Membership (single-server changes)
+// ------------------------------------------------------------------------
+//
+// Membership changes go through the log as EntryConfiguration entries and, following
+// the single-server approach from the Raft dissertation, add or remove one voter at a
+// time. Each node uses the latest configuration in its log as soon as it is appended
+// (committed or not), and the leader allows only one uncommitted change at a time, so
+// any two consecutive configurations share a majority.
+//
+// Learners receive the log and apply it like any follower but neither vote nor count
+// toward commitment, so a new host can catch up without affecting availability. AddPeer
+// adds a node as a learner and the leader promotes it once it has caught up.
+
+// Configuration lists the addresses of the voting members and learners of the cluster.
+type Configuration struct {
+	Members  []string `json:"members"`
+	Learners []string `json:"learners,omitempty"`
+}
+
+// contains reports whether addr is a voting member of the configuration.
+func (c Configuration) contains(addr string) bool {
+	return containsAddr(c.Members, addr)
+}
+
+// isLearner reports whether addr is a learner in the configuration.
+func (c Configuration) isLearner(addr string) bool {
+	return containsAddr(c.Learners, addr)
+}
+
+// includes reports whether addr is part of the configuration in either role.
+func (c Configuration) includes(addr string) bool {
+	return c.contains(addr) || c.isLearner(addr)
+}
+
+// clone returns a deep copy of the configuration.
+func (c Configuration) clone() Configuration {
+	return Configuration{
+		Members:  append([]string(nil), c.Members...),
+		Learners: append([]string(nil), c.Learners...),
+	}
+}
+
+func containsAddr(addrs []string, addr string) bool {
+	for _, a := range addrs {
+		if a == addr {
+			return true
+		}
+	}
+	return false
+}
+
+func withoutAddr(addrs []string, addr string) []string {
+	var out []string
+	for _, a := range addrs {
+		if a != addr {
+			out = append(out, a)
+		}
+	}
+	return out
+}
+
+// SetAdvertiseAddr sets the address other members use to reach this node (the form
+// that appears in -peers and in configuration entries). Call before Start. A node
+// started with peers must set it unless its ID is that address: otherwise its
+// configuration lists it under a name the others do not, and quorums and votes are
+// counted against the wrong members.
+func (rn *RaftNode) SetAdvertiseAddr(addr string) {
+	rn.mutex.Lock()
+	defer rn.mutex.Unlock()
+	rn.addr = addr
+	rn.reloadConfig()
+}
+
+// GetConfiguration returns the configuration currently in effect on this node.
+func (rn *RaftNode) GetConfiguration() Configuration {
+	rn.mutex.Lock()
+	defer rn.mutex.Unlock()
+	return rn.config.clone()
+}
+
+// AddPeer proposes adding addr as a member. It joins as a learner, and this leader
+// promotes it to a voter once its log has caught up (see PromoteLearner). Only the
+// leader may change membership, and only once the previous change has committed.
+func (rn *RaftNode) AddPeer(addr string) error {
+	rn.mutex.Lock()
+	defer rn.mutex.Unlock()
+	if err := rn.addLearner(addr); err != nil {
+		return err
+	}
+	rn.autoPromote[addr] = true
+	return nil
+}
+
+// AddLearner proposes adding addr as a learner that stays non-voting until promoted.
+func (rn *RaftNode) AddLearner(addr string) error {
+	rn.mutex.Lock()
+	defer rn.mutex.Unlock()
+	return rn.addLearner(addr)
+}
+
+// addLearner is AddLearner for callers already holding rn.mutex.
+func (rn *RaftNode) addLearner(addr string) error {
+	if rn.config.includes(addr) {
+		return fmt.Errorf("%s is already a member", addr)
+	}
+	next := rn.config.clone()
+	next.Learners = append(next.Learners, addr)
+	return rn.proposeConfig(next)
+}
+
+// PromoteLearner proposes making the learner at addr a voting member. It fails unless
+// the learner has replicated everything committed so far, so that adding it does not
+// hold up commitment while it catches up.
+func (rn *RaftNode) PromoteLearner(addr string) error {
+	rn.mutex.Lock()
+	defer rn.mutex.Unlock()
+	return rn.promoteLearner(addr)
+}
+
+// promoteLearner is PromoteLearner for callers already holding rn.mutex.
+func (rn *RaftNode) promoteLearner(addr string) error {
+	if !rn.config.isLearner(addr) {
+		return fmt.Errorf("%s is not a learner", addr)
+	}
+	if rn.state == Leader && rn.matchIndex[addr] < rn.commitIndex {
+		return fmt.Errorf("learner %s has not caught up (%d of %d)", addr, rn.matchIndex[addr], rn.commitIndex)
+	}
+	next := rn.config.clone()
+	next.Learners = withoutAddr(next.Learners, addr)
+	next.Members = append(next.Members, addr)
+	return rn.proposeConfig(next)
+}
+
+// RemovePeer proposes removing addr, voter or learner. Removing the leader itself is
+// allowed; it keeps leading until the change commits and then steps down.
+func (rn *RaftNode) RemovePeer(addr string) error {
+	rn.mutex.Lock()
+	defer rn.mutex.Unlock()
+	if !rn.config.includes(addr) {
+		return fmt.Errorf("%s is not a member", addr)
+	}
+	next := rn.config.clone()
+	next.Members = withoutAddr(next.Members, addr)
+	next.Learners = withoutAddr(next.Learners, addr)
+	if len(next.Members) == 0 {
+		return errors.New("cannot remove the last member")
+	}
+	return rn.proposeConfig(next)
+}
+
+// promoteCaughtUpLearners promotes learners added through AddPeer once they have caught
+// up. It runs on the leader after each commit round. Caller holds rn.mutex.
+func (rn *RaftNode) promoteCaughtUpLearners() {
+	for addr := range rn.autoPromote {
+		if !rn.config.isLearner(addr) {
+			delete(rn.autoPromote, addr) // promoted or removed meanwhile
+			continue
+		}
+		if rn.matchIndex[addr] < rn.commitIndex || rn.configIndex > rn.commitIndex {
+			continue
+		}
+		if err := rn.promoteLearner(addr); err != nil {
+			continue // e.g. no entry committed in this term yet; retry next round
+		}
+		log.Printf("Learner %s caught up; promoted to voter", addr)
+		delete(rn.autoPromote, addr)
+		return // one configuration change at a time
+	}
+}
+
+// proposeConfig appends a configuration entry and switches to it immediately.
+// Caller holds rn.mutex.
+func (rn *RaftNode) proposeConfig(next Configuration) error {
+	if rn.state != Leader {
+		return ErrNotLeader
+	}
+	if rn.transferTarget != "" {
+		return ErrLeadershipTransferInProgress
+	}
+	if rn.configIndex > rn.commitIndex {
+		return ErrConfigChangeInProgress
+	}
+	// A new leader must commit an entry of its own term before changing membership,
+	// otherwise an uncommitted change from a previous leader could still surface.
+	if term, _ := rn.termAt(rn.commitIndex); term != rn.currentTerm {
+		return errors.New("leader has not yet committed an entry in its term")
+	}
+	if _, err := rn.appendEntry(EntryConfiguration, next); err != nil {
+		return err
+	}
+	rn.reloadConfig()
+	return nil
+}
+
+// bootstrapConfig is the configuration used before any has been logged: this node plus
+// the peers it was started with. Caller holds rn.mutex.
+func (rn *RaftNode) bootstrapConfig() Configuration {
+	members := []string{rn.addr}
+	for _, p := range rn.bootstrapPeers {
+		if p != rn.addr {
+			members = append(members, p)
+		}
+	}
+	return Configuration{Members: members}
+}
+
+// configAt returns the configuration in effect at index and the index of the entry that
+// introduced it. Caller holds rn.mutex.
+func (rn *RaftNode) configAt(index int) (Configuration, int) {
+	for i := index; i > rn.snapshotIndex(); i-- {
+		entry := rn.entryAt(i)
+		if entry.Type != EntryConfiguration {
+			continue
+		}
+		cfg, err := decodeConfiguration(entry)
+		if err == nil {
+			return cfg, i
+		}
+	}
+	if len(rn.snapConfig.Members) > 0 {
+		return rn.snapConfig, rn.snapshotIndex()
+	}
+	return rn.bootstrapConfig(), 0
+}
+
+// reloadConfig recomputes the configuration in effect from the log and rebuilds the
+// peer list and, on a leader, the replication progress maps. Call after the log gains
+// or loses configuration entries. Caller holds rn.mutex.
+func (rn *RaftNode) reloadConfig() {
+	rn.config, rn.configIndex = rn.configAt(rn.lastLogIndex())
+
+	peers := make([]string, 0, len(rn.config.Members)+len(rn.config.Learners))
+	for _, m := range append(append([]string(nil), rn.config.Members...), rn.config.Learners...) {
+		if m != rn.addr {
+			peers = append(peers, m)
+		}
+	}
+	rn.peers = peers
+
+	if rn.state != Leader {
+		return
+	}
+	for _, p := range peers {
+		if _, ok := rn.nextIndex[p]; !ok {
+			rn.nextIndex[p] = rn.lastLogIndex() + 1
+			rn.matchIndex[p] = 0
+		}
+	}
+	for p := range rn.nextIndex {
+		if !rn.config.includes(p) {
+			delete(rn.nextIndex, p)
+			delete(rn.matchIndex, p)
+		}
+	}
+}
+
+// isVoter reports whether addr is a voting member in the current configuration.
+// Caller holds rn.mutex.
+func (rn *RaftNode) isVoter(addr string) bool {
+	return rn.config.contains(addr)
+}
+
+// votingPeers returns the voting members other than ourselves. Caller holds rn.mutex.
+func (rn *RaftNode) votingPeers() []string {
+	return withoutAddr(rn.config.Members, rn.addr)
+}
+
+// hasQuorum reports whether the members marked in acks form a majority of the current
+// configuration. Caller holds rn.mutex.
+func (rn *RaftNode) hasQuorum(acks map[string]bool) bool {
+	count := 0
+	for _, m := range rn.config.Members {
+		if acks[m] {
+			count++
+		}
+	}
+	return count > len(rn.config.Members)/2
+}
+
+// ------------------------------------------------------------------------
+// Admitting Onboarded Hosts
+// ------------------------------------------------------------------------
+//
+// A NodeOnboarding job that names the new host's member address (Job.NodeAddr) admits
+// the host once it completes. Applying the completion records the host as onboarding;
+// the leader then adds it as a learner and promotes it once it has caught up, like
+// AddPeer, and a leader elected meanwhile takes over the promotion. The record is
+// dropped when a configuration with the host as a voter is applied, so a voter the
+// operator removes later is not added back.
+
+// noteOnboarded records the host a completed NodeOnboarding job admits.
+// Caller holds rn.mutex.
+func (rn *RaftNode) noteOnboarded(job Job) {
+	if job.Type == "NodeOnboarding" && job.NodeAddr != "" {
+		rn.onboarding[job.NodeAddr] = job.ID
+	}
+}
+
+// clearAdmitted drops the onboarding hosts that the configuration carried by entry makes
+// voters. Caller holds rn.mutex.
+func (rn *RaftNode) clearAdmitted(entry LogEntry) {
+	if len(rn.onboarding) == 0 {
+		return
+	}
+	cfg, err := decodeConfiguration(entry)
+	if err != nil {
+		return
+	}
+	for addr := range rn.onboarding {
+		if cfg.contains(addr) {
+			delete(rn.onboarding, addr)
+		}
+	}
+}
+
+// admitOnboardedHosts adds the next onboarding host that is not yet a member as a
+// learner, and has every onboarding learner promoted once caught up. It runs on the
+// leader with each heartbeat.
+func (rn *RaftNode) admitOnboardedHosts() {
+	rn.mutex.Lock()
+	defer rn.mutex.Unlock()
+	if rn.state != Leader || len(rn.onboarding) == 0 {
+		return
+	}
+	addrs := make([]string, 0, len(rn.onboarding))
+	for addr := range rn.onboarding {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	for _, addr := range addrs {
+		if rn.config.contains(addr) {
+			continue
+		}
+		if !rn.config.isLearner(addr) {
+			if err := rn.addLearner(addr); err != nil {
+				return // e.g. a change in progress; retried with the next heartbeat
+			}
+			log.Printf("Host %s onboarded by job %s joins as a learner", addr, rn.onboarding[addr])
+		}
+		rn.autoPromote[addr] = true
+	}
+}
+
+// hasConfigEntry reports whether any of entries changes membership.
+func hasConfigEntry(entries []LogEntry) bool {
+	for _, e := range entries {
+		if e.Type == EntryConfiguration {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeConfiguration decodes the Configuration carried by an EntryConfiguration entry.
+func decodeConfiguration(entry LogEntry) (Configuration, error) {
+	var cfg Configuration
+	err := decodeCommand(entry, &cfg)
+	return cfg, err
+}
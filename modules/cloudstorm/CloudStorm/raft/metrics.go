@@ -0,0 +1,275 @@
+// -------------------- raft/metrics.go --------------------
+package raft
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// peerUnreachableAfter is how many RPCs to a peer must fail in a row before it is
+// reported unreachable.
+const peerUnreachableAfter = 3
+
+// rpcLatencyBuckets are the upper bounds, in seconds, of the RPC latency histogram.
+var rpcLatencyBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1}
+
+// ------------------------------------------------------------------------
+// Metrics (Prometheus text exposition)
+// ------------------------------------------------------------------------
+//
+// A node exposes its term, role, log indexes and, on a leader, every peer's match
+// index, read from its state at scrape time, plus counters it keeps for the RPCs it
+// sends: a latency histogram and an error count per RPC and peer, taken by wrapping the
+// node's Transport. The output is the Prometheus text format, written by hand to avoid
+// a client library dependency. Every sample carries a group label ("" for a plain node
+// or a GroupManager's meta group), so the groups of a process can share one endpoint.
+
+// rpcStats counts the RPCs of one kind sent to one peer.
+type rpcStats struct {
+	count   uint64
+	errors  uint64
+	sum     float64  // seconds
+	buckets []uint64 // cumulative counts per rpcLatencyBuckets bound
+}
+
+// raftMetrics holds a node's RPC counters. It has its own lock since the transport is
+// called without rn.mutex.
+type raftMetrics struct {
+	mutex         sync.Mutex
+	rpcs          map[[2]string]*rpcStats // by (RPC, peer)
+	failures      map[string]int          // consecutive failed RPCs per peer
+	droppedEvents uint64
+}
+
+func newRaftMetrics() *raftMetrics {
+	return &raftMetrics{
+		rpcs:     make(map[[2]string]*rpcStats),
+		failures: make(map[string]int),
+	}
+}
+
+// observeRPC records an RPC to peer that took d and failed with err, and reports
+// whether the peer just became unreachable (-1), reachable again (+1) or neither (0).
+func (m *raftMetrics) observeRPC(rpc, peer string, d time.Duration, err error) int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	key := [2]string{rpc, peer}
+	s := m.rpcs[key]
+	if s == nil {
+		s = &rpcStats{buckets: make([]uint64, len(rpcLatencyBuckets))}
+		m.rpcs[key] = s
+	}
+	s.count++
+	s.sum += d.Seconds()
+	for i, le := range rpcLatencyBuckets {
+		if d.Seconds() <= le {
+			s.buckets[i]++
+		}
+	}
+	if err != nil {
+		s.errors++
+		m.failures[peer]++
+		if m.failures[peer] == peerUnreachableAfter {
+			return -1
+		}
+		return 0
+	}
+	recovered := m.failures[peer] >= peerUnreachableAfter
+	m.failures[peer] = 0
+	if recovered {
+		return 1
+	}
+	return 0
+}
+
+// metricFamily is one metric with its samples.
+type metricFamily struct {
+	name, help, kind string
+	samples          []metricSample
+}
+
+// metricSample is one line of a family: an optional name suffix (_bucket, _sum,
+// _count), its labels and its value.
+type metricSample struct {
+	suffix string
+	labels [][2]string
+	value  float64
+}
+
+// metricFamilies returns the node's metrics.
+func (rn *RaftNode) metricFamilies() []*metricFamily {
+	group := [2]string{"group", rn.groupID}
+	gauge := func(name, help string, v float64) *metricFamily {
+		return &metricFamily{name: name, help: help, kind: "gauge",
+			samples: []metricSample{{labels: [][2]string{group}, value: v}}}
+	}
+
+	rn.mutex.Lock()
+	role := &metricFamily{name: "cloudstorm_raft_role", help: "1 for the role the node is in.", kind: "gauge"}
+	for _, s := range []RaftState{Follower, Candidate, Leader} {
+		v := 0.0
+		if rn.state == s {
+			v = 1
+		}
+		role.samples = append(role.samples, metricSample{labels: [][2]string{group, {"role", s.String()}}, value: v})
+	}
+	matchIndex := &metricFamily{name: "cloudstorm_raft_peer_match_index", help: "Highest log index known replicated on each peer (leader only).", kind: "gauge"}
+	if rn.state == Leader {
+		for _, p := range rn.peers {
+			matchIndex.samples = append(matchIndex.samples, metricSample{labels: [][2]string{group, {"peer", p}}, value: float64(rn.matchIndex[p])})
+		}
+	}
+	families := []*metricFamily{
+		gauge("cloudstorm_raft_term", "Current raft term.", float64(rn.currentTerm)),
+		role,
+		gauge("cloudstorm_raft_commit_index", "Highest log index known committed.", float64(rn.commitIndex)),
+		gauge("cloudstorm_raft_applied_index", "Highest log index applied to the state machine.", float64(rn.lastApplied)),
+		gauge("cloudstorm_raft_last_log_index", "Index of the newest log entry.", float64(rn.lastLogIndex())),
+		gauge("cloudstorm_raft_snapshot_index", "Last log index covered by the latest snapshot.", float64(rn.snapshotIndex())),
+		matchIndex,
+	}
+	rn.mutex.Unlock()
+
+	m := rn.metrics
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	latency := &metricFamily{name: "cloudstorm_raft_rpc_duration_seconds", help: "Latency of outbound raft RPCs, failed ones included.", kind: "histogram"}
+	errs := &metricFamily{name: "cloudstorm_raft_rpc_errors_total", help: "Outbound raft RPCs that failed.", kind: "counter"}
+	keys := make([][2]string, 0, len(m.rpcs))
+	for k := range m.rpcs {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i][0] < keys[j][0] || keys[i][0] == keys[j][0] && keys[i][1] < keys[j][1]
+	})
+	for _, k := range keys {
+		s := m.rpcs[k]
+		labels := [][2]string{group, {"rpc", k[0]}, {"peer", k[1]}}
+		for i, le := range rpcLatencyBuckets {
+			latency.samples = append(latency.samples, metricSample{suffix: "_bucket",
+				labels: append(labels[:3:3], [2]string{"le", fmt.Sprint(le)}), value: float64(s.buckets[i])})
+		}
+		latency.samples = append(latency.samples,
+			metricSample{suffix: "_bucket", labels: append(labels[:3:3], [2]string{"le", "+Inf"}), value: float64(s.count)},
+			metricSample{suffix: "_sum", labels: labels, value: s.sum},
+			metricSample{suffix: "_count", labels: labels, value: float64(s.count)})
+		errs.samples = append(errs.samples, metricSample{labels: labels, value: float64(s.errors)})
+	}
+	dropped := &metricFamily{name: "cloudstorm_raft_events_dropped_total", help: "Events not delivered because a subscriber's buffer was full.", kind: "counter",
+		samples: []metricSample{{labels: [][2]string{group}, value: float64(m.droppedEvents)}}}
+	return append(families, latency, errs, dropped)
+}
+
+// writeMetrics writes families in the Prometheus text format, merging families of the
+// same name (from several groups).
+func writeMetrics(w io.Writer, families []*metricFamily) {
+	var order []string
+	merged := make(map[string]*metricFamily)
+	for _, f := range families {
+		if m, ok := merged[f.name]; ok {
+			m.samples = append(m.samples, f.samples...)
+			continue
+		}
+		merged[f.name] = &metricFamily{name: f.name, help: f.help, kind: f.kind, samples: append([]metricSample(nil), f.samples...)}
+		order = append(order, f.name)
+	}
+	for _, name := range order {
+		f := merged[name]
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.kind)
+		for _, s := range f.samples {
+			pairs := make([]string, len(s.labels))
+			for i, l := range s.labels {
+				pairs[i] = l[0] + `="` + labelEscaper.Replace(l[1]) + `"`
+			}
+			fmt.Fprintf(w, "%s%s{%s} %v\n", f.name, s.suffix, strings.Join(pairs, ","), s.value)
+		}
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// MetricsHandler serves the node's metrics in the Prometheus text format.
+func (rn *RaftNode) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(w, rn.metricFamilies())
+	})
+}
+
+// MetricsHandler serves the metrics of every group in the Prometheus text format.
+func (gm *GroupManager) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		families := gm.meta.metricFamilies()
+		for _, id := range gm.Groups() {
+			if rn, ok := gm.Group(id); ok {
+				families = append(families, rn.metricFamilies()...)
+			}
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(w, families)
+	})
+}
+
+// ------------------------------------------------------------------------
+// Instrumented Transport
+// ------------------------------------------------------------------------
+
+// instrumentedTransport times every RPC and reports peers that stop or resume answering.
+type instrumentedTransport struct {
+	Transport
+	rn *RaftNode
+}
+
+// instrument wraps t so the node's RPCs are measured.
+func (rn *RaftNode) instrument(t Transport) Transport {
+	return instrumentedTransport{Transport: t, rn: rn}
+}
+
+func (t instrumentedTransport) observe(rpc, peer string, start time.Time, err error) {
+	switch t.rn.metrics.observeRPC(rpc, peer, time.Since(start), err) {
+	case -1:
+		t.rn.events.publish(t.rn, Event{Type: EventPeerUnreachable, Peer: peer, Error: err.Error()})
+	case 1:
+		t.rn.events.publish(t.rn, Event{Type: EventPeerReachable, Peer: peer})
+	}
+}
+
+func (t instrumentedTransport) RequestVote(peer string, req VoteRequest) (VoteResponse, error) {
+	start := time.Now()
+	resp, err := t.Transport.RequestVote(peer, req)
+	t.observe("request_vote", peer, start, err)
+	return resp, err
+}
+
+func (t instrumentedTransport) AppendEntries(peer string, req AppendEntriesRequest) (AppendEntriesResponse, error) {
+	start := time.Now()
+	resp, err := t.Transport.AppendEntries(peer, req)
+	t.observe("append_entries", peer, start, err)
+	return resp, err
+}
+
+func (t instrumentedTransport) InstallSnapshot(peer string, req InstallSnapshotRequest) (InstallSnapshotResponse, error) {
+	start := time.Now()
+	resp, err := t.Transport.InstallSnapshot(peer, req)
+	t.observe("install_snapshot", peer, start, err)
+	return resp, err
+}
+
+func (t instrumentedTransport) TimeoutNow(peer string, req TimeoutNowRequest) (TimeoutNowResponse, error) {
+	start := time.Now()
+	resp, err := t.Transport.TimeoutNow(peer, req)
+	t.observe("timeout_now", peer, start, err)
+	return resp, err
+}
+
+func (t instrumentedTransport) ForwardJob(peer string, req JobForwardRequest) (JobForwardResponse, error) {
+	start := time.Now()
+	resp, err := t.Transport.ForwardJob(peer, req)
+	t.observe("forward_job", peer, start, err)
+	return resp, err
+}
@@ -0,0 +1,223 @@
+// -------------------- raft/placement.go --------------------
+package raft
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+// Commands placing nodes in the iBT network.
+const (
+	CmdJoinIBT      = "ibt.join"      // Command is an IBTPlacement (NodeID, Addr)
+	CmdLeaveIBT     = "ibt.leave"     // Command is an IBTPlacement (NodeID)
+	CmdRebalanceIBT = "ibt.rebalance" // Command is empty
+)
+
+// placementInterval is how often a node without coordinates asks for them, and how
+// often a leader looks for placed nodes that have left the configuration.
+const placementInterval = time.Second
+
+var (
+	// ErrNoIBTTopology is returned when placing a node on a node without iBT dimensions.
+	ErrNoIBTTopology = errors.New("no iBT dimensions configured")
+	// ErrIBTFull is returned when every coordinate of the iBT network is taken.
+	ErrIBTFull = errors.New("every iBT coordinate is taken")
+)
+
+// ------------------------------------------------------------------------
+// iBT Coordinate Assignment
+// ------------------------------------------------------------------------
+//
+// Coordinates are assigned through the log, so every node agrees on them. A node
+// without coordinates proposes CmdJoinIBT for itself once it knows a leader (a follower
+// forwards it, like a worker's commands); applying it places the node at a position
+// derived from a hash of its ID, or at the next free one in index order, so no two
+// nodes share coordinates.
+//
+// The leader releases the coordinates of nodes whose address has left the raft
+// configuration with CmdLeaveIBT. A join only records an address the leader's
+// configuration includes when it proposes the join, so a node the configuration knows
+// under another name is never taken for a departed one. Since joins are placed by hash,
+// the remaining nodes can be left clustered; CmdRebalanceIBT spreads them evenly over
+// the network again, in node ID order. Rebalancing moves nodes, so it is left to the
+// operator (RebalanceIBT).
+//
+// A position's index counts through the coordinates with the last dimension fastest,
+// like IBTTopology's node order.
+
+// IBTPlacement is a node's place in the iBT network.
+type IBTPlacement struct {
+	NodeID string         `json:"node_id"`
+	Addr   string         `json:"addr,omitempty"`  // the node's member address, if configured
+	Coord  IBTCoordinates `json:"coord,omitempty"` // set when applied
+}
+
+// ibtPositions returns the number of positions of the network described by dims.
+func ibtPositions(dims []IBTDimension) int {
+	n := 1
+	for _, d := range dims {
+		n *= d.Size
+	}
+	return n
+}
+
+// ibtIndex returns the index of c, or false if c does not lie within dims.
+func ibtIndex(c IBTCoordinates, dims []IBTDimension) (int, bool) {
+	if len(c) != len(dims) {
+		return 0, false
+	}
+	i := 0
+	for d, x := range c {
+		if x < 0 || x >= dims[d].Size {
+			return 0, false
+		}
+		i = i*dims[d].Size + x
+	}
+	return i, true
+}
+
+// ibtCoord returns the coordinates at index i.
+func ibtCoord(i int, dims []IBTDimension) IBTCoordinates {
+	c := make(IBTCoordinates, len(dims))
+	for d := len(dims) - 1; d >= 0; d-- {
+		c[d] = i % dims[d].Size
+		i /= dims[d].Size
+	}
+	return c
+}
+
+// applyPlacement applies CmdJoinIBT, CmdLeaveIBT or CmdRebalanceIBT. Caller holds
+// rn.mutex.
+func (rn *RaftNode) applyPlacement(entry LogEntry) (interface{}, error) {
+	if entry.Type == CmdRebalanceIBT {
+		return nil, rn.rebalanceIBT()
+	}
+	var p IBTPlacement
+	if err := decodeCommand(entry, &p); err != nil {
+		return nil, err
+	}
+	if entry.Type == CmdLeaveIBT {
+		delete(rn.nodeCoords, p.NodeID)
+		delete(rn.nodeAddrs, p.NodeID)
+		log.Printf("Node %s left the iBT network", p.NodeID)
+		return p, nil
+	}
+
+	positions := ibtPositions(rn.ibtDims)
+	if len(rn.ibtDims) == 0 || positions == 0 {
+		return nil, ErrNoIBTTopology
+	}
+	rn.nodeAddrs[p.NodeID] = p.Addr
+	if coord, ok := rn.nodeCoords[p.NodeID]; ok {
+		p.Coord = coord
+		return p, nil // rejoining, e.g. after a restart
+	}
+	taken := make(map[int]bool, len(rn.nodeCoords))
+	for _, c := range rn.nodeCoords {
+		if i, ok := ibtIndex(c, rn.ibtDims); ok {
+			taken[i] = true
+		}
+	}
+	start := int(fnv32(p.NodeID) % uint32(positions))
+	for k := 0; k < positions; k++ {
+		if i := (start + k) % positions; !taken[i] {
+			p.Coord = ibtCoord(i, rn.ibtDims)
+			rn.nodeCoords[p.NodeID] = p.Coord
+			log.Printf("Node %s joined the iBT network at %v", p.NodeID, p.Coord)
+			return p, nil
+		}
+	}
+	delete(rn.nodeAddrs, p.NodeID)
+	return nil, fmt.Errorf("node %s: %w", p.NodeID, ErrIBTFull)
+}
+
+// rebalanceIBT spreads the placed nodes evenly over the network. Caller holds rn.mutex.
+func (rn *RaftNode) rebalanceIBT() error {
+	positions := ibtPositions(rn.ibtDims)
+	if len(rn.ibtDims) == 0 || positions == 0 {
+		return ErrNoIBTTopology
+	}
+	ids := make([]string, 0, len(rn.nodeCoords))
+	for id := range rn.nodeCoords {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for k, id := range ids {
+		rn.nodeCoords[id] = ibtCoord(k*positions/len(ids), rn.ibtDims)
+	}
+	log.Printf("Rebalanced %d nodes over the iBT network", len(ids))
+	return nil
+}
+
+// NodeCoordinates returns the coordinates of every placed node.
+func (rn *RaftNode) NodeCoordinates() map[string]IBTCoordinates {
+	rn.mutex.Lock()
+	defer rn.mutex.Unlock()
+	out := make(map[string]IBTCoordinates, len(rn.nodeCoords))
+	for id, c := range rn.nodeCoords {
+		out[id] = append(IBTCoordinates(nil), c...)
+	}
+	return out
+}
+
+// LeaveIBT releases a node's coordinates, e.g. this node's before it shuts down.
+func (rn *RaftNode) LeaveIBT(nodeID string) error {
+	return rn.submit(CmdLeaveIBT, IBTPlacement{NodeID: nodeID})
+}
+
+// RebalanceIBT spreads the placed nodes evenly over the network. Only the leader can
+// rebalance.
+func (rn *RaftNode) RebalanceIBT() error {
+	return rn.proposeAndWait(CmdRebalanceIBT, nil)
+}
+
+// runPlacement asks for this node's coordinates whenever it is a member without them,
+// e.g. after joining the cluster or being added back to it.
+func (rn *RaftNode) runPlacement() {
+	defer rn.wg.Done()
+	if len(rn.ibtDims) == 0 {
+		return
+	}
+	ticker := time.NewTicker(placementInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-rn.stopChan:
+			return
+		case <-ticker.C:
+		}
+		rn.mutex.Lock()
+		_, placed := rn.nodeCoords[rn.id]
+		member := len(rn.config.Members) == 0 || rn.config.includes(rn.addr)
+		p := IBTPlacement{NodeID: rn.id, Addr: rn.addr}
+		rn.mutex.Unlock()
+		if placed || !member {
+			continue
+		}
+		if err := rn.submit(CmdJoinIBT, p); err != nil && !errors.Is(err, ErrNotLeader) {
+			log.Printf("Node %s could not join the iBT network: %v", rn.id, err)
+		}
+	}
+}
+
+// releaseDepartedNodes proposes CmdLeaveIBT for placed nodes whose address is no longer
+// in the configuration, at most once per placementInterval.
+func (rn *RaftNode) releaseDepartedNodes() {
+	rn.mutex.Lock()
+	defer rn.mutex.Unlock()
+	now := rn.clock()
+	if rn.state != Leader || now.Sub(rn.lastPlacementScan) < placementInterval || len(rn.config.Members) == 0 {
+		return
+	}
+	rn.lastPlacementScan = now
+	for id, addr := range rn.nodeAddrs {
+		if addr == "" || rn.config.includes(addr) {
+			continue
+		}
+		log.Printf("Node %s (%s) left the configuration; releasing its iBT coordinates", id, addr)
+		rn.propose(CmdLeaveIBT, IBTPlacement{NodeID: id}, rn.proposalTimeout)
+	}
+}
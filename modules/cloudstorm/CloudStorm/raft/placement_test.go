@@ -0,0 +1,156 @@
+// -------------------- raft/placement_test.go --------------------
+package raft
+
+import (
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// applyPlacementCmd applies a placement command on rn as if it had been committed.
+func applyPlacementCmd(t *testing.T, rn *RaftNode, cmdType string, p IBTPlacement) error {
+	t.Helper()
+	entry := LogEntry{Type: cmdType}
+	if cmdType != CmdRebalanceIBT {
+		data, err := json.Marshal(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entry.Command = data
+	}
+	rn.mutex.Lock()
+	defer rn.mutex.Unlock()
+	_, err := rn.applyPlacement(entry)
+	return err
+}
+
+// placedIndexes returns the position index of every placed node, failing the test if
+// two nodes share one.
+func placedIndexes(t *testing.T, rn *RaftNode) map[string]int {
+	t.Helper()
+	out := make(map[string]int)
+	seen := make(map[int]string)
+	for id, c := range rn.NodeCoordinates() {
+		i, ok := ibtIndex(c, rn.ibtDims)
+		if !ok {
+			t.Fatalf("%s placed outside the network at %v", id, c)
+		}
+		if other, ok := seen[i]; ok {
+			t.Fatalf("%s and %s share coordinates %v", id, other, c)
+		}
+		seen[i], out[id] = id, i
+	}
+	return out
+}
+
+// TestPlacementCollisions fills a four-position network and checks that joins, leaves
+// and rebalancing never put two nodes at the same coordinates.
+func TestPlacementCollisions(t *testing.T) {
+	dims := []IBTDimension{{Size: 2}, {Size: 2}}
+	rn, err := NewRaftNode("self", nil, filepath.Join(t.TempDir(), "self.db"), nil, dims, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(rn.Stop)
+
+	for _, id := range []string{"a", "b", "c", "d"} {
+		if err := applyPlacementCmd(t, rn, CmdJoinIBT, IBTPlacement{NodeID: id, Addr: id}); err != nil {
+			t.Fatalf("join %s: %v", id, err)
+		}
+	}
+	full := placedIndexes(t, rn)
+	if len(full) != 4 {
+		t.Fatalf("placed %v, want four nodes", full)
+	}
+	if err := applyPlacementCmd(t, rn, CmdJoinIBT, IBTPlacement{NodeID: "e", Addr: "e"}); !errors.Is(err, ErrIBTFull) {
+		t.Fatalf("join of a fifth node: got %v, want ErrIBTFull", err)
+	}
+	if _, ok := rn.nodeAddrs["e"]; ok {
+		t.Fatal("a node that was not placed kept its address")
+	}
+	if err := applyPlacementCmd(t, rn, CmdJoinIBT, IBTPlacement{NodeID: "b", Addr: "b"}); err != nil {
+		t.Fatalf("rejoin: %v", err)
+	}
+	if got := placedIndexes(t, rn); got["b"] != full["b"] {
+		t.Fatalf("rejoin moved b from %d to %d", full["b"], got["b"])
+	}
+
+	// The only free position after a leave goes to the next join.
+	if err := applyPlacementCmd(t, rn, CmdLeaveIBT, IBTPlacement{NodeID: "c"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyPlacementCmd(t, rn, CmdJoinIBT, IBTPlacement{NodeID: "e", Addr: "e"}); err != nil {
+		t.Fatalf("join after a leave: %v", err)
+	}
+	if got := placedIndexes(t, rn); got["e"] != full["c"] {
+		t.Fatalf("e placed at %d, want c's former %d", got["e"], full["c"])
+	}
+
+	if err := applyPlacementCmd(t, rn, CmdRebalanceIBT, IBTPlacement{}); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int{"a": 0, "b": 1, "d": 2, "e": 3}
+	if got := placedIndexes(t, rn); len(got) != len(want) || got["a"] != 0 || got["b"] != 1 || got["d"] != 2 || got["e"] != 3 {
+		t.Fatalf("rebalanced to %v, want %v", got, want)
+	}
+	for _, id := range []string{"b", "d"} {
+		if err := applyPlacementCmd(t, rn, CmdLeaveIBT, IBTPlacement{NodeID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := applyPlacementCmd(t, rn, CmdRebalanceIBT, IBTPlacement{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := placedIndexes(t, rn); len(got) != 2 || got["a"] != 0 || got["e"] != 2 {
+		t.Fatalf("rebalanced to %v, want a at 0 and e at 2", got)
+	}
+}
+
+// TestPlacementReleasesDepartedNodes checks that placed nodes stay put while they are
+// members, including one placed under an address the configuration does not know, and
+// that a removed member's coordinates are released.
+func TestPlacementReleasesDepartedNodes(t *testing.T) {
+	ids := []string{"n1", "n2", "n3"}
+	c := newTestCluster(t, ids, []IBTDimension{{Size: 4}, {Size: 4}}, nil)
+	leader := c.leader()
+	waitFor(t, 5*time.Second, "every node to be placed", func() bool {
+		return len(leader.NodeCoordinates()) == len(ids)
+	})
+	if err := leader.submit(CmdJoinIBT, IBTPlacement{NodeID: "ghost", Addr: "http://ghost"}); err != nil {
+		t.Fatal(err)
+	}
+	leader.mutex.Lock()
+	addr, ok := leader.nodeAddrs["ghost"]
+	leader.mutex.Unlock()
+	if !ok || addr != "" {
+		t.Fatalf("ghost recorded with address %q, want none", addr)
+	}
+
+	before := placedIndexes(t, leader)
+	time.Sleep(3 * placementInterval)
+	if after := placedIndexes(t, leader); len(after) != len(before) {
+		t.Fatalf("placements changed from %v to %v without a membership change", before, after)
+	}
+
+	f := c.follower(leader)
+	var rest []string
+	for _, id := range ids {
+		if id != f.id {
+			rest = append(rest, id)
+		}
+	}
+	c.net.Partition([]string{f.id}, rest)
+	waitFor(t, 5*time.Second, "the removal of "+f.id, func() bool {
+		err := leader.RemovePeer(f.id)
+		return err == nil || !leader.GetConfiguration().includes(f.id)
+	})
+	waitFor(t, 5*time.Second, "the release of "+f.id, func() bool {
+		_, placed := leader.NodeCoordinates()[f.id]
+		return !placed
+	})
+	if _, ok := leader.NodeCoordinates()["ghost"]; !ok {
+		t.Fatal("ghost was released although it never had a configured address")
+	}
+}
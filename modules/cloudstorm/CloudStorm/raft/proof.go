@@ -0,0 +1,153 @@
+// -------------------- raft/proof.go --------------------
+package raft
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+)
+
+// RPC kinds a consensus proof is bound to, so a proof cannot be replayed on another RPC.
+const (
+	proofVote        = "vote"
+	proofAppend      = "append"
+	proofSnapshot    = "snapshot"
+	proofTimeoutNow  = "timeout_now"
+	proofDomainLabel = "cloudstorm-raft-proof"
+)
+
+var (
+	// ErrUntrustedService is returned for an RPC whose sender runs a service tree that is
+	// neither whitelisted nor expected.
+	ErrUntrustedService = errors.New("service ID is not trusted")
+	// ErrUnknownPeerKey is returned for an RPC from a node whose public key is not known.
+	ErrUnknownPeerKey = errors.New("no public key for sender")
+	// ErrInvalidProof is returned for an RPC whose proof is not signed by its sender for
+	// its term.
+	ErrInvalidProof = errors.New("invalid consensus proof")
+)
+
+// ------------------------------------------------------------------------
+// Trinity Consensus Proofs
+// ------------------------------------------------------------------------
+//
+// Every RPC carries the sender's Trinity identity: its ServiceID (the hash of the
+// service tree it runs) and ProofKeyHash. The CombinedProof is the sender's ed25519
+// signature over that identity, the RPC kind, the sender's node ID, the raft group and
+// the term, so a receiver can tell who vouched for which code in which group and term; a
+// plain hash of the identity, which any peer could compute, would prove nothing.
+//
+// Receivers check proofs before acting on an RPC. When a ServiceID verifier is set the
+// sender's ServiceID must pass it, and the signature must verify against the key set for
+// the sender with SetPeerKey. Senders without a key are rejected unless insecure proofs
+// were allowed, for development clusters. A rejected vote request is simply not granted,
+// and a rejected AppendEntries or InstallSnapshot is answered with Rejected set so the
+// leader neither counts it as an acknowledgement nor changes the peer's progress.
+//
+// Proofs cover the sender's identity and term, not the request body; run the transport
+// over TLS for message integrity.
+
+// SetConsensusIdentity sets the ServiceID and ProofKeyHash this node proves in its RPCs,
+// e.g. again after the service tree changed.
+func (rn *RaftNode) SetConsensusIdentity(serviceID, proofKeyHash string) {
+	rn.mutex.Lock()
+	defer rn.mutex.Unlock()
+	rn.serviceID, rn.proofKeyHash = serviceID, proofKeyHash
+}
+
+// SetServiceIDVerifier installs the check a sender's ServiceID must pass, such as
+// membership in the governance whitelist. Nil accepts any ServiceID.
+func (rn *RaftNode) SetServiceIDVerifier(verify func(serviceID string) bool) {
+	rn.mutex.Lock()
+	defer rn.mutex.Unlock()
+	rn.verifyServiceID = verify
+}
+
+// SetPeerKey trusts pub as the signing key of the node with the given ID. RPCs and log
+// entries from nodes without a key are rejected (see SetInsecureProofs).
+func (rn *RaftNode) SetPeerKey(nodeID string, pub ed25519.PublicKey) {
+	rn.mutex.Lock()
+	defer rn.mutex.Unlock()
+	rn.peerKeys[nodeID] = pub
+}
+
+// SetInsecureProofs accepts RPCs and log entries from nodes without a peer key, checking
+// only their ServiceID. Anyone who can reach the node can then forge them; it is meant
+// for development clusters only.
+func (rn *RaftNode) SetInsecureProofs(insecure bool) {
+	rn.mutex.Lock()
+	defer rn.mutex.Unlock()
+	rn.insecureProofs = insecure
+}
+
+// PublicKey returns the key peers verify this node's proofs with.
+func (rn *RaftNode) PublicKey() ed25519.PublicKey {
+	return rn.nodeKey.Public().(ed25519.PublicKey)
+}
+
+// signProof returns the identity and signed proof for an RPC of the given kind sent in
+// term. Caller holds rn.mutex.
+func (rn *RaftNode) signProof(kind string, term int) (serviceID, proofKeyHash, combinedProof string) {
+	if rn.serviceID == "" {
+		return "", "", "" // the HTTP transport falls back to the local Trinity proof
+	}
+	proof := SignConsensusProof(rn.nodeKey, kind, rn.id, rn.groupID, term, rn.serviceID, rn.proofKeyHash)
+	return rn.serviceID, rn.proofKeyHash, proof
+}
+
+// checkProof verifies the proof of an RPC of the given kind from sender in term.
+// Caller holds rn.mutex.
+func (rn *RaftNode) checkProof(kind, sender string, term int, serviceID, proofKeyHash, combinedProof string) error {
+	if rn.verifyServiceID != nil && !rn.verifyServiceID(serviceID) {
+		return fmt.Errorf("%w: %q", ErrUntrustedService, serviceID)
+	}
+	pub, ok := rn.peerKeys[sender]
+	switch {
+	case ok:
+		return VerifyConsensusProof(pub, kind, sender, rn.groupID, term, serviceID, proofKeyHash, combinedProof)
+	case rn.insecureProofs:
+		return nil
+	}
+	return fmt.Errorf("%w %s", ErrUnknownPeerKey, sender)
+}
+
+// rejectRPC logs an RPC refused for its proof.
+func (rn *RaftNode) rejectRPC(kind, sender string, err error) {
+	log.Printf("Node %s rejected %s RPC from %s: %v", rn.id, kind, sender, err)
+}
+
+// SignConsensusProof signs a Trinity identity for an RPC of the given kind, sent by
+// senderID for raft group groupID ("" for the meta group) in term, and returns the
+// hex-encoded signature.
+func SignConsensusProof(key ed25519.PrivateKey, kind, senderID, groupID string, term int, serviceID, proofKeyHash string) string {
+	return hex.EncodeToString(ed25519.Sign(key, proofMessage(kind, senderID, groupID, term, serviceID, proofKeyHash)))
+}
+
+// VerifyConsensusProof checks a proof made by SignConsensusProof against the sender's
+// public key.
+func VerifyConsensusProof(pub ed25519.PublicKey, kind, senderID, groupID string, term int, serviceID, proofKeyHash, combinedProof string) error {
+	if len(serviceID) != 64 || len(proofKeyHash) != 64 {
+		return fmt.Errorf("%w: malformed identity", ErrInvalidProof)
+	}
+	sig, err := hex.DecodeString(combinedProof)
+	if err != nil || len(sig) != ed25519.SignatureSize {
+		return fmt.Errorf("%w: malformed signature", ErrInvalidProof)
+	}
+	if !ed25519.Verify(pub, proofMessage(kind, senderID, groupID, term, serviceID, proofKeyHash), sig) {
+		return fmt.Errorf("%w: bad signature from %s for term %d", ErrInvalidProof, senderID, term)
+	}
+	return nil
+}
+
+// proofMessage is the byte string a consensus proof signs.
+func proofMessage(kind, senderID, groupID string, term int, serviceID, proofKeyHash string) []byte {
+	var b []byte
+	for _, field := range []string{proofDomainLabel, kind, senderID, groupID, strconv.Itoa(term), serviceID, proofKeyHash} {
+		b = append(b, field...)
+		b = append(b, 0)
+	}
+	return b
+}
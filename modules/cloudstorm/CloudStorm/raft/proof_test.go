@@ -0,0 +1,87 @@
+// -------------------- raft/proof_test.go --------------------
+package raft
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+// newProofNode returns an unstarted node with a consensus identity.
+func newProofNode(t *testing.T, id string) *RaftNode {
+	t.Helper()
+	rn, err := NewRaftNode(id, nil, filepath.Join(t.TempDir(), id+".db"), nil, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(rn.Stop)
+	rn.SetConsensusIdentity(testHash("cloudstorm-test-service"), testHash(id))
+	return rn
+}
+
+// proofFrom returns the identity and proof sender attaches to an RPC of kind in term.
+func proofFrom(sender *RaftNode, kind string, term int) (string, string, string) {
+	sender.mutex.Lock()
+	defer sender.mutex.Unlock()
+	return sender.signProof(kind, term)
+}
+
+func TestProofRejectsSendersWithoutKey(t *testing.T) {
+	a, b := newProofNode(t, "a"), newProofNode(t, "b")
+	sid, pkh, proof := proofFrom(b, proofAppend, 3)
+	check := func() error {
+		a.mutex.Lock()
+		defer a.mutex.Unlock()
+		return a.checkProof(proofAppend, "b", 3, sid, pkh, proof)
+	}
+
+	if err := check(); !errors.Is(err, ErrUnknownPeerKey) {
+		t.Fatalf("no peer keys: got %v, want ErrUnknownPeerKey", err)
+	}
+	a.SetInsecureProofs(true)
+	if err := check(); err != nil {
+		t.Fatalf("insecure proofs: %v", err)
+	}
+	// A known key is checked even then.
+	a.SetPeerKey("b", a.PublicKey())
+	if err := check(); !errors.Is(err, ErrInvalidProof) {
+		t.Fatalf("wrong key: got %v, want ErrInvalidProof", err)
+	}
+	a.SetInsecureProofs(false)
+	a.SetPeerKey("b", b.PublicKey())
+	if err := check(); err != nil {
+		t.Fatalf("trusted key: %v", err)
+	}
+	a.SetServiceIDVerifier(func(string) bool { return false })
+	if err := check(); !errors.Is(err, ErrUntrustedService) {
+		t.Fatalf("untrusted service: got %v, want ErrUntrustedService", err)
+	}
+}
+
+// TestProofBinding checks that a proof only verifies for the kind, sender, group and term
+// it was signed for.
+func TestProofBinding(t *testing.T) {
+	b := newProofNode(t, "b")
+	b.groupID = "net-1"
+	sid, pkh, proof := proofFrom(b, proofVote, 7)
+	pub := b.PublicKey()
+
+	if err := VerifyConsensusProof(pub, proofVote, "b", "net-1", 7, sid, pkh, proof); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name, kind, sender, group string
+		term                      int
+	}{
+		{"another kind", proofAppend, "b", "net-1", 7},
+		{"another sender", proofVote, "c", "net-1", 7},
+		{"another group", proofVote, "b", "net-2", 7},
+		{"the meta group", proofVote, "b", "", 7},
+		{"another term", proofVote, "b", "net-1", 8},
+	}
+	for _, tt := range tests {
+		if err := VerifyConsensusProof(pub, tt.kind, tt.sender, tt.group, tt.term, sid, pkh, proof); !errors.Is(err, ErrInvalidProof) {
+			t.Errorf("%s: got %v, want ErrInvalidProof", tt.name, err)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+// -------------------- raft/query.go --------------------
+package raft
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+)
+
+// ------------------------------------------------------------------------
+// Query HTTP Handler
+// ------------------------------------------------------------------------
+
+// QueryHandler returns an http.Handler serving read-only JSON views of the replicated
+// state:
+//
+//	GET /api/networks, /api/networks/{id}
+//	GET /api/jobs, /api/jobs/{id}
+//	GET /api/containers/{id}
+//
+// Reads are linearizable (see ReadIndex) and therefore answered by the leader only;
+// other nodes reply 503 with the known leader in the X-Raft-Leader header. A request
+// with ?stale=true is answered from this node's applied state without that check.
+func (rn *RaftNode) QueryHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/networks", rn.serveListNetworks)
+	mux.HandleFunc("GET /api/networks/{id}", rn.serveGetNetwork)
+	mux.HandleFunc("GET /api/jobs", rn.serveListJobs)
+	mux.HandleFunc("GET /api/jobs/{id}", rn.serveGetJob)
+	mux.HandleFunc("GET /api/containers/{id}", rn.serveGetContainer)
+	return mux
+}
+
+func (rn *RaftNode) serveListNetworks(w http.ResponseWriter, r *http.Request) {
+	if !rn.readBarrier(w, r) {
+		return
+	}
+	networks := rn.ListNetworks()
+	sort.Slice(networks, func(i, j int) bool { return networks[i].ID < networks[j].ID })
+	writeJSON(w, networks)
+}
+
+func (rn *RaftNode) serveGetNetwork(w http.ResponseWriter, r *http.Request) {
+	if !rn.readBarrier(w, r) {
+		return
+	}
+	netw, ok := rn.GetNetwork(r.PathValue("id"))
+	if !ok {
+		http.Error(w, "network not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, netw)
+}
+
+func (rn *RaftNode) serveListJobs(w http.ResponseWriter, r *http.Request) {
+	if !rn.readBarrier(w, r) {
+		return
+	}
+	jobs := rn.ListJobs()
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].ID < jobs[j].ID })
+	writeJSON(w, jobs)
+}
+
+func (rn *RaftNode) serveGetJob(w http.ResponseWriter, r *http.Request) {
+	if !rn.readBarrier(w, r) {
+		return
+	}
+	job, ok := rn.GetJob(r.PathValue("id"))
+	if !ok {
+		http.Error(w, "job not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, job)
+}
+
+func (rn *RaftNode) serveGetContainer(w http.ResponseWriter, r *http.Request) {
+	if !rn.readBarrier(w, r) {
+		return
+	}
+	cons, ok := rn.GetContainerConsensus(r.PathValue("id"))
+	if !ok {
+		http.Error(w, "container not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, cons)
+}
+
+// readBarrier makes the request linearizable unless it asked for a stale read, and
+// writes an error response if that is not possible.
+func (rn *RaftNode) readBarrier(w http.ResponseWriter, r *http.Request) bool {
+	if r.URL.Query().Get("stale") == "true" {
+		return true
+	}
+	_, err := rn.ReadIndex(defaultReadTimeout)
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, ErrNotLeader), errors.Is(err, ErrLeadershipNotConfirmed):
+		if leader := rn.Leader(); leader != "" {
+			w.Header().Set("X-Raft-Leader", leader)
+		}
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	default:
+		http.Error(w, err.Error(), http.StatusGatewayTimeout)
+	}
+	return false
+}
@@ -2,22 +2,22 @@
 package raft
 
 import (
-	"bytes"
+	"crypto/ed25519"
 	"crypto/sha256"
 	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"log"
-	"math"
+	"math/rand"
 	"net/http"
 	"sync"
 	"time"
 
 	bolt "go.etcd.io/bbolt"
 
-	// Hypothetical imports for XRPL / NFT
-	"CloudStorm/nft"
+	// Hypothetical imports for XRPL
 	"CloudStorm/xumm"
 )
 
@@ -33,15 +33,47 @@ const (
 	Leader
 )
 
+func (s RaftState) String() string {
+	switch s {
+	case Follower:
+		return "Follower"
+	case Candidate:
+		return "Candidate"
+	case Leader:
+		return "Leader"
+	}
+	return fmt.Sprintf("RaftState(%d)", int(s))
+}
+
 // ------------------------------------------------------------------------
 // LogEntry & Data Structures
 // ------------------------------------------------------------------------
 
-// LogEntry holds a term, index, and a command payload.
+// Entry types reserved for raft's own bookkeeping; application commands carry their own
+// types (see fsm.go).
+const (
+	EntryNoop           = "raft.noop"            // appended by each new leader to commit its term
+	EntryConfiguration  = "raft.configuration"   // Command is a Configuration
+	EntryRegisterClient = "raft.register_client" // opens a client session (see session.go)
+)
+
+// LogEntry holds a term, index, and a typed command payload. Type selects the handler
+// that applies Command (see fsm.go); Command is the JSON-encoded payload.
 type LogEntry struct {
-	Index   int         `json:"index"`
-	Term    int         `json:"term"`
-	Command interface{} `json:"command"`
+	Index   int             `json:"index"`
+	Term    int             `json:"term"`
+	Type    string          `json:"type,omitempty"`
+	Command json.RawMessage `json:"command,omitempty"`
+
+	// Set on commands proposed through a client session (see ProposeAs).
+	ClientID string `json:"client_id,omitempty"`
+	Sequence uint64 `json:"sequence,omitempty"`
+
+	// Set by the leader that appended the entry (see chain.go).
+	PrevHash  string `json:"prev_hash,omitempty"`
+	Hash      string `json:"hash,omitempty"`
+	Signer    string `json:"signer,omitempty"`
+	Signature string `json:"signature,omitempty"`
 }
 
 // Network represents a CloudStorm network bound to XRPL assets (master licensing).
@@ -49,6 +81,9 @@ type Network struct {
 	ID              string `json:"id"`
 	TokenIssuerAddr string `json:"token_issuer_address"`
 	MasterLicenseID string `json:"master_license_id"`
+	// Members of the network's raft group when run by a GroupManager; filled in from the
+	// meta group's voters, sorted, by the leader that proposes the network.
+	Members []string `json:"members,omitempty"`
 }
 
 // ContainerConsensus represents container-level consensus state, updated via raft.
@@ -58,7 +93,18 @@ type ContainerConsensus struct {
 	Timestamp   int64  `json:"timestamp"`
 }
 
+// JobTransition names the job a state-change command (e.g. CmdAcceptJob) applies to.
+type JobTransition struct {
+	JobID     string `json:"job_id"`
+	Worker    string `json:"worker,omitempty"`     // node taking or holding the lease
+	At        int64  `json:"at,omitempty"`         // leader's clock, Unix nanoseconds
+	Attempt   int    `json:"attempt,omitempty"`    // CmdExpireJobLease: the attempt that ran out
+	ResultCID string `json:"result_cid,omitempty"` // CmdCompleteJob
+	Error     string `json:"error,omitempty"`      // CmdFailJob
+}
+
 // Job holds metadata about posted or accepted tasks (including e.g. "NodeOnboarding").
+// See jobs.go for its lifecycle.
 type Job struct {
 	ID            string `json:"id"`
 	Type          string `json:"type"`
@@ -67,6 +113,21 @@ type Job struct {
 	LicenseNFTCID string `json:"license_nft_cid"`
 	RippleAddress string `json:"ripple_address"`
 	Status        string `json:"status"`
+	AssignedTo    string `json:"assigned_to,omitempty"` // node whose Worker runs the job
+	NodeAddr      string `json:"node_addr,omitempty"`   // NodeOnboarding: member address of the host it admits
+
+	// Placement constraints (see scheduler.go). Jobs sharing an AntiAffinity key are
+	// never placed on the same node.
+	Requires     *JobRequirements `json:"requires,omitempty"`
+	AntiAffinity string           `json:"anti_affinity,omitempty"`
+
+	MaxAttempts  int    `json:"max_attempts,omitempty"`  // 0 for defaultJobMaxAttempts
+	Attempts     int    `json:"attempts,omitempty"`      // times the job has been accepted
+	Worker       string `json:"worker,omitempty"`        // node holding the lease
+	LeaseExpires int64  `json:"lease_expires,omitempty"` // Unix nanoseconds; 0 for no lease
+	NotBefore    int64  `json:"not_before,omitempty"`    // earliest retry, Unix nanoseconds
+	ResultCID    string `json:"result_cid,omitempty"`
+	Error        string `json:"error,omitempty"` // why the last attempt failed
 }
 
 // ------------------------------------------------------------------------
@@ -74,13 +135,18 @@ type Job struct {
 // ------------------------------------------------------------------------
 
 type VoteRequest struct {
-	Term          int    `json:"term"`
-	CandidateID   string `json:"candidate_id"`
-	LastLogIndex  int    `json:"last_log_index"`
-	LastLogTerm   int    `json:"last_log_term"`
-	ServiceID     string `json:"service_id"`
-	ProofKeyHash  string `json:"proof_key_hash"`
-	CombinedProof string `json:"combined_proof"`
+	Term         int    `json:"term"`
+	CandidateID  string `json:"candidate_id"`
+	LastLogIndex int    `json:"last_log_index"`
+	LastLogTerm  int    `json:"last_log_term"`
+	PreVote      bool   `json:"pre_vote,omitempty"` // ask whether a vote would be granted; changes no state
+	// LeadershipTransfer marks an election started by TimeoutNow; voters grant it even
+	// while they still hear from the (handing-off) leader.
+	LeadershipTransfer bool   `json:"leadership_transfer,omitempty"`
+	ServiceID          string `json:"service_id"`
+	ProofKeyHash       string `json:"proof_key_hash"`
+	CombinedProof      string `json:"combined_proof"`
+	GroupID            string `json:"group_id,omitempty"` // raft group the RPC is for (see groups.go)
 }
 
 type VoteResponse struct {
@@ -91,6 +157,7 @@ type VoteResponse struct {
 type AppendEntriesRequest struct {
 	Term          int        `json:"term"`
 	LeaderID      string     `json:"leader_id"`
+	LeaderAddr    string     `json:"leader_addr,omitempty"` // where followers forward to
 	PrevLogIndex  int        `json:"prev_log_index"`
 	PrevLogTerm   int        `json:"prev_log_term"`
 	Entries       []LogEntry `json:"entries"`
@@ -98,11 +165,41 @@ type AppendEntriesRequest struct {
 	ServiceID     string     `json:"service_id"`
 	ProofKeyHash  string     `json:"proof_key_hash"`
 	CombinedProof string     `json:"combined_proof"`
+	GroupID       string     `json:"group_id,omitempty"`
 }
 
 type AppendEntriesResponse struct {
 	Term    int  `json:"term"`
 	Success bool `json:"success"`
+	// On rejection: the term of the follower's conflicting entry at PrevLogIndex (0 if it
+	// has none) and the first index it holds for that term, or its last index + 1.
+	ConflictTerm  int `json:"conflict_term,omitempty"`
+	ConflictIndex int `json:"conflict_index,omitempty"`
+	// Rejected is set when the request was refused before reaching the log: a bad
+	// consensus proof or entry chain, or a group not running on the follower.
+	Rejected bool `json:"rejected,omitempty"`
+}
+
+// InstallSnapshotRequest ships the leader's latest snapshot to a follower whose next
+// entry has already been compacted out of the leader's log.
+type InstallSnapshotRequest struct {
+	Term              int                      `json:"term"`
+	LeaderID          string                   `json:"leader_id"`
+	LastIncludedIndex int                      `json:"last_included_index"`
+	LastIncludedTerm  int                      `json:"last_included_term"`
+	LastIncludedHash  string                   `json:"last_included_hash,omitempty"`
+	Configuration     Configuration            `json:"configuration"`
+	Sessions          map[string]clientSession `json:"sessions,omitempty"`
+	Data              json.RawMessage          `json:"data"`
+	ServiceID         string                   `json:"service_id"`
+	ProofKeyHash      string                   `json:"proof_key_hash"`
+	CombinedProof     string                   `json:"combined_proof"`
+	GroupID           string                   `json:"group_id,omitempty"`
+}
+
+type InstallSnapshotResponse struct {
+	Term     int  `json:"term"`
+	Rejected bool `json:"rejected,omitempty"` // refused, as for AppendEntriesResponse
 }
 
 // ------------------------------------------------------------------------
@@ -123,6 +220,9 @@ type IBTCoordinates []int
 //	dims     = array describing each dimension (size + bypass arcs).
 //	nodeA,B  = IBTCoordinates in the same dimension layout.
 //	allPorts = if true, we can move in multiple dimensions simultaneously (like an all-port).
+//
+// Per dimension this is the exact shortest route mixing ring and bypass hops (see
+// routing.go); coordinates are taken modulo the dimension size.
 func ComputeIBTDistance(nodeA, nodeB IBTCoordinates, dims []IBTDimension, allPorts bool) int {
 	if len(dims) != len(nodeA) || len(dims) != len(nodeB) {
 		// Dimension mismatch => invalid
@@ -131,24 +231,11 @@ func ComputeIBTDistance(nodeA, nodeB IBTCoordinates, dims []IBTDimension, allPor
 	distPerDim := make([]int, len(dims))
 
 	for i, dconf := range dims {
-		diff := (nodeB[i] - nodeA[i]) % dconf.Size
-		if diff < 0 {
-			diff += dconf.Size
-		}
-		// ring distance
-		ringDist := diff
-		if ringDist > dconf.Size-ringDist {
-			ringDist = dconf.Size - ringDist
-		}
-		best := ringDist
-		// Check each bypass arc to see if it shortens the hop count
-		for _, bsize := range dconf.BypassSchemes {
-			hops := int(math.Ceil(float64(ringDist) / float64(bsize)))
-			if hops < best {
-				best = hops
-			}
+		ring, err := newRingRoutes(dconf)
+		if err != nil {
+			return 999999999
 		}
-		distPerDim[i] = best
+		distPerDim[i] = ring.dist[mod(nodeB[i]-nodeA[i], dconf.Size)]
 	}
 
 	if allPorts {
@@ -186,29 +273,97 @@ type RaftNode struct {
 
 	nextIndex  map[string]int
 	matchIndex map[string]int
+	inflight   map[string]int // outstanding AppendEntries per peer (see replication.go)
+
+	maxAppendSize int
+	maxInflight   int
 
 	id        string
-	peers     []string
+	addr      string   // address other members use to reach us; defaults to id
+	peers     []string // members and learners other than ourselves, derived from config
 	db        *bolt.DB
+	groupID   string // raft group within db; "" for the top-level buckets (see groups.go)
+	sharedDB  bool   // db belongs to a GroupManager and outlives the node
 	tlsConfig *tls.Config
+	transport Transport
+	fsm       FSM
+
+	// Observability (see metrics.go and events.go).
+	metrics *raftMetrics
+	events  *eventBus
+
+	// Cluster membership (see membership.go).
+	bootstrapPeers []string
+	snapConfig     Configuration     // configuration captured in the latest snapshot
+	config         Configuration     // latest configuration in the log, in effect once appended
+	configIndex    int               // log index of config; 0 if it predates the log
+	autoPromote    map[string]bool   // learners this leader promotes once caught up
+	onboarding     map[string]string // onboarded host address -> job, until it is a voter
 
 	// Internal Data
 	jobQueue             map[string]Job
+	expiring             map[string]int // job -> attempt whose lease expiry this leader proposed
+	lastLeaseScan        time.Time
 	Networks             map[string]Network
 	ContainerConsensusDB map[string]ContainerConsensus
+	capacities           map[string]NodeCapacity // latest report per node (see capacity.go)
 
 	// iBT NodeCoord storage (OPTIONAL for scheduling)
-	nodeCoords map[string]IBTCoordinates
-	ibtDims    []IBTDimension
-	allPorts   bool
-
-	electionTimeout time.Duration
+	nodeCoords        map[string]IBTCoordinates
+	nodeAddrs         map[string]string // member address of each placed node (see placement.go)
+	lastPlacementScan time.Time
+	ibtDims           []IBTDimension
+	allPorts          bool
+	topology          *IBTTopology  // routes over ibtDims, built once
+	policy            ScoringPolicy // job placement (see scheduler.go)
+
+	// snapshotThreshold is how many applied entries may accumulate past the last
+	// snapshot before the log prefix is compacted.
+	snapshotThreshold int
+
+	// Proposals awaiting apply, by log index (see future.go).
+	pending         map[int]*ApplyFuture
+	proposalTimeout time.Duration
+
+	sessions     map[string]clientSession // replicated client sessions (see session.go)
+	idleSessions []*localSession          // this node's own sessions not in use
+
+	// Trinity consensus proofs (see proof.go).
+	nodeKey         ed25519.PrivateKey
+	peerKeys        map[string]ed25519.PublicKey
+	insecureProofs  bool // accept senders without a peer key
+	serviceID       string
+	proofKeyHash    string
+	verifyServiceID func(serviceID string) bool
+
+	// Linearizable reads (see read.go).
+	lastAck      map[string]time.Time // send time of each peer's latest acknowledged RPC
+	leaseTimeout time.Duration        // zero disables lease-based reads
+	applyNotify  chan struct{}        // closed and replaced whenever lastApplied advances
+
+	leaderID    string
+	leaderAddr  string    // leaderID's member address; "" until its first AppendEntries
+	lastContact time.Time // when we last heard from a valid leader
+
+	// Leadership transfer (see transfer.go).
+	transferTarget   string // set on a leader handing off; proposals are refused meanwhile
+	transferElection bool   // set by TimeoutNow, which already started the election's term
+	timeoutNowTerm   int    // term in which this leader sent TimeoutNow; no lease reads in it
+
+	electionTimeout time.Duration // minimum; each wait is randomized up to twice this
+	rng             *rand.Rand    // guarded by mutex
+	tally           *voteTally    // votes of the current pre-vote or election round
+	clock           func() time.Time
+	dispatch        func(pr string, req interface{}) // starts a pipelined RPC; see dispatchRPC
 	heartbeat       time.Duration
+	resetChan       chan struct{} // signalled when the election timer should restart
 	stopChan        chan struct{}
 	wg              sync.WaitGroup
 }
 
 // NewRaftNode initializes a RaftNode with a sentinel log entry + local DB + optional TLS + iBT dims.
+// Peers are reached over an HTTPTransport using tlsCfg; see SetTransport to replace it.
+// Any term, vote and log entries persisted in the DB by a previous run are restored.
 func NewRaftNode(
 	id string,
 	peers []string,
@@ -222,41 +377,111 @@ func NewRaftNode(
 	if err != nil {
 		return nil, err
 	}
-	return &RaftNode{
+	rn, err := newRaftNode(id, "", peers, db, tlsCfg, dims, useAllPorts)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return rn, nil
+}
+
+// newRaftNode initializes a node of the given raft group whose state lives in db.
+func newRaftNode(
+	id string,
+	groupID string,
+	peers []string,
+	db *bolt.DB,
+	tlsCfg *tls.Config,
+	dims []IBTDimension,
+	useAllPorts bool,
+) (*RaftNode, error) {
+	rn := &RaftNode{
 		state:     Follower,
 		log:       []LogEntry{{Index: 0, Term: 0}}, // sentinel entry
 		id:        id,
-		peers:     peers,
+		addr:      id,
 		db:        db,
+		groupID:   groupID,
 		tlsConfig: tlsCfg,
+		metrics:   newRaftMetrics(),
+		events:    &eventBus{},
+
+		bootstrapPeers: peers,
+		autoPromote:    make(map[string]bool),
 
 		jobQueue:             make(map[string]Job),
 		Networks:             make(map[string]Network),
 		ContainerConsensusDB: make(map[string]ContainerConsensus),
+		capacities:           make(map[string]NodeCapacity),
 		nodeCoords:           make(map[string]IBTCoordinates),
+		nodeAddrs:            make(map[string]string),
+		onboarding:           make(map[string]string),
 		ibtDims:              dims,
 		allPorts:             useAllPorts,
+		policy:               BalancedPolicy,
+		snapshotThreshold:    defaultSnapshotThreshold,
+		pending:              make(map[int]*ApplyFuture),
+		sessions:             make(map[string]clientSession),
+		peerKeys:             make(map[string]ed25519.PublicKey),
+		proposalTimeout:      defaultProposalTimeout,
+		lastAck:              make(map[string]time.Time),
+		applyNotify:          make(chan struct{}),
 
 		electionTimeout: 150 * time.Millisecond,
+		rng:             rand.New(rand.NewSource(time.Now().UnixNano() ^ int64(fnv32(id)))),
+		clock:           time.Now,
 		heartbeat:       50 * time.Millisecond,
+		resetChan:       make(chan struct{}, 1),
 		stopChan:        make(chan struct{}),
 		nextIndex:       make(map[string]int),
 		matchIndex:      make(map[string]int),
-	}, nil
+		inflight:        make(map[string]int),
+		maxAppendSize:   defaultMaxAppendSize,
+		maxInflight:     defaultMaxInflight,
+	}
+	rn.transport = rn.instrument(NewHTTPTransport(tlsCfg, defaultRPCTimeout))
+	rn.fsm = &nodeFSM{rn: rn, registry: groupID == ""}
+	rn.dispatch = rn.dispatchRPC
+	var err error
+	if rn.topology, err = NewIBTTopology(dims, useAllPorts); err != nil {
+		return nil, err
+	}
+	if err := rn.loadFromStorage(); err != nil {
+		return nil, fmt.Errorf("failed to restore raft state: %w", err)
+	}
+	if rn.nodeKey, err = rn.loadNodeKey(); err != nil {
+		return nil, fmt.Errorf("failed to load node key: %w", err)
+	}
+	rn.reloadConfig()
+	return rn, nil
+}
+
+// SetTransport replaces the transport used for outbound RPCs. Call before Start.
+func (rn *RaftNode) SetTransport(t Transport) {
+	rn.mutex.Lock()
+	defer rn.mutex.Unlock()
+	rn.transport = rn.instrument(t)
 }
 
 func (rn *RaftNode) Start() {
-	rn.wg.Add(1)
+	rn.wg.Add(2)
 	go rn.run()
+	go rn.runPlacement()
 }
 
 func (rn *RaftNode) Stop() {
 	close(rn.stopChan)
 	rn.wg.Wait()
-	rn.db.Close()
+	rn.mutex.Lock()
+	rn.failPending(ErrShutdown)
+	rn.mutex.Unlock()
+	if !rn.sharedDB {
+		rn.db.Close()
+	}
 }
 
-// SetNodeCoordinate optionally tracks a node's coordinate in iBT space (for scheduling).
+// SetNodeCoordinate sets a node's coordinate in iBT space on this node only, overriding
+// the one assigned through the log (see placement.go) until the next assignment.
 func (rn *RaftNode) SetNodeCoordinate(nodeID string, coord IBTCoordinates) {
 	rn.mutex.Lock()
 	defer rn.mutex.Unlock()
@@ -272,13 +497,13 @@ func (rn *RaftNode) GetNodeCoordinate(nodeID string) (IBTCoordinates, bool) {
 }
 
 // CreateNetwork securely verifies a host license via XRPL, then appends the new Network to the log.
+// The Network becomes visible on every node once the entry is committed and applied.
 func (rn *RaftNode) CreateNetwork(networkID, tokenIssuerAddr, xrplTxID string) error {
-	rn.mutex.Lock()
-	defer rn.mutex.Unlock()
-	if rn.state != Leader {
+	if rn.getState() != Leader {
 		return errors.New("only leader can create networks")
 	}
 
+	// The XRPL lookup happens before taking the lock; only its result is replicated.
 	masterLicenseID, err := rn.verifyMasterHostLicense(tokenIssuerAddr, xrplTxID)
 	if err != nil {
 		return fmt.Errorf("failed master license verification: %w", err)
@@ -288,9 +513,10 @@ func (rn *RaftNode) CreateNetwork(networkID, tokenIssuerAddr, xrplTxID string) e
 		TokenIssuerAddr: tokenIssuerAddr,
 		MasterLicenseID: masterLicenseID,
 	}
-	rn.Networks[networkID] = netw
-
-	return rn.AppendCommand(netw)
+	rn.mutex.Lock()
+	netw.Members = groupMembers(rn.config)
+	rn.mutex.Unlock()
+	return rn.proposeAndWait(CmdCreateNetwork, netw)
 }
 
 // verifyMasterHostLicense checks XRPL ledger data from xumm for a valid license transaction.
@@ -311,47 +537,88 @@ func (rn *RaftNode) verifyMasterHostLicense(issuerAddr, xrplTxID string) (string
 	return tx.Hash, nil
 }
 
-// UpdateContainerConsensus sets container-level state in the ContainerConsensusDB, replicates it.
+// UpdateContainerConsensus replicates container-level state; ContainerConsensusDB is
+// updated on every node when the entry is applied. The timestamp is fixed by the proposer.
 func (rn *RaftNode) UpdateContainerConsensus(containerID, stateHash string) error {
-	rn.mutex.Lock()
-	defer rn.mutex.Unlock()
-
 	cons := ContainerConsensus{
 		ContainerID: containerID,
 		StateHash:   stateHash,
 		Timestamp:   time.Now().Unix(),
 	}
-	rn.ContainerConsensusDB[containerID] = cons
-
-	return rn.AppendCommand(cons)
+	return rn.proposeAndWait(CmdUpdateContainer, cons)
 }
 
-// PostJob enqueues a new job in this node's jobQueue and replicates it across the cluster.
+// PostJob replicates a new job and waits until it is applied; it then sits in the
+// jobQueue of every node. A job ID already in use is rejected on apply. Only the leader
+// can post jobs.
 func (rn *RaftNode) PostJob(job Job) error {
+	job.Status = JobQueued
+	return rn.proposeAndWait(CmdPostJob, job)
+}
+
+// AcceptJob replicates the transition of a queued job to accepted, leasing it to this
+// node, and waits until it is applied. There is no fast failure: failed jobs return to
+// the queue, so the local state may be stale in either direction and only apply can
+// tell.
+func (rn *RaftNode) AcceptJob(jobID string) error {
+	return rn.submit(CmdAcceptJob, rn.jobTransition(jobID, rn.id))
+}
+
+// proposeAndWait proposes a command through one of the node's client sessions (see
+// session.go) and waits until it is applied. Only the leader can propose it.
+// Caller must not hold rn.mutex.
+func (rn *RaftNode) proposeAndWait(cmdType string, command interface{}) error {
+	return rn.proposeAsClient(cmdType, command, false)
+}
+
+// ------------------------------------------------------------------------
+// Replicated State Queries (local applied state)
+// ------------------------------------------------------------------------
+
+// GetNetwork returns the applied Network with the given ID.
+func (rn *RaftNode) GetNetwork(networkID string) (Network, bool) {
+	rn.mutex.Lock()
+	defer rn.mutex.Unlock()
+	netw, ok := rn.Networks[networkID]
+	return netw, ok
+}
+
+// ListNetworks returns every applied Network.
+func (rn *RaftNode) ListNetworks() []Network {
 	rn.mutex.Lock()
 	defer rn.mutex.Unlock()
-	if _, exists := rn.jobQueue[job.ID]; exists {
-		return errors.New("job already exists")
+	out := make([]Network, 0, len(rn.Networks))
+	for _, netw := range rn.Networks {
+		out = append(out, netw)
 	}
-	job.Status = "queued"
-	rn.jobQueue[job.ID] = job
-	return rn.AppendCommand(job)
+	return out
 }
 
-// AcceptJob transitions a queued job to accepted, replicates that update.
-func (rn *RaftNode) AcceptJob(jobID string) error {
+// GetJob returns the applied state of a job.
+func (rn *RaftNode) GetJob(jobID string) (Job, bool) {
 	rn.mutex.Lock()
 	defer rn.mutex.Unlock()
 	job, ok := rn.jobQueue[jobID]
-	if !ok {
-		return errors.New("job not found")
-	}
-	if job.Status != "queued" {
-		return errors.New("job is not in a queued state")
+	return job, ok
+}
+
+// ListJobs returns every applied job.
+func (rn *RaftNode) ListJobs() []Job {
+	rn.mutex.Lock()
+	defer rn.mutex.Unlock()
+	out := make([]Job, 0, len(rn.jobQueue))
+	for _, job := range rn.jobQueue {
+		out = append(out, job)
 	}
-	job.Status = "accepted"
-	rn.jobQueue[jobID] = job
-	return rn.AppendCommand(job)
+	return out
+}
+
+// GetContainerConsensus returns the applied consensus state of a container.
+func (rn *RaftNode) GetContainerConsensus(containerID string) (ContainerConsensus, bool) {
+	rn.mutex.Lock()
+	defer rn.mutex.Unlock()
+	cons, ok := rn.ContainerConsensusDB[containerID]
+	return cons, ok
 }
 
 // run is the main entrypoint for the node's internal raft state machine.
@@ -362,7 +629,7 @@ func (rn *RaftNode) run() {
 		case <-rn.stopChan:
 			return
 		default:
-			switch rn.state {
+			switch rn.getState() {
 			case Follower:
 				rn.runFollower()
 			case Candidate:
@@ -374,16 +641,97 @@ func (rn *RaftNode) run() {
 	}
 }
 
+// fnv32 hashes s, e.g. to give nodes started at the same instant distinct seeds.
+func fnv32(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
+
+// getState returns the node's current role under the lock.
+func (rn *RaftNode) getState() RaftState {
+	rn.mutex.Lock()
+	defer rn.mutex.Unlock()
+	return rn.state
+}
+
+// becomeFollower steps down to Follower, adopting term if it is newer. Caller holds rn.mutex.
+func (rn *RaftNode) becomeFollower(term int) {
+	if rn.state == Leader {
+		rn.failPending(ErrLeadershipLost)
+		rn.transferTarget = ""
+	}
+	if term > rn.currentTerm {
+		rn.currentTerm = term
+		rn.votedFor = ""
+		if err := rn.saveHardState(); err != nil {
+			log.Printf("Failed to persist term %d: %v", term, err)
+		}
+	}
+	rn.state = Follower
+}
+
+// resetElectionTimer restarts the follower/candidate election timer without blocking.
+func (rn *RaftNode) resetElectionTimer() {
+	select {
+	case rn.resetChan <- struct{}{}:
+	default:
+	}
+}
+
+// snapshotIndex returns the index covered by the latest snapshot. rn.log[0] is a sentinel
+// carrying that index and term, so live entries start at snapshotIndex()+1.
+// Caller holds rn.mutex.
+func (rn *RaftNode) snapshotIndex() int {
+	return rn.log[0].Index
+}
+
+// termAt returns the term of the entry at index, or false if it has been compacted
+// away or does not exist yet. Caller holds rn.mutex.
+func (rn *RaftNode) termAt(index int) (int, bool) {
+	if index < rn.snapshotIndex() || index > rn.lastLogIndex() {
+		return 0, false
+	}
+	return rn.log[index-rn.snapshotIndex()].Term, true
+}
+
+// entryAt returns the live entry at index; the index must lie in
+// (snapshotIndex(), lastLogIndex()]. Caller holds rn.mutex.
+func (rn *RaftNode) entryAt(index int) LogEntry {
+	return rn.log[index-rn.snapshotIndex()]
+}
+
+// lastLogIndex returns the index of the newest log entry. Caller holds rn.mutex.
+func (rn *RaftNode) lastLogIndex() int {
+	return rn.log[len(rn.log)-1].Index
+}
+
+// lastLogTerm returns the term of the newest log entry. Caller holds rn.mutex.
+func (rn *RaftNode) lastLogTerm() int {
+	return rn.log[len(rn.log)-1].Term
+}
+
 func (rn *RaftNode) runFollower() {
-	timer := time.NewTimer(rn.electionTimeout)
+	timer := time.NewTimer(rn.randomizedTimeout())
 	defer timer.Stop()
 
 	for {
 		select {
 		case <-rn.stopChan:
 			return
+		case <-rn.resetChan:
+			if rn.getState() != Follower {
+				return // TimeoutNow made us a candidate
+			}
+			timer.Reset(rn.randomizedTimeout())
 		case <-timer.C:
 			rn.mutex.Lock()
+			if !rn.isVoter(rn.addr) {
+				// Not (or no longer) a voting member: keep following.
+				rn.mutex.Unlock()
+				timer.Reset(rn.randomizedTimeout())
+				continue
+			}
 			rn.state = Candidate
 			rn.mutex.Unlock()
 			return
@@ -391,68 +739,259 @@ func (rn *RaftNode) runFollower() {
 	}
 }
 
+// runCandidate campaigns for leadership: a pre-vote round first, and only if that
+// succeeds a real election in a new term. Elections requested by TimeoutNow skip the
+// pre-vote.
 func (rn *RaftNode) runCandidate() {
 	rn.mutex.Lock()
-	rn.currentTerm++
-	rn.votedFor = rn.id
-	votes := 1 // self-vote
-	lastLogIndex := len(rn.log) - 1
-	lastLogTerm := rn.log[lastLogIndex].Term
+	transfer := rn.transferElection // term already started by HandleTimeoutNow
+	rn.transferElection = false
 	rn.mutex.Unlock()
+	if !transfer {
+		if !rn.runPreVote() {
+			return
+		}
+		rn.mutex.Lock()
+		started := rn.state == Candidate && rn.startElection()
+		rn.mutex.Unlock()
+		if !started {
+			return
+		}
+	}
+
+	rn.mutex.Lock()
+	if rn.state != Candidate {
+		rn.mutex.Unlock()
+		return
+	}
+	tally, req := rn.beginElection(transfer)
+	peers := rn.votingPeers()
+	won := rn.hasQuorum(tally.granted) && rn.becomeLeader(req.Term)
+	rn.mutex.Unlock()
+	if won {
+		return // single-member cluster
+	}
 
-	timer := time.NewTimer(rn.electionTimeout)
+	timer := time.NewTimer(rn.randomizedTimeout())
 	defer timer.Stop()
+	voteChan := rn.requestVotes(peers, tally, req)
 
-	voteChan := make(chan bool, len(rn.peers))
-	for _, peer := range rn.peers {
-		go func(pr string) {
-			req := VoteRequest{
-				Term:         rn.currentTerm,
-				CandidateID:  rn.id,
-				LastLogIndex: lastLogIndex,
-				LastLogTerm:  lastLogTerm,
-			}
-			resp, err := sendVoteRequest(pr, req, 3, 100*time.Millisecond)
-			if err != nil {
-				log.Printf("Vote request to %s failed: %v", pr, err)
-				voteChan <- false
+	for {
+		select {
+		case <-rn.stopChan:
+			return
+		case <-timer.C:
+			return // election timed out
+		case <-rn.resetChan:
+			// A valid leader or a newer term was seen; stop campaigning if we stepped down.
+			if rn.getState() != Candidate {
 				return
 			}
-			rn.mutex.Lock()
-			defer rn.mutex.Unlock()
-			if resp.Term > rn.currentTerm {
-				rn.currentTerm = resp.Term
-				rn.state = Follower
-				rn.votedFor = ""
-				voteChan <- false
+		case v := <-voteChan:
+			if v.won || rn.getState() != Candidate {
 				return
 			}
-			voteChan <- resp.VoteGranted
-		}(peer)
+		}
 	}
+}
 
-	for {
+// startElection moves to a new term as a candidate that voted for itself.
+// Caller holds rn.mutex.
+func (rn *RaftNode) startElection() bool {
+	rn.state = Candidate
+	rn.currentTerm++
+	rn.votedFor = rn.id
+	rn.setLeader("", "")
+	if err := rn.saveHardState(); err != nil {
+		// Without a durable self-vote we could vote twice in this term after a restart.
+		log.Printf("Failed to persist candidacy for term %d: %v", rn.currentTerm, err)
+		rn.state = Follower
+		return false
+	}
+	return true
+}
+
+// runPreVote asks the other voters whether they would vote for us in the next term,
+// without anyone changing term. A node that cannot win, because it is cut off from a
+// quorum, its log is behind or the cluster still hears from a leader, goes back to
+// following instead of inflating terms and deposing a healthy leader on its return.
+func (rn *RaftNode) runPreVote() bool {
+	rn.mutex.Lock()
+	if rn.state != Candidate {
+		rn.mutex.Unlock()
+		return false
+	}
+	tally, req := rn.beginPreVote()
+	if rn.hasQuorum(tally.granted) {
+		rn.mutex.Unlock()
+		return true // single-member cluster
+	}
+	term := rn.currentTerm
+	peers := rn.votingPeers()
+	rn.mutex.Unlock()
+
+	timer := time.NewTimer(rn.randomizedTimeout())
+	defer timer.Stop()
+	voteChan := rn.requestVotes(peers, tally, req)
+
+	won := false
+	for replies := 0; replies < len(peers) && !won; {
 		select {
 		case <-rn.stopChan:
-			return
+			return false
 		case <-timer.C:
-			return // election timed out
-		case granted := <-voteChan:
-			if granted {
-				votes++
+			replies = len(peers)
+		case <-rn.resetChan:
+			if rn.getState() != Candidate {
+				return false
 			}
-			if votes > len(rn.peers)/2 {
-				rn.mutex.Lock()
-				rn.state = Leader
-				for _, p := range rn.peers {
-					rn.nextIndex[p] = len(rn.log)
-					rn.matchIndex[p] = 0
-				}
-				rn.mutex.Unlock()
+		case v := <-voteChan:
+			replies++
+			won = v.won
+		}
+	}
+
+	rn.mutex.Lock()
+	defer rn.mutex.Unlock()
+	if rn.state != Candidate || rn.currentTerm != term {
+		return false
+	}
+	if !won {
+		rn.state = Follower // wait for another election timeout
+	}
+	return won
+}
+
+// voteTally collects the votes granted in one pre-vote or election round. Each round
+// gets a new tally, so late answers to an earlier round are not counted.
+type voteTally struct {
+	granted map[string]bool
+}
+
+// beginPreVote starts a pre-vote round and returns the request to send to each voting
+// peer. Caller holds rn.mutex.
+func (rn *RaftNode) beginPreVote() (*voteTally, VoteRequest) {
+	rn.tally = &voteTally{granted: map[string]bool{rn.addr: true}}
+	req := VoteRequest{
+		Term:         rn.currentTerm + 1,
+		CandidateID:  rn.id,
+		LastLogIndex: rn.lastLogIndex(),
+		LastLogTerm:  rn.lastLogTerm(),
+		PreVote:      true,
+	}
+	req.ServiceID, req.ProofKeyHash, req.CombinedProof = rn.signProof(proofVote, req.Term)
+	return rn.tally, req
+}
+
+// beginElection starts the vote round of the term opened by startElection and returns
+// the request to send to each voting peer. Caller holds rn.mutex.
+func (rn *RaftNode) beginElection(transfer bool) (*voteTally, VoteRequest) {
+	rn.tally = &voteTally{granted: map[string]bool{rn.addr: true}} // self-vote
+	req := VoteRequest{
+		Term:               rn.currentTerm,
+		CandidateID:        rn.id,
+		LastLogIndex:       rn.lastLogIndex(),
+		LastLogTerm:        rn.lastLogTerm(),
+		LeadershipTransfer: transfer,
+	}
+	req.ServiceID, req.ProofKeyHash, req.CombinedProof = rn.signProof(proofVote, req.Term)
+	return rn.tally, req
+}
+
+// handleVoteResponse counts peer's answer to req, sent in the round of tally. It reports
+// whether the round has just been won: for a pre-vote the caller then starts the
+// election, for an election this node has become leader. A reply carrying a newer term
+// makes us step down. Caller holds rn.mutex.
+func (rn *RaftNode) handleVoteResponse(tally *voteTally, peer string, req VoteRequest, resp VoteResponse) bool {
+	if resp.Term > rn.currentTerm {
+		rn.becomeFollower(resp.Term)
+		rn.resetElectionTimer()
+		return false
+	}
+	if tally != rn.tally || rn.state != Candidate || !resp.VoteGranted || tally.granted[peer] {
+		return false
+	}
+	if req.PreVote {
+		// A pre-vote is answered from the voter's current term, not the proposed one.
+		if rn.currentTerm+1 != req.Term {
+			return false
+		}
+		tally.granted[peer] = true
+		return rn.hasQuorum(tally.granted)
+	}
+	if rn.currentTerm != req.Term || resp.Term != req.Term {
+		return false
+	}
+	tally.granted[peer] = true
+	return rn.hasQuorum(tally.granted) && rn.becomeLeader(req.Term)
+}
+
+// voteResult is the outcome of one peer's answer to a (pre-)vote request.
+type voteResult struct {
+	peer string
+	won  bool // the answer completed a quorum
+}
+
+// requestVotes sends req to every peer concurrently, counts their answers into tally and
+// reports each on the returned channel.
+func (rn *RaftNode) requestVotes(peers []string, tally *voteTally, req VoteRequest) <-chan voteResult {
+	voteChan := make(chan voteResult, len(peers))
+	for _, peer := range peers {
+		go func(pr string) {
+			resp, err := rn.transport.RequestVote(pr, req)
+			if err != nil {
+				log.Printf("Vote request to %s failed: %v", pr, err)
+				voteChan <- voteResult{pr, false}
 				return
 			}
-		}
+			rn.mutex.Lock()
+			won := rn.handleVoteResponse(tally, pr, req, resp)
+			rn.mutex.Unlock()
+			voteChan <- voteResult{pr, won}
+		}(peer)
 	}
+	return voteChan
+}
+
+// randomizedTimeout returns an election timeout drawn uniformly from
+// [electionTimeout, 2*electionTimeout), so that nodes rarely time out together and
+// split the vote. Caller must not hold rn.mutex.
+func (rn *RaftNode) randomizedTimeout() time.Duration {
+	rn.mutex.Lock()
+	defer rn.mutex.Unlock()
+	return rn.electionTimeout + time.Duration(rn.rng.Int63n(int64(rn.electionTimeout)))
+}
+
+// leaderActive reports whether this node is the leader or heard from one within the
+// minimum election timeout. Caller holds rn.mutex.
+func (rn *RaftNode) leaderActive() bool {
+	if rn.state == Leader {
+		return true
+	}
+	return !rn.lastContact.IsZero() && rn.clock().Sub(rn.lastContact) < rn.electionTimeout
+}
+
+// becomeLeader takes leadership for term, resets replication progress and appends a
+// no-op so entries from earlier terms can be committed. Caller holds rn.mutex.
+func (rn *RaftNode) becomeLeader(term int) bool {
+	rn.state = Leader
+	rn.setLeader(rn.id, rn.addr)
+	rn.nextIndex = make(map[string]int)
+	rn.matchIndex = make(map[string]int)
+	rn.lastAck = make(map[string]time.Time)
+	rn.inflight = make(map[string]int)
+	rn.expiring = make(map[string]int)
+	for _, p := range rn.peers {
+		rn.nextIndex[p] = rn.lastLogIndex() + 1
+		rn.matchIndex[p] = 0
+	}
+	if _, err := rn.appendEntry(EntryNoop, nil); err != nil {
+		log.Printf("Failed to append leader no-op for term %d: %v", term, err)
+		rn.becomeFollower(term)
+		return false
+	}
+	log.Printf("Node %s became leader for term %d", rn.id, term)
+	return true
 }
 
 func (rn *RaftNode) runLeader() {
@@ -465,184 +1004,103 @@ func (rn *RaftNode) runLeader() {
 		case <-rn.stopChan:
 			return
 		case <-ticker.C:
+			if rn.getState() != Leader {
+				return
+			}
 			rn.sendHeartbeats()
 			rn.updateCommitIndex()
+			rn.expireJobLeases()
+			rn.releaseDepartedNodes()
+			rn.admitOnboardedHosts()
 		}
 	}
 }
 
-func (rn *RaftNode) sendHeartbeats() {
+func (rn *RaftNode) updateCommitIndex() {
 	rn.mutex.Lock()
-	term := rn.currentTerm
-	logLen := len(rn.log)
-	commitIndex := rn.commitIndex
-	rn.mutex.Unlock()
-
-	for _, peer := range rn.peers {
-		go func(pr string) {
-			rn.mutex.Lock()
-			prevLogIndex := rn.nextIndex[pr] - 1
-			prevLogTerm := 0
-			if prevLogIndex >= 0 && prevLogIndex < len(rn.log) {
-				prevLogTerm = rn.log[prevLogIndex].Term
-			}
-			var entries []LogEntry
-			if rn.nextIndex[pr] < logLen {
-				entries = rn.log[rn.nextIndex[pr]:]
-			}
-			req := AppendEntriesRequest{
-				Term:         term,
-				LeaderID:     rn.id,
-				PrevLogIndex: prevLogIndex,
-				PrevLogTerm:  prevLogTerm,
-				Entries:      entries,
-				LeaderCommit: commitIndex,
-			}
-			rn.mutex.Unlock()
-
-			resp, err := sendAppendEntries(pr, req, 3, 100*time.Millisecond)
-			if err != nil {
-				log.Printf("AppendEntries to %s failed: %v", pr, err)
-				return
-			}
-			rn.mutex.Lock()
-			defer rn.mutex.Unlock()
-			if resp.Term > rn.currentTerm {
-				rn.currentTerm = resp.Term
-				rn.state = Follower
-				rn.votedFor = ""
-				return
-			}
-			if resp.Success {
-				rn.nextIndex[pr] = logLen
-				rn.matchIndex[pr] = logLen - 1
-			} else {
-				rn.nextIndex[pr]--
-				if rn.nextIndex[pr] < 1 {
-					rn.nextIndex[pr] = 1
-				}
-			}
-		}(peer)
+	defer rn.mutex.Unlock()
+	if rn.state != Leader {
+		return
 	}
+	rn.advanceCommitIndex()
 }
 
-func (rn *RaftNode) updateCommitIndex() {
-	rn.mutex.Lock()
-	defer rn.mutex.Unlock()
-	for n := rn.commitIndex + 1; n < len(rn.log); n++ {
-		count := 1
+// advanceCommitIndex commits every entry of the current term replicated on a quorum
+// and applies it. Caller holds rn.mutex and is the leader.
+func (rn *RaftNode) advanceCommitIndex() {
+	for n := rn.commitIndex + 1; n <= rn.lastLogIndex(); n++ {
+		replicated := map[string]bool{rn.addr: true}
 		for _, p := range rn.peers {
 			if rn.matchIndex[p] >= n {
-				count++
+				replicated[p] = true
 			}
 		}
-		if count > len(rn.peers)/2 && rn.log[n].Term == rn.currentTerm {
+		if rn.hasQuorum(replicated) && rn.entryAt(n).Term == rn.currentTerm {
 			rn.commitIndex = n
 			rn.applyLogEntries()
 		}
 	}
+	rn.promoteCaughtUpLearners()
+	// A leader that committed its own removal hands off by stepping down.
+	if !rn.isVoter(rn.addr) && rn.commitIndex >= rn.configIndex {
+		log.Printf("Node %s removed from configuration; stepping down", rn.id)
+		rn.becomeFollower(rn.currentTerm)
+	}
 }
 
 func (rn *RaftNode) applyLogEntries() {
+	if rn.lastApplied < rn.commitIndex {
+		rn.events.publish(rn, Event{Type: EventCommitted, Term: rn.currentTerm, Index: rn.commitIndex})
+		defer rn.notifyApplied()
+	}
 	for rn.lastApplied < rn.commitIndex {
 		rn.lastApplied++
-		if err := ProcessLogEntry(rn.log[rn.lastApplied]); err != nil {
-			log.Printf("Error applying log entry %d: %v", rn.lastApplied, err)
+		entry := rn.entryAt(rn.lastApplied)
+		switch entry.Type {
+		case EntryNoop:
+			rn.resolvePending(entry, nil, nil)
+			continue // raft bookkeeping, nothing to apply
+		case EntryConfiguration:
+			rn.clearAdmitted(entry)
+			rn.resolvePending(entry, nil, nil)
+			continue
+		case EntryRegisterClient:
+			rn.registerClient(entry)
+			rn.resolvePending(entry, nil, nil)
+			continue
 		}
-	}
-}
-
-// ------------------------------------------------------------------------
-// ProcessLogEntry
-// ------------------------------------------------------------------------
-
-// ProcessLogEntry checks whether the command is Network, Job, or ContainerConsensus
-// and applies it accordingly (e.g. calls nft.IssueNFT for NodeOnboarding).
-func ProcessLogEntry(entry LogEntry) error {
-	data, err := json.Marshal(entry.Command)
-	if err != nil {
-		return fmt.Errorf("failed to marshal command: %w", err)
-	}
-
-	// 1) Check if it's a new Network command
-	var netw Network
-	if err := json.Unmarshal(data, &netw); err == nil && netw.MasterLicenseID != "" {
-		log.Printf("New CloudStorm Network '%s' created, XRPL Issuer: %s, Master License: %s",
-			netw.ID, netw.TokenIssuerAddr, netw.MasterLicenseID)
-		return nil
-	}
-
-	// 2) Check if it's a Job command, e.g. node onboarding
-	var job Job
-	if err := json.Unmarshal(data, &job); err == nil && job.Type == "NodeOnboarding" {
-		// For demonstration, use the nft package to issue an NFT for the license
-		if err := nft.IssueNFT(job.Issuer, job.LicenseNFTCID); err != nil {
-			return fmt.Errorf("failed to issue NFT: %w", err)
+		var resp interface{}
+		var err error
+		if entry.ClientID != "" {
+			resp, err = rn.applySessionEntry(entry)
+		} else {
+			resp, err = rn.fsm.Apply(entry)
 		}
-		log.Printf("Node onboarded with issuer: %s", job.Issuer)
-		return nil
-	}
-
-	// 3) Check if it's a ContainerConsensus update
-	var consensus ContainerConsensus
-	if err := json.Unmarshal(data, &consensus); err == nil && consensus.ContainerID != "" {
-		log.Printf("Container consensus updated: Container %s, StateHash %s, Timestamp %d",
-			consensus.ContainerID, consensus.StateHash, consensus.Timestamp)
-		return nil
+		if err != nil {
+			log.Printf("Error applying log entry %d: %v", rn.lastApplied, err)
+		}
+		rn.resolvePending(entry, resp, err)
 	}
-
-	// If it doesn't match any known command type, we silently succeed.
-	return nil
+	rn.maybeSnapshot()
 }
 
 // ------------------------------------------------------------------------
 // Additional Helper for iBT Scheduling
 // ------------------------------------------------------------------------
 
-// PickBestNodeForJob uses iBT distance among known nodeCoords to find the minimal distance node.
+// PickBestNodeForJob picks a node for a job without requirements (see scheduler.go).
 func (rn *RaftNode) PickBestNodeForJob() (string, error) {
-	rn.mutex.Lock()
-	defer rn.mutex.Unlock()
-
-	// Suppose we pick the best node for the job relative to our own coordinate
-	selfCoord, ok := rn.nodeCoords[rn.id]
-	if !ok {
-		return "", errors.New("local node does not have iBT coordinates set")
-	}
-	bestID := ""
-	bestDist := 999999999
-
-	for nodeID, coord := range rn.nodeCoords {
-		if nodeID == rn.id {
-			continue // skip ourselves if we only want remote nodes
-		}
-		dist := ComputeIBTDistance(selfCoord, coord, rn.ibtDims, rn.allPorts)
-		if dist < bestDist {
-			bestDist = dist
-			bestID = nodeID
-		}
-	}
-	if bestID == "" {
-		return "", errors.New("no other nodes found in iBT coordinate map")
-	}
-	return bestID, nil
+	return rn.PickNodeForJob(Job{})
 }
 
-// ScheduleJob example: picks the best node for the job, sets job fields, calls PostJob to replicate it.
+// ScheduleJob example: builds the job and places it with Schedule, which replicates it.
 func (rn *RaftNode) ScheduleJob(jobID, jobType, issuer, cid string) error {
-	node, err := rn.PickBestNodeForJob()
-	if err != nil {
-		return err
-	}
-	newJob := Job{
+	return rn.Schedule(Job{
 		ID:            jobID,
 		Type:          jobType,
 		Issuer:        issuer,
 		LicenseNFTCID: cid,
-		RippleAddress: node, // store the chosen node as the job's assigned node
-		Status:        "queued",
-	}
-	return rn.PostJob(newJob)
+	})
 }
 
 // ------------------------------------------------------------------------
@@ -664,124 +1122,59 @@ func LogStatus() string {
 	globalNode.mutex.Lock()
 	defer globalNode.mutex.Unlock()
 	return fmt.Sprintf(
-		"Term: %d, Log length: %d, CommitIndex: %d",
+		"Term: %d, Log length: %d, CommitIndex: %d, SnapshotIndex: %d",
 		globalNode.currentTerm,
-		len(globalNode.log),
+		len(globalNode.log)-1,
 		globalNode.commitIndex,
+		globalNode.snapshotIndex(),
 	)
 }
 
-// AppendCommand appends the given command to the local log if node is Leader.
-func (rn *RaftNode) AppendCommand(command interface{}) error {
+// AppendCommand appends a command of the given type to the local log if node is Leader.
+// It returns as soon as the entry is appended; use Propose to learn whether it was applied.
+func (rn *RaftNode) AppendCommand(cmdType string, command interface{}) error {
 	rn.mutex.Lock()
 	defer rn.mutex.Unlock()
 	if rn.state != Leader {
-		return errors.New("not the leader")
+		return ErrNotLeader
 	}
-	entry := LogEntry{
-		Index:   len(rn.log),
-		Term:    rn.currentTerm,
-		Command: command,
+	if rn.transferTarget != "" {
+		return ErrLeadershipTransferInProgress
 	}
-	rn.log = append(rn.log, entry)
-	return nil
+	_, err := rn.appendEntry(cmdType, command)
+	return err
 }
 
-// ------------------------------------------------------------------------
-// Vote & AppendEntries RPC Helpers (multi-attempt with local proof check)
-// ------------------------------------------------------------------------
-
-func sendVoteRequest(peerURL string, req VoteRequest, attempts int, baseTimeout time.Duration) (VoteResponse, error) {
-	// Insert local consensus proof if empty:
-	if req.ServiceID == "" || req.ProofKeyHash == "" {
-		sid, pkh := getLocalConsensusProof()
-		req.ServiceID = sid
-		req.ProofKeyHash = pkh
-	}
-	if req.CombinedProof == "" {
-		req.CombinedProof = CombineProof(req.ServiceID, req.ProofKeyHash)
-	}
-	if err := ValidateConsensusProof(req.ServiceID, req.ProofKeyHash, req.CombinedProof); err != nil {
-		return VoteResponse{}, err
-	}
-
-	var voteResp VoteResponse
-	data, err := json.Marshal(req)
-	if err != nil {
-		return voteResp, err
-	}
-
-	var finalErr error
-	for i := 0; i < attempts; i++ {
-		client := &http.Client{Timeout: baseTimeout}
-		httpReq, err := http.NewRequest("POST", peerURL+"/requestVote", bytes.NewReader(data))
-		if err != nil {
-			finalErr = err
-			time.Sleep(baseTimeout)
-			continue
-		}
-		httpReq.Header.Set("Content-Type", "application/json")
-		resp, err := client.Do(httpReq)
-		if err != nil {
-			finalErr = err
-			time.Sleep(baseTimeout)
-			continue
-		}
-		defer resp.Body.Close()
-		if err := json.NewDecoder(resp.Body).Decode(&voteResp); err != nil {
-			finalErr = err
-			time.Sleep(baseTimeout)
-			continue
-		}
-		return voteResp, nil
-	}
-	return voteResp, finalErr
+// appendEntry durably appends a new entry for the current term to the leader's log and
+// starts sending it to the peers. Caller holds rn.mutex.
+func (rn *RaftNode) appendEntry(entryType string, command interface{}) (LogEntry, error) {
+	return rn.appendEntryAs(entryType, command, "", 0)
 }
 
-func sendAppendEntries(peerURL string, req AppendEntriesRequest, attempts int, baseTimeout time.Duration) (AppendEntriesResponse, error) {
-	if req.ServiceID == "" || req.ProofKeyHash == "" {
-		sid, pkh := getLocalConsensusProof()
-		req.ServiceID = sid
-		req.ProofKeyHash = pkh
-	}
-	if req.CombinedProof == "" {
-		req.CombinedProof = CombineProof(req.ServiceID, req.ProofKeyHash)
-	}
-	if err := ValidateConsensusProof(req.ServiceID, req.ProofKeyHash, req.CombinedProof); err != nil {
-		return AppendEntriesResponse{}, err
-	}
-
-	var finalResp AppendEntriesResponse
-	data, err := json.Marshal(req)
-	if err != nil {
-		return finalResp, err
+// appendEntryAs is appendEntry for a command tagged with a client session.
+// Caller holds rn.mutex.
+func (rn *RaftNode) appendEntryAs(entryType string, command interface{}, clientID string, seq uint64) (LogEntry, error) {
+	entry := LogEntry{
+		Index:    rn.lastLogIndex() + 1,
+		Term:     rn.currentTerm,
+		Type:     entryType,
+		ClientID: clientID,
+		Sequence: seq,
 	}
-
-	var finalErr error
-	for i := 0; i < attempts; i++ {
-		client := &http.Client{Timeout: baseTimeout}
-		httpReq, err := http.NewRequest("POST", peerURL+"/appendEntries", bytes.NewReader(data))
+	if command != nil {
+		data, err := json.Marshal(command)
 		if err != nil {
-			finalErr = err
-			time.Sleep(baseTimeout)
-			continue
-		}
-		httpReq.Header.Set("Content-Type", "application/json")
-		httpResp, err := client.Do(httpReq)
-		if err != nil {
-			finalErr = err
-			time.Sleep(baseTimeout)
-			continue
+			return entry, fmt.Errorf("failed to encode %s command: %w", entryType, err)
 		}
-		defer httpResp.Body.Close()
-		if err := json.NewDecoder(httpResp.Body).Decode(&finalResp); err != nil {
-			finalErr = err
-			time.Sleep(baseTimeout)
-			continue
-		}
-		return finalResp, nil
+		entry.Command = data
 	}
-	return finalResp, finalErr
+	rn.sealEntry(&entry)
+	if err := rn.saveLogEntries(entry.Index, []LogEntry{entry}); err != nil {
+		return entry, fmt.Errorf("failed to persist log entry: %w", err)
+	}
+	rn.log = append(rn.log, entry)
+	rn.replicateAll()
+	return entry, nil
 }
 
 // ------------------------------------------------------------------------
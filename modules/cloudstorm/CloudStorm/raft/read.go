@@ -0,0 +1,197 @@
+// -------------------- raft/read.go --------------------
+package raft
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// defaultReadTimeout bounds a linearizable read issued through the query endpoints.
+const defaultReadTimeout = time.Second
+
+var (
+	// ErrReadTimeout is returned when a linearizable read cannot be confirmed in time.
+	ErrReadTimeout = errors.New("timed out waiting for a linearizable read")
+	// ErrLeadershipNotConfirmed is returned when a quorum did not acknowledge this node as
+	// leader for a read; it may have been deposed without knowing it yet.
+	ErrLeadershipNotConfirmed = errors.New("leadership could not be confirmed by a quorum")
+)
+
+// ------------------------------------------------------------------------
+// Linearizable Reads (ReadIndex + optional leader lease)
+// ------------------------------------------------------------------------
+//
+// A read is linearizable if it observes every write committed before it started. The
+// leader records its commitIndex as the read index, confirms with a round of heartbeats
+// that a quorum still follows it (so no newer leader can have committed anything), and
+// waits until it has applied up to the read index. The local state is then safe to read.
+//
+// With a lease enabled the heartbeat round is skipped while a quorum acknowledged the
+// leader within the lease. That relies on the lease being shorter than the election
+// timeout and on bounded clock drift between nodes, so it is off by default. It also
+// relies on followers not voting while they hear from the leader, which a leadership
+// transfer overrides: the target campaigns at once and its votes are granted anyway, so
+// a leader handing off confirms every read with a heartbeat round, and once it has sent
+// TimeoutNow it does so for the rest of its term, even if the transfer seems to fail.
+
+// SetReadLease enables lease-based reads for the given duration, which must be shorter
+// than the election timeout. Zero disables the lease.
+func (rn *RaftNode) SetReadLease(lease time.Duration) error {
+	rn.mutex.Lock()
+	defer rn.mutex.Unlock()
+	if lease >= rn.electionTimeout {
+		return fmt.Errorf("read lease %v must be shorter than the election timeout %v", lease, rn.electionTimeout)
+	}
+	rn.leaseTimeout = lease
+	return nil
+}
+
+// Leader returns the ID of the leader this node currently follows, if known.
+func (rn *RaftNode) Leader() string {
+	rn.mutex.Lock()
+	defer rn.mutex.Unlock()
+	return rn.leaderID
+}
+
+// ReadIndex confirms this node is still the leader and waits until its applied state
+// reflects every entry committed before the call. On success the caller may read the
+// local state (GetJob, ListNetworks, ...) and observe a linearizable view. It returns the
+// read index, or ErrNotLeader, ErrLeadershipNotConfirmed, ErrReadTimeout or ErrShutdown.
+func (rn *RaftNode) ReadIndex(timeout time.Duration) (int, error) {
+	deadline := time.Now().Add(timeout)
+
+	// Wait until this leader knows the full commit index (see readIndexReady).
+	var term, readIndex int
+	var leased bool
+	err := rn.waitUntil(deadline, func() (bool, error) {
+		var ready bool
+		var err error
+		term, readIndex, ready, err = rn.readIndexReady()
+		if ready {
+			leased = rn.leaseValid()
+		}
+		return ready, err
+	})
+	if err != nil {
+		return 0, err
+	}
+	if !leased && !rn.confirmLeadership(term, deadline) {
+		return 0, ErrLeadershipNotConfirmed
+	}
+	err = rn.waitUntil(deadline, func() (bool, error) {
+		return rn.lastApplied >= readIndex, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return readIndex, nil
+}
+
+// readIndexReady returns the term and read index for a read starting now. ready is
+// false until this leader has committed an entry of its own term, since only then does
+// it know the full commit index. Caller holds rn.mutex.
+func (rn *RaftNode) readIndexReady() (term, index int, ready bool, err error) {
+	if rn.state != Leader {
+		return 0, 0, false, ErrNotLeader
+	}
+	if t, _ := rn.termAt(rn.commitIndex); t != rn.currentTerm {
+		return 0, 0, false, nil
+	}
+	return rn.currentTerm, rn.commitIndex, true, nil
+}
+
+// leaseValid reports whether a quorum acknowledged this leader within the lease and no
+// leadership transfer is under way or has sent TimeoutNow in this term.
+// Caller holds rn.mutex.
+func (rn *RaftNode) leaseValid() bool {
+	if rn.leaseTimeout <= 0 || rn.transferTarget != "" || rn.timeoutNowTerm == rn.currentTerm {
+		return false
+	}
+	return rn.quorumAckedSince(rn.clock().Add(-rn.leaseTimeout))
+}
+
+// quorumAckedSince reports whether a quorum acknowledged us as leader in response to
+// RPCs sent after t. Caller holds rn.mutex.
+func (rn *RaftNode) quorumAckedSince(t time.Time) bool {
+	acks := map[string]bool{rn.addr: true}
+	for _, p := range rn.peers {
+		if sent, ok := rn.lastAck[p]; ok && sent.After(t) {
+			acks[p] = true
+		}
+	}
+	return rn.hasQuorum(acks)
+}
+
+// confirmLeadership runs a heartbeat round and reports whether a quorum acknowledged us
+// as leader of term before the deadline.
+func (rn *RaftNode) confirmLeadership(term int, deadline time.Time) bool {
+	rn.mutex.Lock()
+	peers := append([]string(nil), rn.peers...)
+	acks := map[string]bool{rn.addr: true}
+	confirmed := rn.hasQuorum(acks)
+	rn.mutex.Unlock()
+	if confirmed {
+		return true // single-member cluster
+	}
+
+	ackChan := make(chan string, len(peers))
+	for _, peer := range peers {
+		go func(pr string) {
+			if rn.replicateTo(pr, term) {
+				ackChan <- pr
+			} else {
+				ackChan <- ""
+			}
+		}(peer)
+	}
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	for range peers {
+		select {
+		case <-timer.C:
+			return false
+		case pr := <-ackChan:
+			if pr == "" {
+				continue
+			}
+			acks[pr] = true
+			rn.mutex.Lock()
+			confirmed = rn.state == Leader && rn.currentTerm == term && rn.hasQuorum(acks)
+			rn.mutex.Unlock()
+			if confirmed {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// waitUntil evaluates cond under rn.mutex each time entries are applied, until it holds,
+// it fails, the deadline passes or the node stops. Caller must not hold rn.mutex.
+func (rn *RaftNode) waitUntil(deadline time.Time, cond func() (bool, error)) error {
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	for {
+		rn.mutex.Lock()
+		ok, err := cond()
+		notify := rn.applyNotify
+		rn.mutex.Unlock()
+		if ok || err != nil {
+			return err
+		}
+		select {
+		case <-notify:
+		case <-timer.C:
+			return ErrReadTimeout
+		case <-rn.stopChan:
+			return ErrShutdown
+		}
+	}
+}
+
+// notifyApplied wakes every waitUntil after lastApplied advanced. Caller holds rn.mutex.
+func (rn *RaftNode) notifyApplied() {
+	close(rn.applyNotify)
+	rn.applyNotify = make(chan struct{})
+}
@@ -0,0 +1,67 @@
+// -------------------- raft/read_test.go --------------------
+package raft
+
+import (
+	"testing"
+	"time"
+)
+
+// testReadLease is a read lease comfortably longer than a heartbeat interval, so a
+// leader cut off right after a heartbeat still holds it.
+const testReadLease = 140 * time.Millisecond
+
+// newLeaseCluster starts a three-node cluster with lease-based reads enabled.
+// configure, if set, runs on each node before it starts.
+func newLeaseCluster(t *testing.T, configure func(rn *RaftNode)) *testCluster {
+	t.Helper()
+	return newTestCluster(t, []string{"n1", "n2", "n3"}, nil, func(rn *RaftNode) {
+		if err := rn.SetReadLease(testReadLease); err != nil {
+			t.Fatal(err)
+		}
+		if configure != nil {
+			configure(rn)
+		}
+	})
+}
+
+// followers returns the two followers of leader in a three-node cluster.
+func (c *testCluster) followers(leader *RaftNode) (*RaftNode, *RaftNode) {
+	var fs []*RaftNode
+	for _, id := range c.ids {
+		if id != leader.id {
+			fs = append(fs, c.nodes[id])
+		}
+	}
+	return fs[0], fs[1]
+}
+
+// TestReadIndexDuringTransfer starts a leadership transfer to a lagging follower, cuts
+// the leader off and checks that it no longer serves reads from its lease.
+func TestReadIndexDuringTransfer(t *testing.T) {
+	c := newLeaseCluster(t, nil)
+	leader := c.leader()
+	target, other := c.followers(leader)
+	if _, err := leader.ReadIndex(time.Second); err != nil {
+		t.Fatalf("read before the transfer: %v", err)
+	}
+
+	// The target misses an entry, so the transfer waits for it to catch up.
+	c.net.Partition([]string{target.id}, []string{leader.id, other.id})
+	if err := leader.PostJob(Job{ID: "j"}); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- leader.TransferLeadership(target.id) }()
+	waitFor(t, time.Second, "the transfer to start", func() bool {
+		leader.mutex.Lock()
+		defer leader.mutex.Unlock()
+		return leader.transferTarget != ""
+	})
+
+	c.net.Partition([]string{leader.id}, []string{other.id})
+	if _, err := leader.ReadIndex(testReadLease / 2); err == nil {
+		t.Fatal("read served from the lease during a transfer")
+	}
+	c.net.Heal()
+	<-done
+}
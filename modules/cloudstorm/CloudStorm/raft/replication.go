@@ -0,0 +1,299 @@
+// -------------------- raft/replication.go --------------------
+package raft
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	// defaultMaxAppendSize caps the approximate encoded size of the entries carried by one
+	// AppendEntries request. A single larger entry is still sent on its own.
+	defaultMaxAppendSize = 1 << 20
+	// defaultMaxInflight is how many AppendEntries requests may be outstanding per peer.
+	defaultMaxInflight = 8
+	// entryOverhead approximates the encoding cost of an entry beyond its payload.
+	entryOverhead = 64
+)
+
+// ------------------------------------------------------------------------
+// Log Replication (batched, pipelined AppendEntries)
+// ------------------------------------------------------------------------
+//
+// The leader keeps up to maxInflight requests outstanding per peer. Each request carries
+// the entries from nextIndex up to maxAppendSize bytes, and nextIndex advances as soon as
+// a request is sent rather than when it is acknowledged, so a lagging follower receives a
+// stream of batches instead of one per heartbeat. New entries are sent as soon as they
+// are appended, and a follower that rejects a request returns a conflict hint so the
+// leader can skip back a whole term at a time.
+
+// SetMaxAppendSize sets the approximate byte budget of the entries in one AppendEntries
+// request.
+func (rn *RaftNode) SetMaxAppendSize(bytes int) {
+	rn.mutex.Lock()
+	defer rn.mutex.Unlock()
+	rn.maxAppendSize = bytes
+}
+
+// SetMaxInflight sets how many AppendEntries requests may be outstanding per peer; 1
+// disables pipelining.
+func (rn *RaftNode) SetMaxInflight(n int) {
+	rn.mutex.Lock()
+	defer rn.mutex.Unlock()
+	if n < 1 {
+		n = 1
+	}
+	rn.maxInflight = n
+}
+
+// sendHeartbeats sends every peer at least one AppendEntries request, filling its
+// pipeline with any entries it is missing.
+func (rn *RaftNode) sendHeartbeats() {
+	rn.mutex.Lock()
+	defer rn.mutex.Unlock()
+	if rn.state != Leader {
+		return
+	}
+	for _, peer := range rn.peers {
+		rn.replicate(peer, true)
+	}
+}
+
+// replicateAll sends newly appended entries to every peer without waiting for the next
+// heartbeat. Caller holds rn.mutex.
+func (rn *RaftNode) replicateAll() {
+	if rn.state != Leader {
+		return
+	}
+	for _, peer := range rn.peers {
+		rn.replicate(peer, false)
+	}
+}
+
+// replicate sends requests to pr until its pipeline is full or it has been sent every
+// entry. With heartbeat set, one request goes out even if there is nothing new.
+// Caller holds rn.mutex and is the leader.
+func (rn *RaftNode) replicate(pr string, heartbeat bool) {
+	for rn.inflight[pr] < rn.maxInflight {
+		if !heartbeat && rn.nextIndex[pr] > rn.lastLogIndex() {
+			return
+		}
+		heartbeat = false
+
+		req, ok := rn.buildAppendRequest(pr)
+		if !ok {
+			// The entries this peer needs were compacted into a snapshot. Send it once the
+			// pipeline has drained, and nothing else meanwhile.
+			if rn.inflight[pr] == 0 {
+				rn.inflight[pr] = rn.maxInflight
+				rn.dispatchSnapshot(pr)
+			}
+			return
+		}
+		rn.nextIndex[pr] = req.PrevLogIndex + len(req.Entries) + 1
+		rn.inflight[pr]++
+		rn.dispatchAppend(pr, req)
+	}
+}
+
+// dispatchAppend starts a pipelined request to pr. Caller holds rn.mutex.
+func (rn *RaftNode) dispatchAppend(pr string, req AppendEntriesRequest) {
+	rn.dispatch(pr, req)
+}
+
+// dispatchSnapshot starts installing the latest snapshot on pr, reopening its pipeline
+// at once if there is none. Caller holds rn.mutex.
+func (rn *RaftNode) dispatchSnapshot(pr string) {
+	req, ok := rn.snapshotRequest(pr, rn.currentTerm)
+	if !ok {
+		rn.inflight[pr] = 0
+		return
+	}
+	rn.dispatch(pr, req)
+}
+
+// dispatchRPC is the default dispatch: it sends an AppendEntriesRequest or
+// InstallSnapshotRequest in the background and handles the answer. Tests that deliver
+// messages themselves replace it. Caller holds rn.mutex.
+func (rn *RaftNode) dispatchRPC(pr string, req interface{}) {
+	switch req := req.(type) {
+	case AppendEntriesRequest:
+		go rn.sendAppend(pr, req)
+	case InstallSnapshotRequest:
+		go rn.sendSnapshotAndResume(pr, req)
+	}
+}
+
+// sendAppend delivers one pipelined request and handles its response.
+func (rn *RaftNode) sendAppend(pr string, req AppendEntriesRequest) {
+	sentAt := rn.clock()
+	resp, err := rn.transport.AppendEntries(pr, req)
+	rn.finishAppend(pr, req, resp, err, sentAt)
+}
+
+// finishAppend handles the outcome of a pipelined request sent at sentAt.
+func (rn *RaftNode) finishAppend(pr string, req AppendEntriesRequest, resp AppendEntriesResponse, err error, sentAt time.Time) {
+	rn.mutex.Lock()
+	defer rn.mutex.Unlock()
+	if rn.state != Leader || rn.currentTerm != req.Term {
+		return // leadership (and the pipeline) changed meanwhile
+	}
+	rn.inflight[pr]--
+	if err == nil && resp.Rejected {
+		err = fmt.Errorf("%s rejected our consensus proof", pr)
+	}
+	if err != nil {
+		log.Printf("AppendEntries to %s failed: %v", pr, err)
+		// Resend whatever this request carried on the next heartbeat.
+		if next := req.PrevLogIndex + 1; next < rn.nextIndex[pr] && next > rn.matchIndex[pr] {
+			rn.nextIndex[pr] = next
+		}
+		return
+	}
+	if rn.handleAppendResponse(pr, req, resp, sentAt) {
+		rn.replicate(pr, false) // keep streaming while the peer is behind
+	}
+}
+
+// sendSnapshotAndResume installs a snapshot on pr and then reopens its pipeline.
+func (rn *RaftNode) sendSnapshotAndResume(pr string, req InstallSnapshotRequest) {
+	rn.installSnapshot(pr, req)
+	rn.mutex.Lock()
+	defer rn.mutex.Unlock()
+	rn.resumeAfterSnapshot(pr, req.Term)
+}
+
+// resumeAfterSnapshot reopens pr's pipeline once a snapshot sent as leader of term has
+// been answered or lost. Caller holds rn.mutex.
+func (rn *RaftNode) resumeAfterSnapshot(pr string, term int) {
+	if rn.state == Leader && rn.currentTerm == term {
+		rn.inflight[pr] = 0
+	}
+}
+
+// replicateTo sends one request to pr outside the pipeline and waits for the answer.
+// It reports whether the peer acknowledged us as leader of term.
+func (rn *RaftNode) replicateTo(pr string, term int) bool {
+	rn.mutex.Lock()
+	if rn.state != Leader || rn.currentTerm != term {
+		rn.mutex.Unlock()
+		return false
+	}
+	req, ok := rn.buildAppendRequest(pr)
+	rn.mutex.Unlock()
+	if !ok {
+		return rn.sendSnapshot(pr, term)
+	}
+
+	sentAt := rn.clock()
+	resp, err := rn.transport.AppendEntries(pr, req)
+	if err != nil {
+		log.Printf("AppendEntries to %s failed: %v", pr, err)
+		return false
+	}
+	rn.mutex.Lock()
+	defer rn.mutex.Unlock()
+	return rn.handleAppendResponse(pr, req, resp, sentAt)
+}
+
+// buildAppendRequest builds the next request for pr from its nextIndex, or returns false
+// if the preceding entry has been compacted away. Caller holds rn.mutex.
+func (rn *RaftNode) buildAppendRequest(pr string) (AppendEntriesRequest, bool) {
+	prevLogIndex := rn.nextIndex[pr] - 1
+	prevLogTerm, ok := rn.termAt(prevLogIndex)
+	if !ok {
+		return AppendEntriesRequest{}, false
+	}
+	req := AppendEntriesRequest{
+		Term:         rn.currentTerm,
+		LeaderID:     rn.id,
+		LeaderAddr:   rn.addr,
+		PrevLogIndex: prevLogIndex,
+		PrevLogTerm:  prevLogTerm,
+		Entries:      rn.entriesBatch(prevLogIndex+1, rn.maxAppendSize),
+		LeaderCommit: rn.commitIndex,
+	}
+	req.ServiceID, req.ProofKeyHash, req.CombinedProof = rn.signProof(proofAppend, req.Term)
+	return req, true
+}
+
+// entriesBatch returns a copy of the entries from index on, up to about maxBytes but at
+// least one entry if any exist. Caller holds rn.mutex.
+func (rn *RaftNode) entriesBatch(index, maxBytes int) []LogEntry {
+	if index > rn.lastLogIndex() {
+		return nil
+	}
+	end, size := index, 0
+	for end <= rn.lastLogIndex() {
+		e := rn.entryAt(end)
+		size += len(e.Command) + len(e.Type) + entryOverhead
+		if end > index && size > maxBytes {
+			break
+		}
+		end++
+	}
+	live := rn.log[index-rn.snapshotIndex() : end-rn.snapshotIndex()]
+	return append([]LogEntry(nil), live...)
+}
+
+// handleAppendResponse updates pr's progress from a response to req, sent at sentAt, and
+// advances the commit index. It reports whether the peer acknowledged us as leader of
+// req.Term. Caller holds rn.mutex.
+func (rn *RaftNode) handleAppendResponse(pr string, req AppendEntriesRequest, resp AppendEntriesResponse, sentAt time.Time) bool {
+	if resp.Term > rn.currentTerm {
+		rn.becomeFollower(resp.Term)
+		rn.resetElectionTimer()
+		return false
+	}
+	if rn.state != Leader || rn.currentTerm != req.Term || resp.Rejected {
+		return false // stale response from an earlier term, or our proof was refused
+	}
+	rn.lastAck[pr] = sentAt
+	if !resp.Success {
+		rn.nextIndex[pr] = rn.conflictNextIndex(pr, req, resp)
+		return true
+	}
+	if match := req.PrevLogIndex + len(req.Entries); match > rn.matchIndex[pr] {
+		rn.matchIndex[pr] = match
+		rn.advanceCommitIndex()
+	}
+	if rn.nextIndex[pr] <= rn.matchIndex[pr] {
+		rn.nextIndex[pr] = rn.matchIndex[pr] + 1
+	}
+	return true
+}
+
+// conflictNextIndex picks where to resume replication to pr after it rejected req. With
+// a conflict term the follower has, we skip to just after our last entry of that term,
+// or to the first index of the term if we have none; otherwise to the end of its log.
+// Caller holds rn.mutex.
+func (rn *RaftNode) conflictNextIndex(pr string, req AppendEntriesRequest, resp AppendEntriesResponse) int {
+	next := req.PrevLogIndex // no hint: step back by one
+	if resp.ConflictIndex > 0 {
+		next = resp.ConflictIndex
+		if resp.ConflictTerm > 0 {
+			last := req.PrevLogIndex
+			if last > rn.lastLogIndex() {
+				last = rn.lastLogIndex()
+			}
+			for i := last; i > rn.snapshotIndex(); i-- {
+				term := rn.entryAt(i).Term
+				if term == resp.ConflictTerm {
+					next = i + 1
+					break
+				}
+				if term < resp.ConflictTerm {
+					break
+				}
+			}
+		}
+	}
+	if next <= rn.matchIndex[pr] {
+		next = rn.matchIndex[pr] + 1
+	}
+	if next < 1 {
+		next = 1
+	}
+	return next
+}
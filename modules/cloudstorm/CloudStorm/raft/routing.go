@@ -0,0 +1,305 @@
+// -------------------- raft/routing.go --------------------
+package raft
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrInvalidTopology is returned for dimensions without positions or with a bypass
+	// arc that is not positive.
+	ErrInvalidTopology = errors.New("invalid iBT topology")
+	// ErrInvalidCoordinates is returned for coordinates of the wrong length or outside
+	// their dimension.
+	ErrInvalidCoordinates = errors.New("invalid iBT coordinates")
+)
+
+// ------------------------------------------------------------------------
+// iBT Routing
+// ------------------------------------------------------------------------
+//
+// Each dimension of an iBT network is a ring of Size positions in which every position
+// also links to the positions BypassSchemes[i] away in either direction. A route within
+// a dimension may mix ring and bypass hops (reaching 10 with a bypass of 8 takes one
+// bypass and two ring hops), so distances come from a breadth-first search over the
+// ring's offsets rather than a closed formula. The ring looks the same from every
+// position, so one search per dimension serves every pair of nodes.
+//
+// On a one-port network a node sends over one link per step, so a route crosses the
+// dimensions one after the other and its length is the sum of the per-dimension
+// distances. On an all-port network a node uses a link in every dimension at once, so
+// the dimensions are crossed side by side and the length is their maximum.
+//
+// routing_test.go checks all of this against a plain breadth-first search over the
+// explicit graph of the network.
+
+// ringRoutes holds the shortest routes from position 0 of a ring: the distance to every
+// offset and, for each offset, the signed hop that starts a shortest route to it.
+type ringRoutes struct {
+	size  int
+	hops  []int // e.g. +1, -1, +8, -8
+	dist  []int
+	first []int
+}
+
+// newRingRoutes searches the ring of one dimension.
+func newRingRoutes(d IBTDimension) (ringRoutes, error) {
+	if d.Size < 1 {
+		return ringRoutes{}, fmt.Errorf("%w: dimension size %d", ErrInvalidTopology, d.Size)
+	}
+	r := ringRoutes{size: d.Size, hops: []int{1, -1}}
+	for _, b := range d.BypassSchemes {
+		if b < 1 {
+			return ringRoutes{}, fmt.Errorf("%w: bypass arc %d", ErrInvalidTopology, b)
+		}
+		r.hops = append(r.hops, b, -b)
+	}
+	r.dist = make([]int, d.Size)
+	r.first = make([]int, d.Size)
+	for i := range r.dist {
+		r.dist[i] = -1
+	}
+	r.dist[0] = 0
+	queue := []int{0}
+	for len(queue) > 0 {
+		at := queue[0]
+		queue = queue[1:]
+		for _, h := range r.hops {
+			next := mod(at+h, d.Size)
+			if r.dist[next] >= 0 {
+				continue
+			}
+			r.dist[next] = r.dist[at] + 1
+			r.first[next] = r.first[at]
+			if at == 0 {
+				r.first[next] = h
+			}
+			queue = append(queue, next)
+		}
+	}
+	return r, nil
+}
+
+// route returns the signed hops of a shortest route across offset positions.
+func (r ringRoutes) route(offset int) []int {
+	var hops []int
+	for at := mod(offset, r.size); at != 0; {
+		h := r.first[at]
+		hops = append(hops, h)
+		at = mod(at-h, r.size)
+	}
+	return hops
+}
+
+func mod(a, n int) int {
+	a %= n
+	if a < 0 {
+		a += n
+	}
+	return a
+}
+
+// IBTTopology computes routes through an iBT network.
+type IBTTopology struct {
+	dims     []IBTDimension
+	allPorts bool
+	rings    []ringRoutes
+}
+
+// NewIBTTopology prepares routing for the network described by dims.
+func NewIBTTopology(dims []IBTDimension, allPorts bool) (*IBTTopology, error) {
+	t := &IBTTopology{dims: dims, allPorts: allPorts}
+	for _, d := range dims {
+		r, err := newRingRoutes(d)
+		if err != nil {
+			return nil, err
+		}
+		t.rings = append(t.rings, r)
+	}
+	return t, nil
+}
+
+// Nodes returns how many nodes the network has.
+func (t *IBTTopology) Nodes() int {
+	n := 1
+	for _, d := range t.dims {
+		n *= d.Size
+	}
+	return n
+}
+
+func (t *IBTTopology) check(cs ...IBTCoordinates) error {
+	for _, c := range cs {
+		if len(c) != len(t.dims) {
+			return fmt.Errorf("%w: %v has %d dimensions, want %d", ErrInvalidCoordinates, c, len(c), len(t.dims))
+		}
+		for i, x := range c {
+			if x < 0 || x >= t.dims[i].Size {
+				return fmt.Errorf("%w: %v outside dimension %d of size %d", ErrInvalidCoordinates, c, i, t.dims[i].Size)
+			}
+		}
+	}
+	return nil
+}
+
+// Distance returns the number of steps on a shortest route from a to b.
+func (t *IBTTopology) Distance(a, b IBTCoordinates) (int, error) {
+	if err := t.check(a, b); err != nil {
+		return 0, err
+	}
+	total := 0
+	for i, r := range t.rings {
+		d := r.dist[mod(b[i]-a[i], r.size)]
+		if !t.allPorts {
+			total += d
+		} else if d > total {
+			total = d
+		}
+	}
+	return total, nil
+}
+
+// Path returns the nodes of a shortest route from a to b, both included. One-port routes
+// finish each dimension before starting the next.
+func (t *IBTTopology) Path(a, b IBTCoordinates) ([]IBTCoordinates, error) {
+	if err := t.check(a, b); err != nil {
+		return nil, err
+	}
+	routes := make([][]int, len(t.rings))
+	for i, r := range t.rings {
+		routes[i] = r.route(b[i] - a[i])
+	}
+	at := append(IBTCoordinates(nil), a...)
+	path := []IBTCoordinates{at}
+	step := func(moves map[int]int) {
+		next := append(IBTCoordinates(nil), at...)
+		for i, h := range moves {
+			next[i] = mod(next[i]+h, t.dims[i].Size)
+		}
+		path = append(path, next)
+		at = next
+	}
+	if t.allPorts {
+		for k := 0; ; k++ {
+			moves := make(map[int]int)
+			for i, hops := range routes {
+				if k < len(hops) {
+					moves[i] = hops[k]
+				}
+			}
+			if len(moves) == 0 {
+				break
+			}
+			step(moves)
+		}
+		return path, nil
+	}
+	for i, hops := range routes {
+		for _, h := range hops {
+			step(map[int]int{i: h})
+		}
+	}
+	return path, nil
+}
+
+// NextHop returns the node after a on a shortest route to b, or a itself if a == b.
+func (t *IBTTopology) NextHop(a, b IBTCoordinates) (IBTCoordinates, error) {
+	path, err := t.Path(a, b)
+	if err != nil {
+		return nil, err
+	}
+	if len(path) == 1 {
+		return path[0], nil
+	}
+	return path[1], nil
+}
+
+// Route is one entry of a next-hop table.
+type Route struct {
+	Destination IBTCoordinates `json:"destination"`
+	NextHop     IBTCoordinates `json:"next_hop"`
+	Distance    int            `json:"distance"`
+}
+
+// NextHopTable returns src's route to every other node of the network.
+func (t *IBTTopology) NextHopTable(src IBTCoordinates) ([]Route, error) {
+	if err := t.check(src); err != nil {
+		return nil, err
+	}
+	var table []Route
+	t.forEachNode(func(dst IBTCoordinates) {
+		if equalCoords(src, dst) {
+			return
+		}
+		hop, _ := t.NextHop(src, dst)
+		dist, _ := t.Distance(src, dst)
+		table = append(table, Route{Destination: dst, NextHop: hop, Distance: dist})
+	})
+	return table, nil
+}
+
+// Neighbors returns the nodes c reaches in one step: over one link on a one-port network,
+// or over at most one link per dimension on an all-port network.
+func (t *IBTTopology) Neighbors(c IBTCoordinates) []IBTCoordinates {
+	seen := map[string]bool{fmt.Sprint(c): true}
+	var out []IBTCoordinates
+	add := func(n IBTCoordinates) {
+		if key := fmt.Sprint(n); !seen[key] {
+			seen[key] = true
+			out = append(out, n)
+		}
+	}
+	if !t.allPorts {
+		for i, r := range t.rings {
+			for _, h := range r.hops {
+				n := append(IBTCoordinates(nil), c...)
+				n[i] = mod(n[i]+h, r.size)
+				add(n)
+			}
+		}
+		return out
+	}
+	// Every combination of staying put or taking one link, per dimension.
+	var expand func(i int, n IBTCoordinates)
+	expand = func(i int, n IBTCoordinates) {
+		if i == len(t.rings) {
+			add(append(IBTCoordinates(nil), n...))
+			return
+		}
+		expand(i+1, n)
+		for _, h := range t.rings[i].hops {
+			moved := append(IBTCoordinates(nil), n...)
+			moved[i] = mod(moved[i]+h, t.rings[i].size)
+			expand(i+1, moved)
+		}
+	}
+	expand(0, c)
+	return out
+}
+
+// forEachNode calls fn with the coordinates of every node, in lexicographic order.
+func (t *IBTTopology) forEachNode(fn func(IBTCoordinates)) {
+	c := make(IBTCoordinates, len(t.dims))
+	for n := t.Nodes(); n > 0; n-- {
+		fn(append(IBTCoordinates(nil), c...))
+		for i := len(c) - 1; i >= 0; i-- {
+			if c[i]++; c[i] < t.dims[i].Size {
+				break
+			}
+			c[i] = 0
+		}
+	}
+}
+
+func equalCoords(a, b IBTCoordinates) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,185 @@
+// -------------------- raft/routing_test.go --------------------
+package raft
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// mainDims are the dimensions main.go runs with.
+var mainDims = []IBTDimension{
+	{Size: 32, BypassSchemes: []int{8, 12}},
+	{Size: 16, BypassSchemes: []int{4}},
+}
+
+// bfsDistances returns the distance from src to every node, by breadth-first search over
+// Neighbors.
+func (t *IBTTopology) bfsDistances(src IBTCoordinates) map[string]int {
+	dist := map[string]int{fmt.Sprint(src): 0}
+	queue := []IBTCoordinates{src}
+	for len(queue) > 0 {
+		at := queue[0]
+		queue = queue[1:]
+		for _, n := range t.Neighbors(at) {
+			key := fmt.Sprint(n)
+			if _, ok := dist[key]; !ok {
+				dist[key] = dist[fmt.Sprint(at)] + 1
+				queue = append(queue, n)
+			}
+		}
+	}
+	return dist
+}
+
+// verifyRouting compares Distance, Path and NextHopTable from each of sources (every
+// node if nil) against a breadth-first search of the explicit network graph: every
+// distance must match and every path must be that long and made of single steps.
+func (t *IBTTopology) verifyRouting(sources []IBTCoordinates) error {
+	if sources == nil {
+		t.forEachNode(func(c IBTCoordinates) { sources = append(sources, c) })
+	}
+	for _, src := range sources {
+		want := t.bfsDistances(src)
+		if len(want) != t.Nodes() {
+			return fmt.Errorf("BFS from %v reaches %d of %d nodes", src, len(want), t.Nodes())
+		}
+		var err error
+		t.forEachNode(func(dst IBTCoordinates) {
+			if err == nil {
+				err = t.verifyRoute(src, dst, want[fmt.Sprint(dst)])
+			}
+		})
+		if err != nil {
+			return err
+		}
+		table, err := t.NextHopTable(src)
+		if err != nil {
+			return err
+		}
+		if len(table) != t.Nodes()-1 {
+			return fmt.Errorf("next-hop table of %v has %d routes, want %d", src, len(table), t.Nodes()-1)
+		}
+		for _, r := range table {
+			if r.Distance != want[fmt.Sprint(r.Destination)] {
+				return fmt.Errorf("next-hop table of %v: distance to %v is %d, BFS finds %d",
+					src, r.Destination, r.Distance, want[fmt.Sprint(r.Destination)])
+			}
+			if rest, _ := t.Distance(r.NextHop, r.Destination); rest != r.Distance-1 {
+				return fmt.Errorf("next-hop table of %v: hop %v is %d from %v, want %d",
+					src, r.NextHop, rest, r.Destination, r.Distance-1)
+			}
+		}
+	}
+	return nil
+}
+
+// verifyRoute checks the route from src to dst against the BFS distance want.
+func (t *IBTTopology) verifyRoute(src, dst IBTCoordinates, want int) error {
+	if got, _ := t.Distance(src, dst); got != want {
+		return fmt.Errorf("distance %v -> %v is %d, BFS finds %d", src, dst, got, want)
+	}
+	path, _ := t.Path(src, dst)
+	if len(path)-1 != want || !equalCoords(path[len(path)-1], dst) {
+		return fmt.Errorf("path %v -> %v is %v, BFS finds %d steps", src, dst, path, want)
+	}
+	for i := 1; i < len(path); i++ {
+		linked := false
+		for _, n := range t.Neighbors(path[i-1]) {
+			linked = linked || equalCoords(n, path[i])
+		}
+		if !linked {
+			return fmt.Errorf("path %v -> %v steps from %v to %v without a link", src, dst, path[i-1], path[i])
+		}
+	}
+	if hop, _ := t.NextHop(src, dst); want > 0 && !equalCoords(hop, path[1]) {
+		return fmt.Errorf("next hop %v -> %v is %v, path starts %v", src, dst, hop, path[1])
+	}
+	return nil
+}
+
+func TestRoutingMainDims(t *testing.T) {
+	sources := []IBTCoordinates{{0, 0}, {5, 3}, {17, 8}, {31, 15}, {12, 0}}
+	for _, allPorts := range []bool{false, true} {
+		topo, err := NewIBTTopology(mainDims, allPorts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := topo.verifyRouting(sources); err != nil {
+			t.Errorf("allPorts=%v: %v", allPorts, err)
+		}
+	}
+}
+
+// TestRoutingRandomTopologies checks random networks, including bypass arcs longer than
+// their ring and single-position dimensions, from every node of the small ones and a
+// few nodes of the others.
+func TestRoutingRandomTopologies(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 60; i++ {
+		dims := make([]IBTDimension, 1+rng.Intn(3))
+		for d := range dims {
+			dims[d].Size = 1 + rng.Intn(10)
+			for b := rng.Intn(3); b > 0; b-- {
+				dims[d].BypassSchemes = append(dims[d].BypassSchemes, 1+rng.Intn(dims[d].Size+2))
+			}
+		}
+		for _, allPorts := range []bool{false, true} {
+			topo, err := NewIBTTopology(dims, allPorts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var sources []IBTCoordinates // every node
+			if topo.Nodes() > 32 {
+				for k := 0; k < 3; k++ {
+					src := make(IBTCoordinates, len(dims))
+					for d := range dims {
+						src[d] = rng.Intn(dims[d].Size)
+					}
+					sources = append(sources, src)
+				}
+			}
+			if err := topo.verifyRouting(sources); err != nil {
+				t.Errorf("dims %+v, allPorts=%v: %v", dims, allPorts, err)
+			}
+		}
+	}
+}
+
+func TestRoutingMixedHops(t *testing.T) {
+	topo, err := NewIBTTopology([]IBTDimension{{Size: 32, BypassSchemes: []int{8}}}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d, _ := topo.Distance(IBTCoordinates{0}, IBTCoordinates{10}); d != 3 {
+		t.Fatalf("distance 0 -> 10 is %d, want 3 (one bypass, two ring hops)", d)
+	}
+}
+
+func TestRoutingInvalid(t *testing.T) {
+	if _, err := NewIBTTopology([]IBTDimension{{Size: 0}}, false); err == nil {
+		t.Error("a dimension without positions was accepted")
+	}
+	if _, err := NewIBTTopology([]IBTDimension{{Size: 4, BypassSchemes: []int{0}}}, false); err == nil {
+		t.Error("a bypass arc of 0 was accepted")
+	}
+	topo, _ := NewIBTTopology(mainDims, false)
+	for _, c := range []IBTCoordinates{{1}, {32, 0}, {-1, 0}} {
+		if _, err := topo.Distance(IBTCoordinates{0, 0}, c); err == nil {
+			t.Errorf("coordinates %v were accepted", c)
+		}
+	}
+}
+
+func TestComputeIBTDistanceMatchesTopology(t *testing.T) {
+	for _, allPorts := range []bool{false, true} {
+		topo, _ := NewIBTTopology(mainDims, allPorts)
+		src := IBTCoordinates{3, 7}
+		topo.forEachNode(func(dst IBTCoordinates) {
+			want, _ := topo.Distance(src, dst)
+			if got := ComputeIBTDistance(src, dst, mainDims, allPorts); got != want {
+				t.Errorf("allPorts=%v: ComputeIBTDistance %v -> %v is %d, want %d", allPorts, src, dst, got, want)
+			}
+		})
+	}
+}
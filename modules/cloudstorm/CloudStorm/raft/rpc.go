@@ -0,0 +1,220 @@
+// -------------------- raft/rpc.go --------------------
+package raft
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// ------------------------------------------------------------------------
+// Inbound RPC HTTP Handler
+// ------------------------------------------------------------------------
+
+// Handler returns an http.Handler serving the receiver side of the raft RPCs
+// (POST /requestVote, /appendEntries, /installSnapshot, /timeoutNow and /forwardJob), matching
+// the paths used by the senders.
+func (rn *RaftNode) Handler() http.Handler {
+	return rpcHandler(rn)
+}
+
+// rpcHandler serves the raft RPCs by decoding each request and passing it to h.
+func rpcHandler(h RPCHandler) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/requestVote", func(w http.ResponseWriter, r *http.Request) {
+		var req VoteRequest
+		if decodeRPC(w, r, &req, "vote request") {
+			writeJSON(w, h.HandleVoteRequest(req))
+		}
+	})
+	mux.HandleFunc("/appendEntries", func(w http.ResponseWriter, r *http.Request) {
+		var req AppendEntriesRequest
+		if decodeRPC(w, r, &req, "append entries request") {
+			writeJSON(w, h.HandleAppendEntries(req))
+		}
+	})
+	mux.HandleFunc("/installSnapshot", func(w http.ResponseWriter, r *http.Request) {
+		var req InstallSnapshotRequest
+		if decodeRPC(w, r, &req, "install snapshot request") {
+			writeJSON(w, h.HandleInstallSnapshot(req))
+		}
+	})
+	mux.HandleFunc("/timeoutNow", func(w http.ResponseWriter, r *http.Request) {
+		var req TimeoutNowRequest
+		if decodeRPC(w, r, &req, "timeout now request") {
+			writeJSON(w, h.HandleTimeoutNow(req))
+		}
+	})
+	mux.HandleFunc("/forwardJob", func(w http.ResponseWriter, r *http.Request) {
+		var req JobForwardRequest
+		if decodeRPC(w, r, &req, "forward job request") {
+			writeJSON(w, h.HandleForwardJob(req))
+		}
+	})
+	return mux
+}
+
+// decodeRPC decodes a POSTed RPC into req, answering the request with an error and
+// returning false if it cannot.
+func decodeRPC(w http.ResponseWriter, r *http.Request, req interface{}, what string) bool {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		http.Error(w, "invalid "+what, http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, "failed to encode response", http.StatusInternalServerError)
+	}
+}
+
+// ------------------------------------------------------------------------
+// RPC Receivers
+// ------------------------------------------------------------------------
+
+// HandleVoteRequest implements the receiver side of RequestVote: it rejects stale terms,
+// grants at most one vote per term, and only to candidates whose log is at least as
+// up-to-date as ours. Pre-votes are answered the same way but leave no trace.
+func (rn *RaftNode) HandleVoteRequest(req VoteRequest) VoteResponse {
+	rn.mutex.Lock()
+	defer rn.mutex.Unlock()
+
+	if err := rn.checkProof(proofVote, req.CandidateID, req.Term, req.ServiceID, req.ProofKeyHash, req.CombinedProof); err != nil {
+		rn.rejectRPC(proofVote, req.CandidateID, err)
+		return VoteResponse{Term: rn.currentTerm}
+	}
+
+	// While a leader is active, a candidate can only be a node that lost contact with it
+	// (e.g. was partitioned away); ignore it rather than adopt its term and depose the leader.
+	// The exception is an election the leader itself asked for by TimeoutNow.
+	if req.Term > rn.currentTerm && !req.LeadershipTransfer && rn.leaderActive() {
+		return VoteResponse{Term: rn.currentTerm}
+	}
+	if req.PreVote {
+		// Grant if a real vote in req.Term could be granted, without changing any state.
+		granted := req.Term > rn.currentTerm && rn.isLogUpToDate(req.LastLogIndex, req.LastLogTerm)
+		return VoteResponse{Term: rn.currentTerm, VoteGranted: granted}
+	}
+	if req.Term > rn.currentTerm {
+		rn.becomeFollower(req.Term)
+		rn.resetElectionTimer()
+	}
+	resp := VoteResponse{Term: rn.currentTerm}
+	if req.Term < rn.currentTerm {
+		return resp
+	}
+	if rn.votedFor != "" && rn.votedFor != req.CandidateID {
+		return resp
+	}
+	if !rn.isLogUpToDate(req.LastLogIndex, req.LastLogTerm) {
+		return resp
+	}
+	rn.votedFor = req.CandidateID
+	if err := rn.saveHardState(); err != nil {
+		log.Printf("Failed to persist vote for %s: %v", req.CandidateID, err)
+		rn.votedFor = ""
+		return resp
+	}
+	resp.VoteGranted = true
+	rn.resetElectionTimer()
+	return resp
+}
+
+// HandleAppendEntries implements the receiver side of AppendEntries: term check, log
+// consistency check on PrevLogIndex/PrevLogTerm, truncation of conflicting entries and
+// commitIndex advance from LeaderCommit. A valid call also resets the election timer.
+func (rn *RaftNode) HandleAppendEntries(req AppendEntriesRequest) AppendEntriesResponse {
+	rn.mutex.Lock()
+	defer rn.mutex.Unlock()
+
+	if err := rn.checkProof(proofAppend, req.LeaderID, req.Term, req.ServiceID, req.ProofKeyHash, req.CombinedProof); err != nil {
+		rn.rejectRPC(proofAppend, req.LeaderID, err)
+		return AppendEntriesResponse{Term: rn.currentTerm, Rejected: true}
+	}
+
+	if req.Term < rn.currentTerm {
+		return AppendEntriesResponse{Term: rn.currentTerm, Success: false}
+	}
+	// A current leader exists for this term; candidates and stale leaders step down.
+	rn.becomeFollower(req.Term)
+	rn.setLeader(req.LeaderID, req.LeaderAddr)
+	rn.lastContact = rn.clock()
+	rn.resetElectionTimer()
+
+	resp := AppendEntriesResponse{Term: rn.currentTerm}
+	if req.PrevLogIndex < rn.snapshotIndex() {
+		// Everything up to our snapshot is committed; skip the entries it already covers.
+		covered := rn.snapshotIndex() - req.PrevLogIndex
+		if covered >= len(req.Entries) {
+			resp.Success = true
+			return resp
+		}
+		req.Entries = req.Entries[covered:]
+		req.PrevLogIndex = rn.snapshotIndex()
+		req.PrevLogTerm = rn.log[0].Term
+	}
+	if term, ok := rn.termAt(req.PrevLogIndex); !ok || term != req.PrevLogTerm {
+		// Tell the leader where our log diverges so it can skip back a term at a time.
+		if !ok {
+			resp.ConflictIndex = rn.lastLogIndex() + 1
+			return resp
+		}
+		resp.ConflictTerm = term
+		resp.ConflictIndex = req.PrevLogIndex
+		for resp.ConflictIndex-1 > rn.snapshotIndex() && rn.entryAt(resp.ConflictIndex-1).Term == term {
+			resp.ConflictIndex--
+		}
+		return resp
+	}
+
+	for i, entry := range req.Entries {
+		idx := req.PrevLogIndex + 1 + i
+		if term, ok := rn.termAt(idx); ok && term == entry.Term {
+			continue // already have it
+		}
+		// New or conflicting entry: replace everything from idx onwards, on disk first.
+		if err := rn.checkEntryChain(rn.entryAt(idx-1).Hash, req.Entries[i:]); err != nil {
+			rn.rejectRPC(proofAppend, req.LeaderID, err)
+			resp.Rejected = true
+			return resp
+		}
+		if err := rn.saveLogEntries(idx, req.Entries[i:]); err != nil {
+			log.Printf("Failed to persist entries from index %d: %v", idx, err)
+			return resp
+		}
+		truncated := idx <= rn.lastLogIndex()
+		rn.log = append(rn.log[:idx-rn.snapshotIndex()], req.Entries[i:]...)
+		if truncated || hasConfigEntry(req.Entries[i:]) {
+			rn.reloadConfig()
+		}
+		break
+	}
+
+	newCommit := req.LeaderCommit
+	if lastNew := req.PrevLogIndex + len(req.Entries); lastNew < newCommit {
+		newCommit = lastNew
+	}
+	if newCommit > rn.commitIndex {
+		rn.commitIndex = newCommit
+		rn.applyLogEntries()
+	}
+	resp.Success = true
+	return resp
+}
+
+// isLogUpToDate reports whether a candidate's log (lastIndex, lastTerm) is at least as
+// up-to-date as ours, per the Raft election restriction. Caller holds rn.mutex.
+func (rn *RaftNode) isLogUpToDate(lastIndex, lastTerm int) bool {
+	ourTerm := rn.lastLogTerm()
+	if lastTerm != ourTerm {
+		return lastTerm > ourTerm
+	}
+	return lastIndex >= rn.lastLogIndex()
+}
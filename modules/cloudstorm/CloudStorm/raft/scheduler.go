@@ -0,0 +1,153 @@
+// -------------------- raft/scheduler.go --------------------
+package raft
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// ErrNoEligibleNode is returned when no node with a fresh capacity report meets a job's
+// requirements and anti-affinity.
+var ErrNoEligibleNode = errors.New("no eligible node for job")
+
+// ------------------------------------------------------------------------
+// Job Placement
+// ------------------------------------------------------------------------
+//
+// The scheduler places a job on one of the nodes that reported their capacity recently
+// (see capacity.go). Nodes without the cores, memory or disk the job requires are
+// dropped, as are nodes already holding a job with the same anti-affinity key; the
+// ScoringPolicy then rates the rest and the highest score wins, ties going to the lowest
+// node ID.
+//
+// A node's job count is taken from the log, counting the jobs queued for it as well as
+// those it holds, so jobs placed in quick succession spread out before the next round of
+// reports; a higher count in the node's own report (e.g. from other groups) wins.
+
+// JobRequirements are the resources a job needs free on its node.
+type JobRequirements struct {
+	CPUCores int    `json:"cpu_cores,omitempty"`
+	Memory   uint64 `json:"memory,omitempty"` // bytes
+	Disk     uint64 `json:"disk,omitempty"`   // bytes
+}
+
+// PlacementCandidate is a node a job may be placed on, as seen by the scoring policy.
+type PlacementCandidate struct {
+	NodeID   string
+	Capacity NodeCapacity
+	Distance int // iBT hops from the scheduling node; 0 if either has no coordinates
+	Jobs     int
+}
+
+// Utilization is the candidate's busier resource as a fraction: worker slots in use, or
+// CPU load per core.
+func (c PlacementCandidate) Utilization() float64 {
+	u := 0.0
+	if c.Capacity.MaxJobs > 0 {
+		u = float64(c.Jobs) / float64(c.Capacity.MaxJobs)
+	}
+	if c.Capacity.CPUCores > 0 {
+		if load := c.Capacity.CPULoad / float64(c.Capacity.CPUCores); load > u {
+			u = load
+		}
+	}
+	return u
+}
+
+// ScoringPolicy rates an eligible candidate for a job; higher is better.
+type ScoringPolicy func(job Job, c PlacementCandidate) float64
+
+// WeightedPolicy scores candidates by a weighted sum of their iBT distance in hops and
+// their utilization, both counting against them.
+func WeightedPolicy(distanceWeight, loadWeight float64) ScoringPolicy {
+	return func(job Job, c PlacementCandidate) float64 {
+		return -(distanceWeight*float64(c.Distance) + loadWeight*c.Utilization())
+	}
+}
+
+var (
+	// BalancedPolicy, the default, weighs a fully utilized node like four extra hops.
+	BalancedPolicy = WeightedPolicy(1, 4)
+	// NearestPolicy places jobs by iBT distance alone.
+	NearestPolicy = WeightedPolicy(1, 0)
+	// LeastLoadedPolicy places jobs by utilization alone.
+	LeastLoadedPolicy = WeightedPolicy(0, 1)
+)
+
+// SetSchedulingPolicy replaces the policy jobs are placed by.
+func (rn *RaftNode) SetSchedulingPolicy(policy ScoringPolicy) {
+	rn.mutex.Lock()
+	defer rn.mutex.Unlock()
+	rn.policy = policy
+}
+
+// PickNodeForJob returns the node the scheduling policy places job on.
+func (rn *RaftNode) PickNodeForJob(job Job) (string, error) {
+	rn.mutex.Lock()
+	defer rn.mutex.Unlock()
+	candidates := rn.candidates(job)
+	if len(candidates) == 0 {
+		return "", fmt.Errorf("job %s: %w", job.ID, ErrNoEligibleNode)
+	}
+	best, bestScore := "", 0.0
+	for _, c := range candidates { // sorted by node ID
+		if score := rn.policy(job, c); best == "" || score > bestScore {
+			best, bestScore = c.NodeID, score
+		}
+	}
+	return best, nil
+}
+
+// candidates returns the eligible nodes for job, sorted by node ID. Caller holds rn.mutex.
+func (rn *RaftNode) candidates(job Job) []PlacementCandidate {
+	jobs := make(map[string]int)
+	conflicts := make(map[string]bool)
+	for _, j := range rn.jobQueue {
+		node := j.AssignedTo
+		if jobActive(j) {
+			node = j.Worker
+		} else if j.Status != JobQueued {
+			continue
+		}
+		jobs[node]++
+		if job.AntiAffinity != "" && j.AntiAffinity == job.AntiAffinity && j.ID != job.ID {
+			conflicts[node] = true
+		}
+	}
+
+	self, hasSelf := rn.nodeCoords[rn.id]
+	now := rn.clock().UnixNano()
+	var out []PlacementCandidate
+	for id, capacity := range rn.capacities {
+		if now-capacity.At > int64(capacityStaleAfter) || conflicts[id] || !capacity.fits(job.Requires) {
+			continue
+		}
+		c := PlacementCandidate{NodeID: id, Capacity: capacity, Jobs: max(jobs[id], capacity.Jobs)}
+		if coord, ok := rn.nodeCoords[id]; ok && hasSelf {
+			c.Distance, _ = rn.topology.Distance(self, coord) // 0 for coordinates outside the network
+		}
+		out = append(out, c)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].NodeID < out[j].NodeID })
+	return out
+}
+
+// fits reports whether the reported capacity meets req.
+func (c NodeCapacity) fits(req *JobRequirements) bool {
+	if req == nil {
+		return true
+	}
+	return c.CPUCores >= req.CPUCores && c.MemoryFree >= req.Memory && c.DiskFree >= req.Disk
+}
+
+// Schedule places job with PickNodeForJob and posts it, assigned to the chosen node.
+func (rn *RaftNode) Schedule(job Job) error {
+	node, err := rn.PickNodeForJob(job)
+	if err != nil {
+		return err
+	}
+	job.AssignedTo = node // the chosen node's Worker picks the job up
+	job.Status = JobQueued
+	return rn.PostJob(job)
+}
@@ -0,0 +1,155 @@
+// -------------------- raft/scheduler_test.go --------------------
+package raft
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newSchedulingNode returns an unstarted node "self" at iBT coordinates {0, 0} of a 16x16
+// network, whose clock stands still at now, with a fresh report from each of nodes.
+func newSchedulingNode(t *testing.T, now time.Time, nodes ...NodeCapacity) *RaftNode {
+	t.Helper()
+	dims := []IBTDimension{{Size: 16}, {Size: 16}}
+	rn, err := NewRaftNode("self", nil, filepath.Join(t.TempDir(), "self.db"), nil, dims, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(rn.Stop)
+	rn.clock = func() time.Time { return now }
+	rn.nodeCoords["self"] = IBTCoordinates{0, 0}
+	for _, c := range nodes {
+		if c.At == 0 {
+			c.At = now.UnixNano()
+		}
+		rn.capacities[c.NodeID] = c
+	}
+	return rn
+}
+
+func TestSchedulerPolicies(t *testing.T) {
+	now := time.Unix(1000, 0)
+	rn := newSchedulingNode(t, now,
+		NodeCapacity{NodeID: "near-busy", CPUCores: 4, MaxJobs: 4, Jobs: 4},
+		NodeCapacity{NodeID: "far-idle", CPUCores: 4, MaxJobs: 4},
+		NodeCapacity{NodeID: "mid-half", CPUCores: 4, MaxJobs: 4, Jobs: 2},
+	)
+	rn.nodeCoords["near-busy"] = IBTCoordinates{1, 0} // 1 hop
+	rn.nodeCoords["far-idle"] = IBTCoordinates{8, 8}  // 16 hops
+	rn.nodeCoords["mid-half"] = IBTCoordinates{1, 1}  // 2 hops
+
+	tests := []struct {
+		name   string
+		policy ScoringPolicy
+		want   string
+	}{
+		{"nearest", NearestPolicy, "near-busy"},
+		{"least loaded", LeastLoadedPolicy, "far-idle"},
+		{"balanced", BalancedPolicy, "mid-half"}, // 2+2 beats 1+4 and 16+0
+		{"custom", func(job Job, c PlacementCandidate) float64 {
+			if c.NodeID == "far-idle" {
+				return 1
+			}
+			return 0
+		}, "far-idle"},
+	}
+	for _, tt := range tests {
+		rn.SetSchedulingPolicy(tt.policy)
+		if got, err := rn.PickNodeForJob(Job{ID: "j"}); err != nil || got != tt.want {
+			t.Errorf("%s: got %q, %v; want %q", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestSchedulerTiesGoToLowestID(t *testing.T) {
+	rn := newSchedulingNode(t, time.Unix(1000, 0),
+		NodeCapacity{NodeID: "c", MaxJobs: 1}, NodeCapacity{NodeID: "a", MaxJobs: 1}, NodeCapacity{NodeID: "b", MaxJobs: 1})
+	for i := 0; i < 5; i++ {
+		if got, _ := rn.PickNodeForJob(Job{ID: "j"}); got != "a" {
+			t.Fatalf("got %q, want a", got)
+		}
+	}
+}
+
+func TestSchedulerRequirements(t *testing.T) {
+	const gib = 1 << 30
+	rn := newSchedulingNode(t, time.Unix(1000, 0),
+		NodeCapacity{NodeID: "small", CPUCores: 2, MemoryFree: 2 * gib, DiskFree: 10 * gib},
+		NodeCapacity{NodeID: "big", CPUCores: 16, MemoryFree: 64 * gib, DiskFree: 100 * gib, Jobs: 3, MaxJobs: 4},
+	)
+	tests := []struct {
+		req  *JobRequirements
+		want string
+		err  error
+	}{
+		{nil, "small", nil}, // idle beats busy
+		{&JobRequirements{CPUCores: 4}, "big", nil},
+		{&JobRequirements{Memory: 8 * gib}, "big", nil},
+		{&JobRequirements{Disk: 50 * gib}, "big", nil},
+		{&JobRequirements{CPUCores: 32}, "", ErrNoEligibleNode},
+	}
+	for _, tt := range tests {
+		got, err := rn.PickNodeForJob(Job{ID: "j", Requires: tt.req})
+		if got != tt.want || !errors.Is(err, tt.err) {
+			t.Errorf("requirements %+v: got %q, %v; want %q, %v", tt.req, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestSchedulerAntiAffinity(t *testing.T) {
+	rn := newSchedulingNode(t, time.Unix(1000, 0),
+		NodeCapacity{NodeID: "a", MaxJobs: 10}, NodeCapacity{NodeID: "b", MaxJobs: 10})
+	rn.jobQueue["db-1"] = Job{ID: "db-1", Status: JobRunning, Worker: "a", AntiAffinity: "db"}
+	rn.jobQueue["web-1"] = Job{ID: "web-1", Status: JobQueued, AssignedTo: "b", AntiAffinity: "web"}
+
+	if got, _ := rn.PickNodeForJob(Job{ID: "db-2", AntiAffinity: "db"}); got != "b" {
+		t.Errorf("db-2 placed on %q, want b (a runs db-1)", got)
+	}
+	if got, _ := rn.PickNodeForJob(Job{ID: "web-2", AntiAffinity: "web"}); got != "a" {
+		t.Errorf("web-2 placed on %q, want a (web-1 is queued for b)", got)
+	}
+	rn.jobQueue["db-3"] = Job{ID: "db-3", Status: JobAccepted, Worker: "b", AntiAffinity: "db"}
+	if _, err := rn.PickNodeForJob(Job{ID: "db-4", AntiAffinity: "db"}); !errors.Is(err, ErrNoEligibleNode) {
+		t.Errorf("got %v, want ErrNoEligibleNode with db jobs on both nodes", err)
+	}
+	// A finished job no longer repels.
+	rn.jobQueue["db-1"] = Job{ID: "db-1", Status: JobCompleted, Worker: "a", AntiAffinity: "db"}
+	if got, _ := rn.PickNodeForJob(Job{ID: "db-4", AntiAffinity: "db"}); got != "a" {
+		t.Errorf("db-4 placed on %q, want a", got)
+	}
+}
+
+func TestSchedulerSkipsStaleReports(t *testing.T) {
+	now := time.Unix(1000, 0)
+	rn := newSchedulingNode(t, now,
+		NodeCapacity{NodeID: "fresh", MaxJobs: 4, Jobs: 3},
+		NodeCapacity{NodeID: "stale", MaxJobs: 4, At: now.Add(-capacityStaleAfter - time.Second).UnixNano()},
+	)
+	if got, _ := rn.PickNodeForJob(Job{ID: "j"}); got != "fresh" {
+		t.Fatalf("got %q, want fresh", got)
+	}
+}
+
+// TestCapacityStampedByLeader checks that reports carry the leader's time, whatever the
+// reporting node's clock says.
+func TestCapacityStampedByLeader(t *testing.T) {
+	c := newTestCluster(t, []string{"n1", "n2", "n3"}, nil, nil)
+	leader := c.leader()
+	f := c.follower(leader)
+	for _, skew := range []time.Duration{time.Hour, -time.Hour} {
+		before := time.Now().UnixNano()
+		report := NodeCapacity{NodeID: f.id, MaxJobs: 1, At: time.Now().Add(skew).UnixNano()}
+		if err := f.submit(CmdNodeCapacity, report); err != nil {
+			t.Fatal(err)
+		}
+		after := time.Now().UnixNano()
+		if at := leader.NodeCapacities()[f.id].At; at < before || at > after {
+			t.Fatalf("skew %v: report stamped %d, outside the leader's [%d, %d]", skew, at, before, after)
+		}
+		if got, err := leader.PickNodeForJob(Job{ID: "j"}); err != nil || got != f.id {
+			t.Fatalf("skew %v: got %q, %v; want %s", skew, got, err, f.id)
+		}
+	}
+}
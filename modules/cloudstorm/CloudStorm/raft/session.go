@@ -0,0 +1,326 @@
+// -------------------- raft/session.go --------------------
+package raft
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// maxClientSessions bounds the session table; the least recently used session is
+// evicted beyond it. Eviction runs at apply time, so every node evicts the same one.
+const maxClientSessions = 4096
+
+var (
+	// ErrSessionExpired is returned for commands from a client ID that was never
+	// registered or whose session has been evicted. The client must register again.
+	ErrSessionExpired = errors.New("client session expired or unknown")
+	// ErrStaleSequence is returned for a sequence number older than the client's latest
+	// applied command, whose response is no longer retained.
+	ErrStaleSequence = errors.New("sequence number already applied")
+)
+
+// ------------------------------------------------------------------------
+// Client Sessions (exactly-once apply)
+// ------------------------------------------------------------------------
+//
+// A client that retries a command, for instance after a timeout or a leader change, can
+// cause it to be appended more than once. Following the Raft dissertation, clients first
+// register a session, then tag every command with their client ID and an increasing
+// sequence number, reusing the number when they retry. The session table is part of
+// the replicated state: each node applies a (client, sequence) pair at most once and
+// answers a duplicate with the response recorded the first time.
+
+// clientSession is the replicated record of a client's latest applied command.
+type clientSession struct {
+	LastSeq   uint64          `json:"last_seq"`
+	LastIndex int             `json:"last_index"` // log index of the latest command, for eviction
+	Type      string          `json:"type,omitempty"`
+	Response  json.RawMessage `json:"response,omitempty"`
+	Error     string          `json:"error,omitempty"`
+
+	// value is what the FSM returned the first time. Snapshots keep only its encoding
+	// (Response), so a restored session has none.
+	value interface{}
+}
+
+// result returns the recorded outcome: the value the FSM returned the first time, or for
+// a session restored from a snapshot that value decoded from the response.
+func (s clientSession) result() (interface{}, error) {
+	resp := s.value
+	if resp == nil {
+		resp = decodeResult(s.Type, s.Response)
+	}
+	if s.Error != "" {
+		return resp, errors.New(s.Error)
+	}
+	return resp, nil
+}
+
+// decodeResult decodes the response to a command of cmdType into the type the default
+// FSM returns for it. Responses to other commands are returned as JSON.
+func decodeResult(cmdType string, data json.RawMessage) interface{} {
+	if len(data) == 0 || string(data) == "null" {
+		return nil
+	}
+	switch cmdType {
+	case CmdCreateNetwork:
+		var netw Network
+		if json.Unmarshal(data, &netw) == nil {
+			return netw
+		}
+	case CmdPostJob, CmdAcceptJob, CmdStartJob, CmdHeartbeatJob, CmdCompleteJob, CmdFailJob, CmdExpireJobLease:
+		var job Job
+		if json.Unmarshal(data, &job) == nil {
+			return job
+		}
+	case CmdNodeCapacity:
+		var c NodeCapacity
+		if json.Unmarshal(data, &c) == nil {
+			return c
+		}
+	case CmdJoinIBT, CmdLeaveIBT:
+		var p IBTPlacement
+		if json.Unmarshal(data, &p) == nil {
+			return p
+		}
+	case CmdUpdateContainer:
+		var cons ContainerConsensus
+		if json.Unmarshal(data, &cons) == nil {
+			return cons
+		}
+	}
+	return data
+}
+
+// RegisterClient creates a client session through the log and returns its client ID
+// (the index of the registration entry, so it is unique cluster-wide).
+func (rn *RaftNode) RegisterClient(timeout time.Duration) (string, error) {
+	rn.mutex.Lock()
+	f := rn.propose(EntryRegisterClient, nil, timeout)
+	rn.mutex.Unlock()
+	if _, err := f.Wait(); err != nil {
+		return "", err
+	}
+	return strconv.Itoa(f.Index()), nil
+}
+
+// ProposeAs is Propose on behalf of a registered client. seq starts at 1, must increase
+// from one command to the next, and must be reused when retrying a command whose outcome
+// is unknown; the command is then applied only once. A client has at most one command
+// outstanding at a time.
+func (rn *RaftNode) ProposeAs(clientID string, seq uint64, cmdType string, command interface{}, timeout time.Duration) *ApplyFuture {
+	rn.mutex.Lock()
+	defer rn.mutex.Unlock()
+	return rn.proposeAs(clientID, seq, cmdType, command, timeout)
+}
+
+// proposeAs is ProposeAs for callers already holding rn.mutex.
+func (rn *RaftNode) proposeAs(clientID string, seq uint64, cmdType string, command interface{}, timeout time.Duration) *ApplyFuture {
+	s, ok := rn.sessions[clientID]
+	if !ok {
+		return failedFuture(ErrSessionExpired)
+	}
+	// Answer retries of an already applied command without appending it again.
+	if seq <= s.LastSeq {
+		if seq < s.LastSeq {
+			return failedFuture(ErrStaleSequence)
+		}
+		f := newApplyFuture(0)
+		f.respond(s.result())
+		return f
+	}
+	return rn.proposeEntry(cmdType, command, clientID, seq, timeout)
+}
+
+// ------------------------------------------------------------------------
+// The Node's Own Commands
+// ------------------------------------------------------------------------
+//
+// The node proposes its own commands (jobs and networks created through it, its worker's
+// transitions and reports) as a client too. It keeps a pool of sessions registered for
+// itself, one per command in flight, and retries a command whose outcome a timeout or a
+// leader change left open under the same sequence number, at the new leader if need be,
+// until the proposal timeout runs out.
+
+// clientRetryWait is the pause before retrying a command whose outcome is unknown.
+const clientRetryWait = 20 * time.Millisecond
+
+// localSession is a session the node registered for its own commands.
+type localSession struct {
+	id  string
+	seq uint64 // latest sequence number used
+}
+
+// clientRegistration is the command of an EntryRegisterClient entry proposed for a node,
+// so that a follower's registration can be forwarded like its other commands.
+type clientRegistration struct {
+	NodeID string `json:"node_id"`
+}
+
+// proposeAsClient proposes a command through one of the node's sessions and waits until
+// it is applied. With forward set a follower forwards the command to the leader, which
+// only accepts commands a node issues for itself (see forwardedFor); otherwise only the
+// leader may propose it.
+func (rn *RaftNode) proposeAsClient(cmdType string, command interface{}, forward bool) error {
+	data, err := json.Marshal(command)
+	if err != nil {
+		return err
+	}
+	s, err := rn.acquireSession(forward)
+	if err != nil {
+		return err
+	}
+	rn.mutex.Lock()
+	timeout := rn.proposalTimeout
+	rn.mutex.Unlock()
+	deadline := time.Now().Add(timeout)
+
+	s.seq++
+	var open error // latest error that left the outcome open
+	for {
+		_, unknown, err := rn.submitAs(s.id, s.seq, cmdType, data, forward)
+		switch {
+		case errors.Is(err, ErrSessionExpired):
+			if open != nil {
+				return open
+			}
+			// Evicted before anything was appended: start over with a fresh session.
+			if s, err = rn.acquireSession(forward); err != nil {
+				return err
+			}
+			s.seq++
+			continue
+		case unknown:
+			open = err
+		case !refused(err) || open == nil:
+			rn.releaseSession(s)
+			return err
+		case !forward:
+			// Only the leader could settle the open attempt, and this node no longer
+			// is. The session is dropped, as that attempt may still be applied.
+			return open
+		}
+		if timeout > 0 && time.Now().After(deadline) {
+			return open
+		}
+		time.Sleep(clientRetryWait)
+	}
+}
+
+// refused reports whether err means a command was turned away without being appended.
+func refused(err error) bool {
+	return errors.Is(err, ErrNotLeader) || errors.Is(err, ErrLeadershipTransferInProgress)
+}
+
+// outcomeUnknown reports whether a command that failed with err may still be applied.
+func outcomeUnknown(err error) bool {
+	return errors.Is(err, ErrLeadershipLost) || errors.Is(err, ErrProposalTimeout)
+}
+
+// submitAs makes one attempt at a command for clientID (untagged if empty) and waits for
+// it to be applied, forwarding it to the leader if forward is set and this node is not
+// the leader. It returns the index the command was applied at, if any, and whether it
+// may be applied although err is set.
+func (rn *RaftNode) submitAs(clientID string, seq uint64, cmdType string, data json.RawMessage, forward bool) (int, bool, error) {
+	rn.mutex.Lock()
+	if rn.state == Leader || !forward {
+		f := rn.proposeClientCommand(clientID, seq, cmdType, data)
+		rn.mutex.Unlock()
+		_, err := f.Wait()
+		return f.Index(), outcomeUnknown(err), err
+	}
+	leader := rn.leaderAddr
+	req := JobForwardRequest{
+		Term: rn.currentTerm, NodeID: rn.id, Type: cmdType, Command: data,
+		ClientID: clientID, Sequence: seq,
+	}
+	req.ServiceID, req.ProofKeyHash, req.CombinedProof = rn.signProof(proofForwardJob, req.Term)
+	rn.mutex.Unlock()
+
+	if leader == "" {
+		return 0, false, ErrNotLeader
+	}
+	resp, err := rn.transport.ForwardJob(leader, req)
+	if err != nil {
+		return 0, true, err // the request may have arrived
+	}
+	err = resp.err()
+	return resp.Index, outcomeUnknown(err), err
+}
+
+// acquireSession takes an idle session from the node's pool, registering a new one if
+// there is none.
+func (rn *RaftNode) acquireSession(forward bool) (*localSession, error) {
+	rn.mutex.Lock()
+	if n := len(rn.idleSessions); n > 0 {
+		s := rn.idleSessions[n-1]
+		rn.idleSessions = rn.idleSessions[:n-1]
+		rn.mutex.Unlock()
+		return s, nil
+	}
+	rn.mutex.Unlock()
+	data, _ := json.Marshal(clientRegistration{NodeID: rn.id})
+	index, _, err := rn.submitAs("", 0, EntryRegisterClient, data, forward)
+	if err != nil {
+		return nil, fmt.Errorf("failed to register client session: %w", err)
+	}
+	return &localSession{id: strconv.Itoa(index)}, nil
+}
+
+// releaseSession returns a session to the pool once its command is settled.
+func (rn *RaftNode) releaseSession(s *localSession) {
+	rn.mutex.Lock()
+	defer rn.mutex.Unlock()
+	rn.idleSessions = append(rn.idleSessions, s)
+}
+
+// applySessionEntry applies a client-tagged entry unless its sequence number was already
+// applied for that client. Caller holds rn.mutex.
+func (rn *RaftNode) applySessionEntry(entry LogEntry) (interface{}, error) {
+	s, ok := rn.sessions[entry.ClientID]
+	switch {
+	case !ok:
+		return nil, ErrSessionExpired
+	case entry.Sequence == s.LastSeq:
+		return s.result()
+	case entry.Sequence < s.LastSeq:
+		return nil, ErrStaleSequence
+	}
+	resp, err := rn.fsm.Apply(entry)
+	s = clientSession{LastSeq: entry.Sequence, LastIndex: entry.Index, Type: entry.Type, value: resp}
+	if data, mErr := json.Marshal(resp); mErr == nil {
+		s.Response = data
+	}
+	if err != nil {
+		s.Error = err.Error()
+	}
+	rn.sessions[entry.ClientID] = s
+	return resp, err
+}
+
+// registerClient applies an EntryRegisterClient entry. Caller holds rn.mutex.
+func (rn *RaftNode) registerClient(entry LogEntry) {
+	rn.sessions[strconv.Itoa(entry.Index)] = clientSession{LastIndex: entry.Index}
+	if len(rn.sessions) <= maxClientSessions {
+		return
+	}
+	oldest, oldestIndex := "", entry.Index
+	for id, s := range rn.sessions {
+		if s.LastIndex < oldestIndex {
+			oldest, oldestIndex = id, s.LastIndex
+		}
+	}
+	delete(rn.sessions, oldest)
+}
+
+// copySessions returns a copy of a session table.
+func copySessions(sessions map[string]clientSession) map[string]clientSession {
+	out := make(map[string]clientSession, len(sessions))
+	for id, s := range sessions {
+		out[id] = s
+	}
+	return out
+}
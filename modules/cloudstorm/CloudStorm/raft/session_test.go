@@ -0,0 +1,144 @@
+// -------------------- raft/session_test.go --------------------
+package raft
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestSessionAppliesOnce appends the same tagged command twice and checks that the copy
+// is answered with the first outcome instead of being applied again.
+func TestSessionAppliesOnce(t *testing.T) {
+	c := newTestCluster(t, []string{"n1", "n2", "n3"}, nil, nil)
+	leader := c.leader()
+	client, err := leader.RegisterClient(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Both copies are appended before either is applied, as after a retry that raced
+	// the original.
+	leader.mutex.Lock()
+	first := leader.proposeEntry(CmdPostJob, Job{ID: "j", Status: JobQueued}, client, 1, time.Second)
+	second := leader.proposeEntry(CmdPostJob, Job{ID: "j", Status: JobQueued}, client, 1, time.Second)
+	leader.mutex.Unlock()
+	want, err := first.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := second.Wait()
+	if err != nil {
+		t.Fatalf("duplicate: got %v, want the first outcome", err)
+	}
+	if second.Index() == first.Index() {
+		t.Fatal("the duplicate was not appended")
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("duplicate answered with %#v, want %#v", got, want)
+	}
+	// A retry answered before it is appended, by a session restored from a snapshot too.
+	retried, err := leader.ProposeAs(client, 1, CmdPostJob, Job{ID: "j"}, time.Second).Wait()
+	if err != nil || !reflect.DeepEqual(retried, want) {
+		t.Fatalf("retry answered with %#v, %v; want %#v", retried, err, want)
+	}
+	leader.mutex.Lock()
+	data, err := json.Marshal(leader.sessions[client])
+	var restored clientSession
+	if err == nil {
+		err = json.Unmarshal(data, &restored)
+	}
+	leader.mutex.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := restored.result(); err != nil || !reflect.DeepEqual(got, want) {
+		t.Fatalf("restored session answers with %#v, %v; want %#v", got, err, want)
+	}
+
+	if _, err := leader.ProposeAs(client, 2, CmdPostJob, Job{ID: "j", Status: JobQueued}, time.Second).Wait(); !errors.Is(err, ErrJobExists) {
+		t.Fatalf("new sequence number: got %v, want ErrJobExists", err)
+	}
+	if _, err := leader.ProposeAs(client, 1, CmdPostJob, Job{ID: "j"}, time.Second).Wait(); !errors.Is(err, ErrStaleSequence) {
+		t.Fatalf("old sequence number: got %v, want ErrStaleSequence", err)
+	}
+	if _, err := leader.ProposeAs("no-such-client", 1, CmdPostJob, Job{ID: "k"}, time.Second).Wait(); !errors.Is(err, ErrSessionExpired) {
+		t.Fatalf("unregistered client: got %v, want ErrSessionExpired", err)
+	}
+}
+
+// loseReply is a Transport that loses the reply to the first forwarded command of type
+// cmdType, after running then.
+type loseReply struct {
+	Transport
+	cmdType string
+	then    func()
+}
+
+func (t *loseReply) ForwardJob(peer string, req JobForwardRequest) (JobForwardResponse, error) {
+	resp, err := t.Transport.ForwardJob(peer, req)
+	if req.Type == t.cmdType && t.then != nil {
+		t.then()
+		t.then = nil
+		return JobForwardResponse{}, ErrUnreachable
+	}
+	return resp, err
+}
+
+// TestSessionDuplicateAcrossLeaderChange forwards an accept from a follower, loses the
+// leader's reply and cuts the leader off. The follower retries at the next leader, where
+// the accept must not be applied a second time.
+func TestSessionDuplicateAcrossLeaderChange(t *testing.T) {
+	ids := []string{"n1", "n2", "n3", "n4", "n5"}
+	c := newTestCluster(t, ids, nil, nil)
+	old := c.leader()
+	f := c.follower(old)
+	if err := old.PostJob(Job{ID: "j", Type: "Test"}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, 5*time.Second, "the job on the follower", func() bool { return c.hasJob("j", f.id) })
+
+	var rest []string
+	for _, id := range ids {
+		if id != old.id {
+			rest = append(rest, id)
+		}
+	}
+	f.SetTransport(&loseReply{Transport: c.net.Transport(f.id), cmdType: CmdAcceptJob, then: func() {
+		c.net.Partition([]string{old.id}, rest)
+	}})
+	if err := f.AcceptJob("j"); err != nil {
+		t.Fatalf("retried accept: %v", err)
+	}
+
+	next := c.leader(rest...)
+	if next == old {
+		t.Fatal("the partitioned leader kept its leadership")
+	}
+	if job, _ := next.GetJob("j"); job.Status != JobAccepted || job.Worker != f.id || job.Attempts != 1 {
+		t.Fatalf("job after the retry: %+v", job)
+	}
+	// The retry may be appended again if it reaches the new leader before that leader
+	// has applied the original; every copy must then carry the same session tag.
+	next.mutex.Lock()
+	var tags []string
+	for _, e := range next.log {
+		if e.Type == CmdAcceptJob {
+			tags = append(tags, fmt.Sprintf("%s/%d", e.ClientID, e.Sequence))
+		}
+	}
+	next.mutex.Unlock()
+	for _, tag := range tags {
+		if tag != tags[0] || strings.HasPrefix(tag, "/") {
+			t.Fatalf("accept entries tagged %v, want one session and sequence", tags)
+		}
+	}
+	// A new command, unlike the retry, finds the job taken.
+	if err := f.AcceptJob("j"); !errors.Is(err, ErrJobNotQueued) {
+		t.Fatalf("second accept: got %v, want ErrJobNotQueued", err)
+	}
+}
@@ -0,0 +1,930 @@
+// -------------------- raft/simulation_test.go --------------------
+package raft
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+const (
+	defaultSimNodes      = 3
+	defaultSimTick       = 10 * time.Millisecond
+	defaultSimMinLatency = time.Millisecond
+	defaultSimMaxLatency = 20 * time.Millisecond
+	defaultSimClients    = 3
+	defaultSimKeys       = 5
+	// simKeyShift is how many steps pass before the clients' key window moves on by one,
+	// so that there are always jobs left to post and accept.
+	simKeyShift = 100
+	// simClientTimeout is how long a simulated client waits for an operation. A write
+	// still in progress then has an unknown outcome; a read is abandoned.
+	simClientTimeout = 2 * time.Second
+	// simRPCTimeout is how long after sending a lost request its sender is told it failed,
+	// standing in for the transport's RPC timeout.
+	simRPCTimeout = 100 * time.Millisecond
+)
+
+// errSimLost is the transport error reported to the sender of a lost request.
+var errSimLost = errors.New("simulated message loss")
+
+// ------------------------------------------------------------------------
+// Deterministic Simulation
+// ------------------------------------------------------------------------
+//
+// The Simulator runs a cluster of real RaftNodes in a single goroutine against a virtual
+// clock, so a run is fully determined by its seed. Nodes are never started: instead of
+// their timer loops the simulator fires election timeouts and heartbeats itself, and
+// instead of the transport it queues every RPC with a random latency (so messages are
+// reordered), drops the ones crossing a partition or lost at random, and delivers the
+// answers back through the same handlers the runtime uses. Crashes close a node's
+// database and restarts reopen it, so recovery goes through the persisted state.
+//
+// After every step the simulator checks the Raft safety properties: at most one leader
+// per term (election safety), logs that agree on an entry's term agree on everything up
+// to it (log matching), every leader holds the entries committed in earlier terms
+// (leader completeness) and no two nodes apply different entries at the same index
+// (state machine safety). A violation is returned as an error naming the seed and step,
+// which is all it takes to replay the run.
+
+// SimConfig configures a Simulator. Zero fields take the defaults noted.
+type SimConfig struct {
+	Nodes             int           // cluster size; defaults to 3
+	Seed              int64         // seeds every random choice of the run
+	Dir               string        // directory for the nodes' databases (required)
+	Tick              time.Duration // virtual time per step; defaults to 10ms
+	MinLatency        time.Duration // defaults to 1ms
+	MaxLatency        time.Duration // defaults to 20ms
+	DropRate          float64       // probability that a message is lost
+	FaultRate         float64       // probability per step of a random crash, restart, partition or heal
+	ClientRate        float64       // probability per step that an idle client issues an operation
+	Clients           int           // concurrent clients; defaults to 3
+	Keys              int           // jobs and networks the clients use at a time; defaults to 5
+	SnapshotThreshold int           // per node; zero keeps the node default
+}
+
+// Simulator drives a cluster of RaftNodes deterministically. It is not safe for
+// concurrent use.
+type Simulator struct {
+	cfg   SimConfig
+	rng   *rand.Rand
+	now   time.Time
+	steps int
+	addrs []string
+	nodes map[string]*simNode
+	keys  map[string]ed25519.PublicKey // consensus key of every node booted so far
+
+	queue   []*simMessage      // pending deliveries, ordered by (deliverAt, seq)
+	seq     uint64             // tie-breaker keeping same-time deliveries in send order
+	blocked map[[2]string]bool // directed links cut by Partition
+	calls   []*simCall         // client operations in progress
+	busy    map[int]bool       // clients with an operation in progress
+	history *HistoryRecorder
+	leaders map[int]string      // term -> the one node seen leading it
+	applied map[int]LogEntry    // index -> entry first seen applied there
+	commits map[int]committedAt // index -> entry and term first seen committed
+	commitH int                 // highest index in commits
+}
+
+// simNode is the simulator's handle on one cluster member.
+type simNode struct {
+	addr        string
+	path        string
+	rn          *RaftNode
+	up          bool
+	incarnation int // bumped on every restart, so answers to a crashed run are dropped
+	deadline    time.Time
+	heartbeat   time.Time
+	checked     int // highest applied index compared against s.applied
+}
+
+// simCall is a client operation in progress: a write waiting on its future, or a read
+// going through the ReadIndex steps on a leader.
+type simCall struct {
+	client int
+	op     int // handle in the history
+	future *ApplyFuture
+
+	kind        string // OpReadJob or OpReadNetwork for reads
+	key         string
+	node        *simNode
+	incarnation int
+	term, index int
+	started     time.Time // when the read index was taken; zero before
+	confirmed   bool      // a quorum acknowledged the leader after started
+	deadline    time.Time
+}
+
+// committedAt records an entry and the leader term in which it was seen committed.
+type committedAt struct {
+	entry LogEntry
+	term  int
+}
+
+// simMessage is a request in flight, or the answer to one travelling back to its sender.
+type simMessage struct {
+	from, to    string
+	incarnation int // of the node that sent the request
+	deliverAt   time.Time
+	seq         uint64
+	req         interface{} // VoteRequest, AppendEntriesRequest or InstallSnapshotRequest
+	resp        interface{} // nil for a request; the response or errSimLost for an answer
+	sentAt      time.Time   // when req was sent
+	tally       *voteTally  // round a vote request belongs to
+}
+
+// NewSimulator creates a cluster of cfg.Nodes fresh nodes, named node-1, node-2, ...,
+// with their databases under cfg.Dir.
+func NewSimulator(cfg SimConfig) (*Simulator, error) {
+	if cfg.Dir == "" {
+		return nil, errors.New("simulation requires a directory for node databases")
+	}
+	if cfg.Nodes <= 0 {
+		cfg.Nodes = defaultSimNodes
+	}
+	if cfg.Tick <= 0 {
+		cfg.Tick = defaultSimTick
+	}
+	if cfg.MinLatency <= 0 {
+		cfg.MinLatency = defaultSimMinLatency
+	}
+	if cfg.Clients <= 0 {
+		cfg.Clients = defaultSimClients
+	}
+	if cfg.Keys <= 0 {
+		cfg.Keys = defaultSimKeys
+	}
+	if cfg.MaxLatency <= 0 {
+		cfg.MaxLatency = defaultSimMaxLatency
+	}
+	if cfg.MaxLatency < cfg.MinLatency {
+		cfg.MaxLatency = cfg.MinLatency
+	}
+	s := &Simulator{
+		cfg:     cfg,
+		rng:     rand.New(rand.NewSource(cfg.Seed)),
+		now:     time.Unix(0, 0).UTC(),
+		nodes:   make(map[string]*simNode),
+		keys:    make(map[string]ed25519.PublicKey),
+		blocked: make(map[[2]string]bool),
+		leaders: make(map[int]string),
+		applied: make(map[int]LogEntry),
+		commits: make(map[int]committedAt),
+		busy:    make(map[int]bool),
+		history: NewHistoryRecorder(),
+	}
+	for i := 1; i <= cfg.Nodes; i++ {
+		s.addrs = append(s.addrs, fmt.Sprintf("node-%d", i))
+	}
+	for _, addr := range s.addrs {
+		n := &simNode{addr: addr, path: filepath.Join(cfg.Dir, addr+".db")}
+		s.nodes[addr] = n
+		if err := s.boot(n); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// boot opens n's database and wires the node to the simulator. Nodes sign their RPCs
+// and trust each other's keys, which survive restarts in their databases.
+func (s *Simulator) boot(n *simNode) error {
+	rn, err := NewRaftNode(n.addr, s.addrs, n.path, nil, nil, false)
+	if err != nil {
+		return fmt.Errorf("failed to start %s: %w", n.addr, err)
+	}
+	rn.SetConsensusIdentity(testHash("cloudstorm-sim-service"), testHash(n.addr))
+	s.keys[n.addr] = rn.PublicKey()
+	for addr, key := range s.keys {
+		rn.SetPeerKey(addr, key)
+		if other := s.nodes[addr]; other.up && addr != n.addr {
+			other.rn.SetPeerKey(n.addr, rn.PublicKey())
+		}
+	}
+	rn.dispatch = func(pr string, req interface{}) { s.send(n.addr, pr, req) }
+	rn.clock = s.Now
+	rn.rng = rand.New(rand.NewSource((s.cfg.Seed ^ int64(fnv32(n.addr))) + int64(n.incarnation)))
+	if s.cfg.SnapshotThreshold > 0 {
+		rn.snapshotThreshold = s.cfg.SnapshotThreshold
+	}
+	n.rn = rn
+	n.up = true
+	n.checked = rn.lastApplied
+	n.deadline = s.now.Add(rn.randomizedTimeout())
+	n.heartbeat = s.now
+	return nil
+}
+
+// Close stops every running node.
+func (s *Simulator) Close() {
+	for _, addr := range s.addrs {
+		if n := s.nodes[addr]; n != nil && n.up {
+			n.up = false
+			n.rn.Stop()
+		}
+	}
+}
+
+// Now returns the virtual time.
+func (s *Simulator) Now() time.Time {
+	return s.now
+}
+
+// Steps returns how many steps have run.
+func (s *Simulator) Steps() int {
+	return s.steps
+}
+
+// Addrs returns the members' addresses.
+func (s *Simulator) Addrs() []string {
+	return append([]string(nil), s.addrs...)
+}
+
+// Node returns the RaftNode at addr, or nil while it is crashed.
+func (s *Simulator) Node(addr string) *RaftNode {
+	if n, ok := s.nodes[addr]; ok && n.up {
+		return n.rn
+	}
+	return nil
+}
+
+// Leader returns the running leader with the highest term, or "" if there is none.
+func (s *Simulator) Leader() string {
+	best, bestTerm := "", -1
+	for _, addr := range s.addrs {
+		n := s.nodes[addr]
+		if !n.up {
+			continue
+		}
+		n.rn.mutex.Lock()
+		if n.rn.state == Leader && n.rn.currentTerm > bestTerm {
+			best, bestTerm = addr, n.rn.currentTerm
+		}
+		n.rn.mutex.Unlock()
+	}
+	return best
+}
+
+// ------------------------------------------------------------------------
+// Faults
+// ------------------------------------------------------------------------
+
+// Partition splits the given addresses into groups that cannot reach each other, as
+// InmemNetwork.Partition does; messages already in flight between them are lost too.
+// Addresses not listed keep their existing links.
+func (s *Simulator) Partition(groups ...[]string) {
+	for i, a := range groups {
+		for j, b := range groups {
+			if i == j {
+				continue
+			}
+			for _, from := range a {
+				for _, to := range b {
+					s.blocked[[2]string{from, to}] = true
+				}
+			}
+		}
+	}
+}
+
+// Heal removes every partition.
+func (s *Simulator) Heal() {
+	s.blocked = make(map[[2]string]bool)
+}
+
+// Crash stops the node at addr, losing everything it has not persisted.
+func (s *Simulator) Crash(addr string) error {
+	n, ok := s.nodes[addr]
+	if !ok {
+		return fmt.Errorf("unknown node %q", addr)
+	}
+	if !n.up {
+		return nil
+	}
+	n.up = false
+	n.rn.Stop()
+	return nil
+}
+
+// Restart recovers a crashed node from its database.
+func (s *Simulator) Restart(addr string) error {
+	n, ok := s.nodes[addr]
+	if !ok {
+		return fmt.Errorf("unknown node %q", addr)
+	}
+	if n.up {
+		return nil
+	}
+	n.incarnation++
+	return s.boot(n)
+}
+
+// SetDropRate sets the probability that a message is lost.
+func (s *Simulator) SetDropRate(p float64) {
+	s.cfg.DropRate = p
+}
+
+// Propose hands a command to the current leader without waiting for it to commit.
+func (s *Simulator) Propose(cmdType string, command interface{}) error {
+	leader := s.Leader()
+	if leader == "" {
+		return ErrNotLeader
+	}
+	f := s.nodes[leader].rn.Propose(cmdType, command, 0)
+	select {
+	case <-f.Done():
+		_, err := f.Wait()
+		return err
+	default:
+		return nil
+	}
+}
+
+// ------------------------------------------------------------------------
+// Execution
+// ------------------------------------------------------------------------
+
+// Run executes the given number of steps, stopping at the first invariant violation.
+func (s *Simulator) Run(steps int) error {
+	for i := 0; i < steps; i++ {
+		if err := s.Step(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Step advances the virtual clock by one tick: it injects random faults and client
+// operations,
+// delivers every message due, fires due election timeouts and heartbeats, and then checks
+// the safety invariants.
+func (s *Simulator) Step() error {
+	s.steps++
+	s.now = s.now.Add(s.cfg.Tick)
+
+	if s.rng.Float64() < s.cfg.FaultRate {
+		s.injectFault()
+	}
+	if s.rng.Float64() < s.cfg.ClientRate {
+		s.issueClientOp()
+	}
+
+	for len(s.queue) > 0 && !s.queue[0].deliverAt.After(s.now) {
+		m := s.queue[0]
+		s.queue = s.queue[1:]
+		s.deliver(m)
+	}
+
+	for _, addr := range s.addrs {
+		if n := s.nodes[addr]; n.up {
+			s.tick(n)
+		}
+	}
+	s.pollClientOps()
+
+	if err := s.checkInvariants(); err != nil {
+		return fmt.Errorf("seed %d, step %d: %w", s.cfg.Seed, s.steps, err)
+	}
+	return nil
+}
+
+// injectFault applies one random crash, restart, partition or heal.
+func (s *Simulator) injectFault() {
+	addr := s.addrs[s.rng.Intn(len(s.addrs))]
+	switch s.rng.Intn(4) {
+	case 0:
+		s.Crash(addr)
+	case 1:
+		s.Restart(addr)
+	case 2:
+		var a, b []string
+		for _, m := range s.addrs {
+			if s.rng.Intn(2) == 0 {
+				a = append(a, m)
+			} else {
+				b = append(b, m)
+			}
+		}
+		s.Partition(a, b)
+	case 3:
+		s.Heal()
+	}
+}
+
+// tick fires n's election timeout or, on a leader, its heartbeat, if due.
+func (s *Simulator) tick(n *simNode) {
+	select {
+	case <-n.rn.resetChan:
+		n.deadline = s.now.Add(n.rn.randomizedTimeout())
+	default:
+	}
+	if n.rn.getState() == Leader {
+		if !s.now.Before(n.heartbeat) {
+			n.rn.sendHeartbeats()
+			n.rn.updateCommitIndex()
+			n.heartbeat = s.now.Add(n.rn.heartbeat)
+		}
+		return
+	}
+	if !s.now.Before(n.deadline) {
+		s.campaign(n)
+		n.deadline = s.now.Add(n.rn.randomizedTimeout())
+	}
+}
+
+// campaign starts a pre-vote round on n, as runFollower and runCandidate would when the
+// election timer fires.
+func (s *Simulator) campaign(n *simNode) {
+	rn := n.rn
+	rn.mutex.Lock()
+	if !rn.isVoter(rn.addr) {
+		rn.mutex.Unlock()
+		return
+	}
+	rn.state = Candidate
+	tally, req := rn.beginPreVote()
+	won := rn.hasQuorum(tally.granted)
+	peers := rn.votingPeers()
+	rn.mutex.Unlock()
+	if won {
+		s.elect(n)
+		return
+	}
+	s.requestVotes(n, peers, tally, req)
+}
+
+// elect starts the real election on n after it won a pre-vote.
+func (s *Simulator) elect(n *simNode) {
+	rn := n.rn
+	rn.mutex.Lock()
+	if rn.state != Candidate || !rn.startElection() {
+		rn.mutex.Unlock()
+		return
+	}
+	tally, req := rn.beginElection(false)
+	won := rn.hasQuorum(tally.granted) && rn.becomeLeader(req.Term)
+	peers := rn.votingPeers()
+	rn.mutex.Unlock()
+	n.deadline = s.now.Add(rn.randomizedTimeout())
+	if !won {
+		s.requestVotes(n, peers, tally, req)
+	}
+}
+
+// requestVotes queues req from n to every peer.
+func (s *Simulator) requestVotes(n *simNode, peers []string, tally *voteTally, req VoteRequest) {
+	for _, p := range peers {
+		s.enqueue(&simMessage{from: n.addr, to: p, incarnation: n.incarnation, req: req, sentAt: s.now, tally: tally})
+	}
+}
+
+// send queues an RPC from a node's replication code. The sender holds its rn.mutex.
+func (s *Simulator) send(from, to string, req interface{}) {
+	s.enqueue(&simMessage{from: from, to: to, incarnation: s.nodes[from].incarnation, req: req, sentAt: s.now})
+}
+
+// enqueue schedules m after a random latency, or as a loss if it is dropped.
+func (s *Simulator) enqueue(m *simMessage) {
+	m.deliverAt = s.now.Add(s.latency())
+	if s.rng.Float64() < s.cfg.DropRate {
+		s.lose(m)
+		return
+	}
+	s.push(m)
+}
+
+// lose reports a lost request, or the request of a lost answer, to its sender as a
+// transport error once the RPC would have timed out.
+func (s *Simulator) lose(m *simMessage) {
+	if _, isVote := m.req.(VoteRequest); isVote {
+		return // the candidate just never hears back
+	}
+	peer, sender := m.to, m.from
+	if m.resp != nil {
+		peer, sender = m.from, m.to // an answer travels from the peer back to the sender
+	}
+	s.push(&simMessage{
+		from:        peer,
+		to:          sender,
+		incarnation: m.incarnation,
+		deliverAt:   m.sentAt.Add(simRPCTimeout),
+		req:         m.req,
+		resp:        errSimLost,
+		sentAt:      m.sentAt,
+	})
+}
+
+// push inserts m into the queue in delivery order.
+func (s *Simulator) push(m *simMessage) {
+	s.seq++
+	m.seq = s.seq
+	i := sort.Search(len(s.queue), func(i int) bool {
+		q := s.queue[i]
+		return q.deliverAt.After(m.deliverAt) || (q.deliverAt.Equal(m.deliverAt) && q.seq > m.seq)
+	})
+	s.queue = append(s.queue, nil)
+	copy(s.queue[i+1:], s.queue[i:])
+	s.queue[i] = m
+}
+
+// latency draws a delivery delay in [MinLatency, MaxLatency].
+func (s *Simulator) latency() time.Duration {
+	spread := int64(s.cfg.MaxLatency - s.cfg.MinLatency)
+	if spread <= 0 {
+		return s.cfg.MinLatency
+	}
+	return s.cfg.MinLatency + time.Duration(s.rng.Int63n(spread+1))
+}
+
+// deliver hands m to its destination: a request to the receiver's handler, an answer or
+// loss to the sender's response handling.
+func (s *Simulator) deliver(m *simMessage) {
+	if m.resp != nil {
+		s.deliverAnswer(m)
+		return
+	}
+	n := s.nodes[m.to]
+	if !n.up || s.blocked[[2]string{m.from, m.to}] {
+		s.lose(m)
+		return
+	}
+	var resp interface{}
+	switch req := m.req.(type) {
+	case VoteRequest:
+		resp = n.rn.HandleVoteRequest(req)
+	case AppendEntriesRequest:
+		resp = n.rn.HandleAppendEntries(req)
+	case InstallSnapshotRequest:
+		resp = n.rn.HandleInstallSnapshot(req)
+	}
+	answer := *m
+	answer.from, answer.to, answer.resp = m.to, m.from, resp
+	s.enqueue(&answer)
+}
+
+// deliverAnswer passes the answer to (or loss of) a request back to its sender, unless
+// the sender has crashed since or the answer crosses a partition.
+func (s *Simulator) deliverAnswer(m *simMessage) {
+	n := s.nodes[m.to]
+	if !n.up || n.incarnation != m.incarnation {
+		return
+	}
+	_, lost := m.resp.(error)
+	if !lost && s.blocked[[2]string{m.from, m.to}] {
+		s.lose(m)
+		return
+	}
+	rn, peer := n.rn, m.from
+	switch req := m.req.(type) {
+	case VoteRequest:
+		rn.mutex.Lock()
+		won := rn.handleVoteResponse(m.tally, peer, req, m.resp.(VoteResponse))
+		rn.mutex.Unlock()
+		if won && req.PreVote {
+			s.elect(n)
+		}
+	case AppendEntriesRequest:
+		if lost {
+			rn.finishAppend(peer, req, AppendEntriesResponse{}, errSimLost, m.sentAt)
+		} else {
+			rn.finishAppend(peer, req, m.resp.(AppendEntriesResponse), nil, m.sentAt)
+		}
+	case InstallSnapshotRequest:
+		rn.mutex.Lock()
+		if !lost {
+			rn.handleSnapshotResponse(peer, req, m.resp.(InstallSnapshotResponse), m.sentAt)
+		}
+		rn.resumeAfterSnapshot(peer, req.Term)
+		rn.mutex.Unlock()
+	}
+}
+
+// ------------------------------------------------------------------------
+// Clients
+// ------------------------------------------------------------------------
+//
+// Simulated clients call the same code paths as PostJob, AcceptJob and CreateNetwork,
+// without blocking on the outcome, and read through the ReadIndex steps. Every
+// operation is recorded, so the run's history can be checked for linearizability
+// against JobQueueModel.
+
+// History returns the client operations recorded so far.
+func (s *Simulator) History() []Operation {
+	return s.history.History()
+}
+
+// CheckHistory checks the recorded client operations for linearizability.
+func (s *Simulator) CheckHistory() error {
+	return CheckLinearizable(JobQueueModel, s.history.History())
+}
+
+// issueClientOp starts a random operation for a random idle client, usually on the
+// leader but sometimes on another node.
+func (s *Simulator) issueClientOp() {
+	var idle []int
+	for c := 0; c < s.cfg.Clients; c++ {
+		if !s.busy[c] {
+			idle = append(idle, c)
+		}
+	}
+	var up []*simNode
+	for _, addr := range s.addrs {
+		if n := s.nodes[addr]; n.up {
+			up = append(up, n)
+		}
+	}
+	if len(idle) == 0 || len(up) == 0 {
+		return
+	}
+	client := idle[s.rng.Intn(len(idle))]
+	n := up[s.rng.Intn(len(up))]
+	if leader := s.Leader(); leader != "" && s.rng.Intn(5) > 0 {
+		n = s.nodes[leader]
+	}
+	key := s.steps/simKeyShift + s.rng.Intn(s.cfg.Keys)
+	jobID := fmt.Sprintf("sim-job-%d", key)
+	networkID := fmt.Sprintf("sim-network-%d", key)
+
+	call := &simCall{client: client}
+	switch s.rng.Intn(5) {
+	case 0:
+		call.op = s.history.Begin(client, OpPostJob, jobID)
+		call.future = n.rn.Propose(CmdPostJob, Job{ID: jobID, Type: "Simulation", Status: JobQueued}, n.rn.proposalTimeout)
+	case 1:
+		call.op = s.history.Begin(client, OpAcceptJob, jobID)
+		call.future = n.rn.Propose(CmdAcceptJob, n.rn.jobTransition(jobID, n.rn.id), n.rn.proposalTimeout)
+	case 2:
+		// CreateNetwork without the XRPL license lookup.
+		call.op = s.history.Begin(client, OpCreateNetwork, networkID)
+		call.future = n.rn.Propose(CmdCreateNetwork, Network{ID: networkID}, n.rn.proposalTimeout)
+	case 3:
+		call.op = s.history.Begin(client, OpReadJob, jobID)
+		call.kind, call.key = OpReadJob, jobID
+	case 4:
+		call.op = s.history.Begin(client, OpReadNetwork, networkID)
+		call.kind, call.key = OpReadNetwork, networkID
+	}
+	call.node, call.incarnation = n, n.incarnation
+	call.deadline = s.now.Add(simClientTimeout)
+	s.calls = append(s.calls, call)
+	s.busy[client] = true
+}
+
+// pollClientOps records every operation that has completed.
+func (s *Simulator) pollClientOps() {
+	var open []*simCall
+	for _, c := range s.calls {
+		if !s.pollClientOp(c) {
+			open = append(open, c)
+		}
+	}
+	s.calls = open
+}
+
+// pollClientOp advances c and reports whether it is done.
+func (s *Simulator) pollClientOp(c *simCall) bool {
+	done := true
+	if c.future != nil {
+		select {
+		case <-c.future.Done():
+			_, err := c.future.Wait()
+			s.history.endWrite(c.op, err)
+		default:
+			done = !s.now.Before(c.deadline) // outcome stays unknown
+		}
+	} else {
+		done = s.pollRead(c)
+	}
+	if done {
+		s.busy[c.client] = false
+	}
+	return done
+}
+
+// pollRead takes c's read index, waits for a quorum to confirm the leader after that,
+// and for the index to be applied, as ReadIndex does. It reports whether c is done.
+func (s *Simulator) pollRead(c *simCall) bool {
+	n := c.node
+	if !n.up || n.incarnation != c.incarnation || !s.now.Before(c.deadline) {
+		s.history.Drop(c.op)
+		return true
+	}
+	rn := n.rn
+	rn.mutex.Lock()
+	defer rn.mutex.Unlock()
+	if c.started.IsZero() {
+		term, index, ready, err := rn.readIndexReady()
+		if err != nil {
+			s.history.Drop(c.op)
+			return true
+		}
+		if ready {
+			c.term, c.index, c.started = term, index, s.now
+		}
+		return false
+	}
+	if !c.confirmed {
+		if rn.state != Leader || rn.currentTerm != c.term {
+			s.history.Drop(c.op)
+			return true
+		}
+		// Only acknowledgements of RPCs sent after the index was taken count.
+		c.confirmed = rn.quorumAckedSince(c.started)
+	}
+	if !c.confirmed || rn.lastApplied < c.index {
+		return false
+	}
+	if c.kind == OpReadJob {
+		job, ok := rn.jobQueue[c.key]
+		s.history.End(c.op, jobOutcome(job, ok))
+	} else {
+		_, ok := rn.Networks[c.key]
+		s.history.End(c.op, networkOutcome(ok))
+	}
+	return true
+}
+
+// ------------------------------------------------------------------------
+// Safety Invariants
+// ------------------------------------------------------------------------
+
+// simView is a consistent copy of the state of one running node.
+type simView struct {
+	addr        string
+	state       RaftState
+	term        int
+	commitIndex int
+	lastApplied int
+	log         []LogEntry // log[0] is the snapshot sentinel
+}
+
+func (v simView) snapshotIndex() int { return v.log[0].Index }
+func (v simView) lastIndex() int     { return v.log[len(v.log)-1].Index }
+func (v simView) entry(i int) LogEntry {
+	return v.log[i-v.snapshotIndex()]
+}
+
+// checkInvariants verifies the safety properties across every running node.
+func (s *Simulator) checkInvariants() error {
+	var views []simView
+	for _, addr := range s.addrs {
+		n := s.nodes[addr]
+		if !n.up {
+			continue
+		}
+		n.rn.mutex.Lock()
+		views = append(views, simView{
+			addr:        addr,
+			state:       n.rn.state,
+			term:        n.rn.currentTerm,
+			commitIndex: n.rn.commitIndex,
+			lastApplied: n.rn.lastApplied,
+			log:         append([]LogEntry(nil), n.rn.log...),
+		})
+		n.rn.mutex.Unlock()
+	}
+
+	// Election safety: at most one leader per term, over the whole run.
+	for _, v := range views {
+		if v.state != Leader {
+			continue
+		}
+		if other, ok := s.leaders[v.term]; ok && other != v.addr {
+			return fmt.Errorf("election safety violated: %s and %s both led term %d", other, v.addr, v.term)
+		}
+		s.leaders[v.term] = v.addr
+	}
+
+	// Log matching: if two logs hold an entry with the same index and term, they are
+	// identical up to that index.
+	for i := range views {
+		for j := i + 1; j < len(views); j++ {
+			if err := checkLogMatching(views[i], views[j]); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Record what leaders have committed, and the term they committed it in.
+	for _, v := range views {
+		if v.state != Leader {
+			continue
+		}
+		for idx := s.commitH + 1; idx <= v.commitIndex; idx++ {
+			if idx > v.snapshotIndex() {
+				s.commits[idx] = committedAt{entry: v.entry(idx), term: v.term}
+			}
+		}
+		if v.commitIndex > s.commitH {
+			s.commitH = v.commitIndex
+		}
+	}
+
+	// Leader completeness: a leader holds every entry committed in an earlier term.
+	for _, v := range views {
+		if v.state != Leader {
+			continue
+		}
+		for idx := v.snapshotIndex() + 1; idx <= s.commitH; idx++ {
+			c, ok := s.commits[idx]
+			if !ok || c.term >= v.term {
+				continue
+			}
+			if idx > v.lastIndex() || !sameEntry(v.entry(idx), c.entry) {
+				return fmt.Errorf("leader completeness violated: leader %s of term %d lacks entry %d committed in term %d",
+					v.addr, v.term, idx, c.term)
+			}
+		}
+	}
+
+	// State machine safety: no two nodes apply different entries at the same index.
+	for _, v := range views {
+		n := s.nodes[v.addr]
+		from := n.checked + 1
+		if from <= v.snapshotIndex() {
+			from = v.snapshotIndex() + 1 // installed from a snapshot; entries not visible
+		}
+		for idx := from; idx <= v.lastApplied; idx++ {
+			e := v.entry(idx)
+			if prev, ok := s.applied[idx]; ok && !sameEntry(prev, e) {
+				return fmt.Errorf("state machine safety violated: %s applied %s at index %d (term %d), another node %s (term %d)",
+					v.addr, e.Type, idx, e.Term, prev.Type, prev.Term)
+			}
+			s.applied[idx] = e
+		}
+		n.checked = v.lastApplied
+		if v.lastApplied > v.commitIndex {
+			return fmt.Errorf("%s applied index %d beyond its commit index %d", v.addr, v.lastApplied, v.commitIndex)
+		}
+	}
+	return nil
+}
+
+// checkLogMatching verifies the log matching property between two nodes over the part
+// of their logs neither has compacted.
+func checkLogMatching(a, b simView) error {
+	lo := a.snapshotIndex()
+	if b.snapshotIndex() > lo {
+		lo = b.snapshotIndex()
+	}
+	hi := a.lastIndex()
+	if b.lastIndex() < hi {
+		hi = b.lastIndex()
+	}
+	match := 0
+	for idx := hi; idx > lo; idx-- {
+		if a.entry(idx).Term == b.entry(idx).Term {
+			match = idx
+			break
+		}
+	}
+	for idx := lo + 1; idx <= match; idx++ {
+		if !sameEntry(a.entry(idx), b.entry(idx)) {
+			return fmt.Errorf("log matching violated: %s and %s agree on entry %d (term %d) but differ at index %d",
+				a.addr, b.addr, match, a.entry(match).Term, idx)
+		}
+	}
+	return nil
+}
+
+// sameEntry reports whether two log entries are identical.
+func sameEntry(a, b LogEntry) bool {
+	return a.Index == b.Index && a.Term == b.Term && a.Type == b.Type &&
+		a.ClientID == b.ClientID && a.Sequence == b.Sequence && bytes.Equal(a.Command, b.Command)
+}
+
+// TestSimulation runs clusters through crashes, restarts, partitions and message loss
+// under several seeds, checking the safety invariants after every step and the clients'
+// history for linearizability at the end.
+func TestSimulation(t *testing.T) {
+	for seed := int64(1); seed <= 12; seed++ {
+		t.Run(fmt.Sprintf("seed-%d", seed), func(t *testing.T) {
+			s, err := NewSimulator(SimConfig{
+				Nodes:             5,
+				Seed:              seed,
+				Dir:               t.TempDir(),
+				FaultRate:         0.01,
+				DropRate:          0.05,
+				ClientRate:        0.3,
+				SnapshotThreshold: 40,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			if err := s.Run(2000); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.CheckHistory(); err != nil {
+				t.Fatalf("seed %d: %v", seed, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,225 @@
+// -------------------- raft/snapshot.go --------------------
+package raft
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+)
+
+// defaultSnapshotThreshold is the number of applied entries kept in the log before the
+// prefix is folded into a snapshot.
+const defaultSnapshotThreshold = 1024
+
+// ------------------------------------------------------------------------
+// Snapshot & Log Compaction
+// ------------------------------------------------------------------------
+
+// Snapshot is the persisted image of the applied state as of LastIncludedIndex.
+type Snapshot struct {
+	LastIncludedIndex int                      `json:"last_included_index"`
+	LastIncludedTerm  int                      `json:"last_included_term"`
+	LastIncludedHash  string                   `json:"last_included_hash,omitempty"`
+	Configuration     Configuration            `json:"configuration"`
+	Sessions          map[string]clientSession `json:"sessions,omitempty"`
+	State             json.RawMessage          `json:"state"`
+}
+
+// SetSnapshotThreshold sets how many applied entries may accumulate before the log is
+// compacted. Zero or less disables automatic snapshots.
+func (rn *RaftNode) SetSnapshotThreshold(entries int) {
+	rn.mutex.Lock()
+	defer rn.mutex.Unlock()
+	rn.snapshotThreshold = entries
+}
+
+// TakeSnapshot snapshots the applied state now and compacts the log up to lastApplied.
+func (rn *RaftNode) TakeSnapshot() error {
+	rn.mutex.Lock()
+	defer rn.mutex.Unlock()
+	return rn.takeSnapshot()
+}
+
+// maybeSnapshot takes a snapshot once enough entries have been applied. Caller holds rn.mutex.
+func (rn *RaftNode) maybeSnapshot() {
+	if rn.snapshotThreshold <= 0 || rn.lastApplied-rn.snapshotIndex() < rn.snapshotThreshold {
+		return
+	}
+	if err := rn.takeSnapshot(); err != nil {
+		log.Printf("Snapshot at index %d failed: %v", rn.lastApplied, err)
+	}
+}
+
+// takeSnapshot persists the applied state at lastApplied and drops the log prefix it
+// covers. Caller holds rn.mutex.
+func (rn *RaftNode) takeSnapshot() error {
+	index := rn.lastApplied
+	if index <= rn.snapshotIndex() {
+		return nil
+	}
+	term := rn.entryAt(index).Term
+	state, err := rn.fsm.Snapshot()
+	if err != nil {
+		return err
+	}
+	cfg, _ := rn.configAt(index)
+	snap := Snapshot{
+		LastIncludedIndex: index,
+		LastIncludedTerm:  term,
+		LastIncludedHash:  rn.entryAt(index).Hash,
+		Configuration:     cfg,
+		Sessions:          copySessions(rn.sessions),
+		State:             state,
+	}
+	if err := rn.saveSnapshot(snap, false); err != nil {
+		return err
+	}
+	rn.compactLog(index, term)
+	rn.snapConfig = cfg
+	log.Printf("Snapshot taken at index %d (term %d)", index, term)
+	return nil
+}
+
+// compactLog drops entries up to and including index, keeping a sentinel that records
+// the snapshot's index, term and hash. Caller holds rn.mutex.
+func (rn *RaftNode) compactLog(index, term int) {
+	var keep []LogEntry
+	if index < rn.lastLogIndex() {
+		keep = rn.log[index-rn.snapshotIndex()+1:]
+	}
+	compacted := make([]LogEntry, 0, len(keep)+1)
+	compacted = append(compacted, LogEntry{Index: index, Term: term, Hash: rn.entryAt(index).Hash})
+	rn.log = append(compacted, keep...)
+}
+
+// ------------------------------------------------------------------------
+// InstallSnapshot RPC
+// ------------------------------------------------------------------------
+
+// sendSnapshot ships the latest snapshot to a peer that has fallen behind the compacted
+// prefix of our log, then advances its replication progress. It reports whether the
+// peer acknowledged us as leader of term.
+func (rn *RaftNode) sendSnapshot(peer string, term int) bool {
+	rn.mutex.Lock()
+	req, ok := rn.snapshotRequest(peer, term)
+	rn.mutex.Unlock()
+	if !ok {
+		return false
+	}
+	return rn.installSnapshot(peer, req)
+}
+
+// installSnapshot sends req to peer and handles the answer, reporting whether the peer
+// acknowledged us as leader of req.Term.
+func (rn *RaftNode) installSnapshot(peer string, req InstallSnapshotRequest) bool {
+	sentAt := rn.clock()
+	resp, err := rn.transport.InstallSnapshot(peer, req)
+	if err != nil {
+		log.Printf("InstallSnapshot to %s failed: %v", peer, err)
+		return false
+	}
+	rn.mutex.Lock()
+	defer rn.mutex.Unlock()
+	return rn.handleSnapshotResponse(peer, req, resp, sentAt)
+}
+
+// snapshotRequest loads the latest snapshot into an InstallSnapshot request for a leader
+// of term. Caller holds rn.mutex.
+func (rn *RaftNode) snapshotRequest(peer string, term int) (InstallSnapshotRequest, bool) {
+	snap, ok, err := rn.loadSnapshot()
+	if err != nil || !ok {
+		log.Printf("No snapshot available for %s: %v", peer, err)
+		return InstallSnapshotRequest{}, false
+	}
+	req := InstallSnapshotRequest{
+		Term:              term,
+		LeaderID:          rn.id,
+		LastIncludedIndex: snap.LastIncludedIndex,
+		LastIncludedTerm:  snap.LastIncludedTerm,
+		LastIncludedHash:  snap.LastIncludedHash,
+		Configuration:     snap.Configuration,
+		Sessions:          snap.Sessions,
+		Data:              snap.State,
+	}
+	req.ServiceID, req.ProofKeyHash, req.CombinedProof = rn.signProof(proofSnapshot, term)
+	return req, true
+}
+
+// handleSnapshotResponse updates peer's progress from a response to req, sent at sentAt,
+// and reports whether the peer acknowledged us as leader of req.Term. Caller holds
+// rn.mutex.
+func (rn *RaftNode) handleSnapshotResponse(peer string, req InstallSnapshotRequest, resp InstallSnapshotResponse, sentAt time.Time) bool {
+	if resp.Term > rn.currentTerm {
+		rn.becomeFollower(resp.Term)
+		rn.resetElectionTimer()
+		return false
+	}
+	if rn.state != Leader || rn.currentTerm != req.Term || resp.Rejected {
+		return false
+	}
+	rn.lastAck[peer] = sentAt
+	if req.LastIncludedIndex > rn.matchIndex[peer] {
+		rn.matchIndex[peer] = req.LastIncludedIndex
+	}
+	rn.nextIndex[peer] = rn.matchIndex[peer] + 1
+	return true
+}
+
+// HandleInstallSnapshot implements the receiver side of InstallSnapshot: it replaces the
+// applied state with the leader's snapshot, keeping any log suffix that agrees with it.
+func (rn *RaftNode) HandleInstallSnapshot(req InstallSnapshotRequest) InstallSnapshotResponse {
+	rn.mutex.Lock()
+	defer rn.mutex.Unlock()
+
+	if err := rn.checkProof(proofSnapshot, req.LeaderID, req.Term, req.ServiceID, req.ProofKeyHash, req.CombinedProof); err != nil {
+		rn.rejectRPC(proofSnapshot, req.LeaderID, err)
+		return InstallSnapshotResponse{Term: rn.currentTerm, Rejected: true}
+	}
+
+	if req.Term < rn.currentTerm {
+		return InstallSnapshotResponse{Term: rn.currentTerm}
+	}
+	rn.becomeFollower(req.Term)
+	rn.setLeader(req.LeaderID, "")
+	rn.lastContact = rn.clock()
+	rn.resetElectionTimer()
+
+	resp := InstallSnapshotResponse{Term: rn.currentTerm}
+	if req.LastIncludedIndex <= rn.lastApplied {
+		return resp // we already have everything this snapshot covers
+	}
+	term, ok := rn.termAt(req.LastIncludedIndex)
+	keepSuffix := ok && term == req.LastIncludedTerm
+
+	snap := Snapshot{
+		LastIncludedIndex: req.LastIncludedIndex,
+		LastIncludedTerm:  req.LastIncludedTerm,
+		LastIncludedHash:  req.LastIncludedHash,
+		Configuration:     req.Configuration,
+		Sessions:          req.Sessions,
+		State:             req.Data,
+	}
+	if err := rn.saveSnapshot(snap, !keepSuffix); err != nil {
+		log.Printf("Failed to persist snapshot at index %d: %v", req.LastIncludedIndex, err)
+		return resp
+	}
+	if err := rn.fsm.Restore(req.Data); err != nil {
+		log.Printf("Failed to restore snapshot at index %d: %v", req.LastIncludedIndex, err)
+		return resp
+	}
+	if keepSuffix {
+		rn.compactLog(req.LastIncludedIndex, req.LastIncludedTerm)
+	} else {
+		rn.log = []LogEntry{{Index: req.LastIncludedIndex, Term: req.LastIncludedTerm, Hash: req.LastIncludedHash}}
+	}
+	rn.snapConfig = req.Configuration
+	rn.sessions = copySessions(req.Sessions)
+	rn.reloadConfig()
+	if req.LastIncludedIndex > rn.commitIndex {
+		rn.commitIndex = req.LastIncludedIndex
+	}
+	rn.lastApplied = req.LastIncludedIndex
+	rn.notifyApplied()
+	rn.applyLogEntries()
+	return resp
+}
@@ -0,0 +1,92 @@
+// -------------------- raft/snapshot_test.go --------------------
+package raft
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// restart stops node id and opens it again from its database, unstarted.
+func (c *testCluster) restart(id string) *RaftNode {
+	c.t.Helper()
+	c.nodes[id].Stop()
+	return c.newNode(id, c.ids)
+}
+
+// jobs returns a copy of rn's applied jobs.
+func jobs(rn *RaftNode) map[string]Job {
+	rn.mutex.Lock()
+	defer rn.mutex.Unlock()
+	out := make(map[string]Job, len(rn.jobQueue))
+	for id, job := range rn.jobQueue {
+		out[id] = job
+	}
+	return out
+}
+
+// TestInstallSnapshot cuts a follower off while the leader compacts its log past the
+// follower's last entry, restarts the follower and checks that InstallSnapshot brings it
+// up to date, and that the installed snapshot survives another restart.
+func TestInstallSnapshot(t *testing.T) {
+	c := newTestCluster(t, []string{"n1", "n2", "n3"}, nil, func(rn *RaftNode) {
+		rn.SetSnapshotThreshold(5)
+	})
+	leader := c.leader()
+	f := c.follower(leader)
+	var rest []string
+	for _, id := range c.ids {
+		if id != f.id {
+			rest = append(rest, id)
+		}
+	}
+	c.net.Partition([]string{f.id}, rest)
+	for i := 0; i < 20; i++ {
+		if err := leader.PostJob(Job{ID: fmt.Sprintf("j%d", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	leader.mutex.Lock()
+	compacted := leader.snapshotIndex()
+	leader.mutex.Unlock()
+	if compacted == 0 {
+		t.Fatal("the leader did not compact its log")
+	}
+
+	f = c.restart(f.id)
+	f.Start()
+	c.net.Heal()
+	want := jobs(leader)
+	waitFor(t, 5*time.Second, "the follower to catch up", func() bool {
+		return reflect.DeepEqual(jobs(f), want)
+	})
+	f.mutex.Lock()
+	installed := f.snapshotIndex()
+	f.mutex.Unlock()
+	if installed < compacted {
+		t.Fatalf("follower's log starts after %d, want a snapshot of at least %d", installed, compacted)
+	}
+
+	f = c.restart(f.id)
+	f.mutex.Lock()
+	restored := f.snapshotIndex()
+	f.mutex.Unlock()
+	if restored != installed {
+		t.Fatalf("restarted follower's log starts after %d, want the installed snapshot's %d", restored, installed)
+	}
+	// Entries after the snapshot are applied once a leader confirms they are committed.
+	got := jobs(f)
+	if len(got) == 0 {
+		t.Fatal("restarted follower restored no jobs from its snapshot")
+	}
+	for id, job := range got {
+		if !reflect.DeepEqual(job, want[id]) {
+			t.Fatalf("restarted follower restored %+v, want %+v", job, want[id])
+		}
+	}
+	f.Start()
+	waitFor(t, 5*time.Second, "the restarted follower to catch up", func() bool {
+		return reflect.DeepEqual(jobs(f), want)
+	})
+}
@@ -0,0 +1,232 @@
+// -------------------- raft/storage.go --------------------
+package raft
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// ------------------------------------------------------------------------
+// Durable Raft State (bbolt)
+// ------------------------------------------------------------------------
+
+// Bucket and key names used in the node's bolt database. Every Update transaction
+// is fsync'd by bbolt on commit, so a nil error means the data is on disk. The buckets of
+// a group run by a GroupManager live under bucketGroups/<group ID>; those of a plain
+// RaftNode (and of a manager's meta group) at the top level.
+var (
+	bucketLog      = []byte("raft_log")
+	bucketState    = []byte("raft_state")
+	bucketSnapshot = []byte("raft_snapshot")
+	bucketGroups   = []byte("raft_groups")
+
+	keyCurrentTerm = []byte("current_term")
+	keyVotedFor    = []byte("voted_for")
+	keySnapshot    = []byte("latest")
+	keyNodeKey     = []byte("node_key")
+)
+
+// indexKey encodes a log index as a big-endian key so bolt iterates entries in log order.
+func indexKey(index int) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, uint64(index))
+	return k
+}
+
+// bucket returns one of the node's raft buckets.
+func (rn *RaftNode) bucket(tx *bolt.Tx, name []byte) *bolt.Bucket {
+	if rn.groupID == "" {
+		return tx.Bucket(name)
+	}
+	return tx.Bucket(bucketGroups).Bucket([]byte(rn.groupID)).Bucket(name)
+}
+
+// createBuckets creates the node's raft buckets if needed.
+func (rn *RaftNode) createBuckets(tx *bolt.Tx) error {
+	var parent interface {
+		CreateBucketIfNotExists(name []byte) (*bolt.Bucket, error)
+	} = tx
+	if rn.groupID != "" {
+		groups, err := tx.CreateBucketIfNotExists(bucketGroups)
+		if err != nil {
+			return err
+		}
+		if parent, err = groups.CreateBucketIfNotExists([]byte(rn.groupID)); err != nil {
+			return err
+		}
+	}
+	for _, name := range [][]byte{bucketLog, bucketState, bucketSnapshot} {
+		if _, err := parent.CreateBucketIfNotExists(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadFromStorage creates the raft buckets if needed and restores the latest snapshot,
+// currentTerm, votedFor and the log entries written by a previous run. Called once from
+// newRaftNode.
+func (rn *RaftNode) loadFromStorage() error {
+	return rn.db.Update(func(tx *bolt.Tx) error {
+		if err := rn.createBuckets(tx); err != nil {
+			return err
+		}
+		st := rn.bucket(tx, bucketState)
+		sb := rn.bucket(tx, bucketSnapshot)
+		if v := sb.Get(keySnapshot); v != nil {
+			var snap Snapshot
+			if err := json.Unmarshal(v, &snap); err != nil {
+				return fmt.Errorf("corrupt snapshot: %w", err)
+			}
+			if err := rn.fsm.Restore(snap.State); err != nil {
+				return fmt.Errorf("failed to restore snapshot state: %w", err)
+			}
+			rn.log = []LogEntry{{Index: snap.LastIncludedIndex, Term: snap.LastIncludedTerm, Hash: snap.LastIncludedHash}}
+			rn.snapConfig = snap.Configuration
+			rn.sessions = copySessions(snap.Sessions)
+			rn.commitIndex = snap.LastIncludedIndex
+			rn.lastApplied = snap.LastIncludedIndex
+		}
+		if v := st.Get(keyCurrentTerm); v != nil {
+			term, err := strconv.Atoi(string(v))
+			if err != nil {
+				return fmt.Errorf("corrupt current term: %w", err)
+			}
+			rn.currentTerm = term
+		}
+		if v := st.Get(keyVotedFor); v != nil {
+			rn.votedFor = string(v)
+		}
+
+		c := rn.bucket(tx, bucketLog).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			var entry LogEntry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return fmt.Errorf("corrupt log entry %x: %w", k, err)
+			}
+			if entry.Index <= rn.snapshotIndex() {
+				continue
+			}
+			if entry.Index != rn.lastLogIndex()+1 {
+				return fmt.Errorf("log gap: expected index %d, found %d", rn.lastLogIndex()+1, entry.Index)
+			}
+			rn.log = append(rn.log, entry)
+		}
+		return nil
+	})
+}
+
+// loadNodeKey returns the node's ed25519 signing key, generating and storing one on first
+// start so the node keeps its identity across restarts. All groups sharing a database
+// share the key, which lives in the top-level state bucket.
+func (rn *RaftNode) loadNodeKey() (ed25519.PrivateKey, error) {
+	var key ed25519.PrivateKey
+	err := rn.db.Update(func(tx *bolt.Tx) error {
+		st, err := tx.CreateBucketIfNotExists(bucketState)
+		if err != nil {
+			return err
+		}
+		if seed := st.Get(keyNodeKey); seed != nil {
+			if len(seed) != ed25519.SeedSize {
+				return fmt.Errorf("corrupt node key")
+			}
+			key = ed25519.NewKeyFromSeed(seed)
+			return nil
+		}
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return err
+		}
+		key = priv
+		return st.Put(keyNodeKey, priv.Seed())
+	})
+	return key, err
+}
+
+// saveHardState durably records currentTerm and votedFor. Caller holds rn.mutex.
+func (rn *RaftNode) saveHardState() error {
+	return rn.db.Update(func(tx *bolt.Tx) error {
+		st := rn.bucket(tx, bucketState)
+		if err := st.Put(keyCurrentTerm, []byte(strconv.Itoa(rn.currentTerm))); err != nil {
+			return err
+		}
+		return st.Put(keyVotedFor, []byte(rn.votedFor))
+	})
+}
+
+// saveLogEntries deletes every stored entry at or after fromIndex and then writes
+// entries in a single transaction. Caller holds rn.mutex.
+func (rn *RaftNode) saveLogEntries(fromIndex int, entries []LogEntry) error {
+	return rn.db.Update(func(tx *bolt.Tx) error {
+		b := rn.bucket(tx, bucketLog)
+		var stale [][]byte
+		c := b.Cursor()
+		for k, _ := c.Seek(indexKey(fromIndex)); k != nil; k, _ = c.Next() {
+			stale = append(stale, append([]byte(nil), k...))
+		}
+		for _, k := range stale {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		for _, entry := range entries {
+			data, err := json.Marshal(entry)
+			if err != nil {
+				return err
+			}
+			if err := b.Put(indexKey(entry.Index), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// saveSnapshot stores snap as the latest snapshot and removes the log entries it covers.
+// With discardLog set the whole stored log is dropped instead, for when a snapshot from
+// the leader conflicts with our log. Caller holds rn.mutex.
+func (rn *RaftNode) saveSnapshot(snap Snapshot, discardLog bool) error {
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	return rn.db.Update(func(tx *bolt.Tx) error {
+		if err := rn.bucket(tx, bucketSnapshot).Put(keySnapshot, data); err != nil {
+			return err
+		}
+		b := rn.bucket(tx, bucketLog)
+		var stale [][]byte
+		c := b.Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			if !discardLog && binary.BigEndian.Uint64(k) > uint64(snap.LastIncludedIndex) {
+				break
+			}
+			stale = append(stale, append([]byte(nil), k...))
+		}
+		for _, k := range stale {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// loadSnapshot reads the latest stored snapshot; ok is false if none has been taken yet.
+func (rn *RaftNode) loadSnapshot() (snap Snapshot, ok bool, err error) {
+	err = rn.db.View(func(tx *bolt.Tx) error {
+		v := rn.bucket(tx, bucketSnapshot).Get(keySnapshot)
+		if v == nil {
+			return nil
+		}
+		ok = true
+		return json.Unmarshal(v, &snap)
+	})
+	return snap, ok, err
+}
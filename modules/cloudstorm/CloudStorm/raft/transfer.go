@@ -0,0 +1,175 @@
+// -------------------- raft/transfer.go --------------------
+package raft
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// defaultTransferTimeout bounds a leadership transfer, catch-up included.
+const defaultTransferTimeout = 2 * time.Second
+
+var (
+	// ErrLeadershipTransferInProgress is returned for proposals made while the leader is
+	// handing off leadership, and for a second concurrent transfer.
+	ErrLeadershipTransferInProgress = errors.New("leadership transfer in progress")
+	// ErrTransferTimeout is returned when the target did not take over in time; the old
+	// leader then resumes accepting proposals.
+	ErrTransferTimeout = errors.New("timed out transferring leadership")
+)
+
+// ------------------------------------------------------------------------
+// Leadership Transfer (TimeoutNow)
+// ------------------------------------------------------------------------
+
+// TimeoutNowRequest tells a caught-up follower to start an election immediately.
+type TimeoutNowRequest struct {
+	Term          int    `json:"term"`
+	LeaderID      string `json:"leader_id"`
+	ServiceID     string `json:"service_id"`
+	ProofKeyHash  string `json:"proof_key_hash"`
+	CombinedProof string `json:"combined_proof"`
+	GroupID       string `json:"group_id,omitempty"`
+}
+
+type TimeoutNowResponse struct {
+	Term int `json:"term"`
+}
+
+// TransferLeadership hands leadership to the voting member at target (the most
+// up-to-date peer if target is empty), e.g. before draining this host. The leader stops
+// accepting proposals and serving reads from its lease, brings the target's log up to
+// date, and sends it TimeoutNow so it starts an election it is certain to win. It
+// returns once this node has stepped down.
+func (rn *RaftNode) TransferLeadership(target string) error {
+	rn.mutex.Lock()
+	if rn.state != Leader {
+		rn.mutex.Unlock()
+		return ErrNotLeader
+	}
+	if rn.transferTarget != "" {
+		rn.mutex.Unlock()
+		return ErrLeadershipTransferInProgress
+	}
+	if target == "" {
+		target = rn.mostUpToDatePeer()
+	}
+	if target == "" || target == rn.addr || !rn.isVoter(target) {
+		rn.mutex.Unlock()
+		return fmt.Errorf("%q is not a voting peer", target)
+	}
+	rn.transferTarget = target
+	term := rn.currentTerm
+	rn.mutex.Unlock()
+
+	log.Printf("Node %s transferring leadership to %s", rn.id, target)
+	err := rn.transferTo(target, term, time.Now().Add(defaultTransferTimeout))
+	if err != nil {
+		rn.mutex.Lock()
+		if rn.state == Leader && rn.currentTerm == term {
+			rn.transferTarget = "" // resume normal operation
+		}
+		rn.mutex.Unlock()
+		log.Printf("Leadership transfer to %s failed: %v", target, err)
+	}
+	return err
+}
+
+// transferTo runs the transfer to target for a leader of term.
+func (rn *RaftNode) transferTo(target string, term int, deadline time.Time) error {
+	// With proposals blocked, once the target matches our last index it cannot lose the
+	// election on log up-to-dateness.
+	for {
+		rn.mutex.Lock()
+		if rn.state != Leader || rn.currentTerm != term {
+			rn.mutex.Unlock()
+			return ErrLeadershipLost
+		}
+		caughtUp := rn.matchIndex[target] == rn.lastLogIndex()
+		rn.mutex.Unlock()
+		if caughtUp {
+			break
+		}
+		if time.Now().After(deadline) {
+			return ErrTransferTimeout
+		}
+		if !rn.replicateTo(target, term) {
+			time.Sleep(rn.heartbeat)
+		}
+	}
+
+	rn.mutex.Lock()
+	// The target may win even if the request seems lost, so the lease cannot be trusted
+	// again in this term (see leaseValid).
+	rn.timeoutNowTerm = term
+	req := TimeoutNowRequest{Term: term, LeaderID: rn.id}
+	req.ServiceID, req.ProofKeyHash, req.CombinedProof = rn.signProof(proofTimeoutNow, term)
+	rn.mutex.Unlock()
+	resp, err := rn.transport.TimeoutNow(target, req)
+	if err != nil {
+		return fmt.Errorf("TimeoutNow to %s failed: %w", target, err)
+	}
+	rn.mutex.Lock()
+	if resp.Term > rn.currentTerm {
+		rn.becomeFollower(resp.Term)
+	}
+	rn.mutex.Unlock()
+
+	// The target's vote request, carrying a newer term, makes us step down.
+	ticker := time.NewTicker(rn.heartbeat)
+	defer ticker.Stop()
+	for {
+		rn.mutex.Lock()
+		done := rn.state != Leader || rn.currentTerm != term
+		rn.mutex.Unlock()
+		if done {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return ErrTransferTimeout
+		}
+		<-ticker.C
+	}
+}
+
+// mostUpToDatePeer returns the voting peer with the highest matchIndex.
+// Caller holds rn.mutex.
+func (rn *RaftNode) mostUpToDatePeer() string {
+	best, bestMatch := "", -1
+	for _, p := range rn.peers {
+		if rn.isVoter(p) && rn.matchIndex[p] > bestMatch {
+			best, bestMatch = p, rn.matchIndex[p]
+		}
+	}
+	return best
+}
+
+// HandleTimeoutNow implements the receiver side of TimeoutNow: a voter starts an election
+// right away, skipping the pre-vote and the election timeout.
+func (rn *RaftNode) HandleTimeoutNow(req TimeoutNowRequest) TimeoutNowResponse {
+	rn.mutex.Lock()
+	defer rn.mutex.Unlock()
+
+	if err := rn.checkProof(proofTimeoutNow, req.LeaderID, req.Term, req.ServiceID, req.ProofKeyHash, req.CombinedProof); err != nil {
+		rn.rejectRPC(proofTimeoutNow, req.LeaderID, err)
+		return TimeoutNowResponse{Term: rn.currentTerm}
+	}
+
+	if req.Term < rn.currentTerm {
+		return TimeoutNowResponse{Term: rn.currentTerm}
+	}
+	rn.becomeFollower(req.Term)
+	if !rn.isVoter(rn.addr) {
+		return TimeoutNowResponse{Term: rn.currentTerm}
+	}
+	log.Printf("Node %s starting election at the request of leader %s", rn.id, req.LeaderID)
+	// Start the term here rather than in runCandidate, so that a heartbeat from the old
+	// leader racing with this call cannot turn us back into its follower.
+	if rn.startElection() {
+		rn.transferElection = true
+		rn.resetElectionTimer() // wakes runFollower
+	}
+	return TimeoutNowResponse{Term: rn.currentTerm}
+}
@@ -0,0 +1,85 @@
+// -------------------- raft/transfer_test.go --------------------
+package raft
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// TestTransferLeadership hands leadership to a follower and checks that reads move with
+// it: the old leader refuses them and the new one serves them.
+func TestTransferLeadership(t *testing.T) {
+	c := newLeaseCluster(t, nil)
+	old := c.leader()
+	target, _ := c.followers(old)
+	if err := old.PostJob(Job{ID: "j"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := old.TransferLeadership(target.id); err != nil {
+		t.Fatalf("transfer: %v", err)
+	}
+	if next := c.leader(); next != target {
+		t.Fatalf("leadership went to %s, want %s", next.id, target.id)
+	}
+	if _, err := old.ReadIndex(time.Second); !errors.Is(err, ErrNotLeader) {
+		t.Fatalf("read on the old leader: got %v, want ErrNotLeader", err)
+	}
+	if _, err := target.ReadIndex(time.Second); err != nil {
+		t.Fatalf("read on the new leader: %v", err)
+	}
+	if _, ok := target.GetJob("j"); !ok {
+		t.Fatal("the new leader's read misses a job committed before the transfer")
+	}
+}
+
+// loseTimeoutNow is a Transport that delivers TimeoutNow but loses its reply, running
+// then first.
+type loseTimeoutNow struct {
+	Transport
+	then func()
+}
+
+func (t *loseTimeoutNow) TimeoutNow(peer string, req TimeoutNowRequest) (TimeoutNowResponse, error) {
+	t.Transport.TimeoutNow(peer, req)
+	t.then()
+	return TimeoutNowResponse{}, ErrUnreachable
+}
+
+// TestTransferReadsAfterLostTimeoutNow loses the reply to TimeoutNow, so the transfer
+// fails while the target takes over, and checks that the old leader, cut off from the
+// others, does not fall back to serving reads from its lease.
+func TestTransferReadsAfterLostTimeoutNow(t *testing.T) {
+	// Whichever node leads cuts itself off once it has sent TimeoutNow. The transports
+	// are wrapped before the nodes start, as they are used without the node's lock,
+	// and unwrapped from their instrumentation, which SetTransport adds again.
+	var c *testCluster
+	c = newLeaseCluster(t, func(rn *RaftNode) {
+		id := rn.id
+		inner := rn.transport.(instrumentedTransport).Transport
+		rn.SetTransport(&loseTimeoutNow{Transport: inner, then: func() {
+			var rest []string
+			for _, other := range c.ids {
+				if other != id {
+					rest = append(rest, other)
+				}
+			}
+			c.net.Partition([]string{id}, rest)
+		}})
+	})
+	old := c.leader()
+	target, other := c.followers(old)
+	if _, err := old.ReadIndex(time.Second); err != nil {
+		t.Fatalf("read before the transfer: %v", err)
+	}
+
+	if err := old.TransferLeadership(target.id); err == nil {
+		t.Fatal("transfer succeeded without a reply to TimeoutNow")
+	}
+	if _, err := old.ReadIndex(testReadLease / 2); err == nil {
+		t.Fatal("read served from the lease after TimeoutNow was sent")
+	}
+	if next := c.leader(target.id, other.id); next != target {
+		t.Fatalf("leadership went to %s, want %s", next.id, target.id)
+	}
+}
@@ -0,0 +1,408 @@
+// -------------------- raft/transport.go --------------------
+package raft
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// defaultRPCTimeout bounds a single RPC attempt over HTTP.
+const defaultRPCTimeout = 100 * time.Millisecond
+
+// ------------------------------------------------------------------------
+// Transport Interface
+// ------------------------------------------------------------------------
+
+// Transport carries outbound raft RPCs to a peer, identified by its member address.
+type Transport interface {
+	RequestVote(peer string, req VoteRequest) (VoteResponse, error)
+	AppendEntries(peer string, req AppendEntriesRequest) (AppendEntriesResponse, error)
+	InstallSnapshot(peer string, req InstallSnapshotRequest) (InstallSnapshotResponse, error)
+	TimeoutNow(peer string, req TimeoutNowRequest) (TimeoutNowResponse, error)
+	ForwardJob(peer string, req JobForwardRequest) (JobForwardResponse, error)
+}
+
+// RPCHandler is the receiving side of a Transport; *RaftNode implements it.
+type RPCHandler interface {
+	HandleVoteRequest(req VoteRequest) VoteResponse
+	HandleAppendEntries(req AppendEntriesRequest) AppendEntriesResponse
+	HandleInstallSnapshot(req InstallSnapshotRequest) InstallSnapshotResponse
+	HandleTimeoutNow(req TimeoutNowRequest) TimeoutNowResponse
+	HandleForwardJob(req JobForwardRequest) JobForwardResponse
+}
+
+// ------------------------------------------------------------------------
+// HTTP(S) Transport (multi-attempt with local proof check)
+// ------------------------------------------------------------------------
+
+// HTTPTransport posts JSON RPCs to peerURL+"/requestVote" etc. (see RaftNode.Handler),
+// reusing pooled connections and the supplied TLS configuration.
+type HTTPTransport struct {
+	client         *http.Client
+	snapshotClient *http.Client
+	attempts       int
+	retryDelay     time.Duration
+}
+
+// NewHTTPTransport builds a transport whose connections use tlsCfg (nil for plain HTTP)
+// and whose individual attempts time out after timeout. Snapshots get a longer budget.
+func NewHTTPTransport(tlsCfg *tls.Config, timeout time.Duration) *HTTPTransport {
+	rt := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		TLSClientConfig:     tlsCfg,
+		MaxIdleConnsPerHost: 4,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	return &HTTPTransport{
+		client:         &http.Client{Timeout: timeout, Transport: rt},
+		snapshotClient: &http.Client{Timeout: 50 * timeout, Transport: rt},
+		attempts:       3,
+		retryDelay:     timeout,
+	}
+}
+
+// RequestVote sends a vote request to peer.
+func (t *HTTPTransport) RequestVote(peer string, req VoteRequest) (VoteResponse, error) {
+	var resp VoteResponse
+	if err := t.withProof(&req.ServiceID, &req.ProofKeyHash, &req.CombinedProof); err != nil {
+		return resp, err
+	}
+	err := t.post(t.client, peer+"/requestVote", req, &resp)
+	return resp, err
+}
+
+// AppendEntries sends an AppendEntries (or heartbeat) request to peer.
+func (t *HTTPTransport) AppendEntries(peer string, req AppendEntriesRequest) (AppendEntriesResponse, error) {
+	var resp AppendEntriesResponse
+	if err := t.withProof(&req.ServiceID, &req.ProofKeyHash, &req.CombinedProof); err != nil {
+		return resp, err
+	}
+	err := t.post(t.client, peer+"/appendEntries", req, &resp)
+	return resp, err
+}
+
+// InstallSnapshot sends the leader's snapshot to peer.
+func (t *HTTPTransport) InstallSnapshot(peer string, req InstallSnapshotRequest) (InstallSnapshotResponse, error) {
+	var resp InstallSnapshotResponse
+	if err := t.withProof(&req.ServiceID, &req.ProofKeyHash, &req.CombinedProof); err != nil {
+		return resp, err
+	}
+	err := t.post(t.snapshotClient, peer+"/installSnapshot", req, &resp)
+	return resp, err
+}
+
+// TimeoutNow asks peer to start an election immediately (leadership transfer).
+func (t *HTTPTransport) TimeoutNow(peer string, req TimeoutNowRequest) (TimeoutNowResponse, error) {
+	var resp TimeoutNowResponse
+	if err := t.withProof(&req.ServiceID, &req.ProofKeyHash, &req.CombinedProof); err != nil {
+		return resp, err
+	}
+	err := t.post(t.client, peer+"/timeoutNow", req, &resp)
+	return resp, err
+}
+
+// ForwardJob hands a worker's job transition to the leader at peer. The leader answers
+// once the entry is applied, so the call gets the snapshot budget, and it is not retried
+// since the first attempt may have been applied.
+func (t *HTTPTransport) ForwardJob(peer string, req JobForwardRequest) (JobForwardResponse, error) {
+	var resp JobForwardResponse
+	if err := t.withProof(&req.ServiceID, &req.ProofKeyHash, &req.CombinedProof); err != nil {
+		return resp, err
+	}
+	data, err := json.Marshal(req)
+	if err != nil {
+		return resp, err
+	}
+	err = t.postOnce(t.snapshotClient, peer+"/forwardJob", data, &resp)
+	return resp, err
+}
+
+// withProof leaves a proof signed by the node as it is (see proof.go). A node without a
+// consensus identity sends the local Trinity identity with an unsigned combined proof,
+// checked before anything is sent; only receivers that allow insecure proofs accept it.
+func (t *HTTPTransport) withProof(serviceID, proofKeyHash, combinedProof *string) error {
+	if *combinedProof != "" {
+		return nil
+	}
+	if *serviceID == "" || *proofKeyHash == "" {
+		*serviceID, *proofKeyHash = getLocalConsensusProof()
+	}
+	*combinedProof = CombineProof(*serviceID, *proofKeyHash)
+	return ValidateConsensusProof(*serviceID, *proofKeyHash, *combinedProof)
+}
+
+// post sends body as JSON to url, retrying up to t.attempts times, and decodes the reply.
+func (t *HTTPTransport) post(client *http.Client, url string, body, out interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	var finalErr error
+	for i := 0; i < t.attempts; i++ {
+		if i > 0 {
+			time.Sleep(t.retryDelay)
+		}
+		if finalErr = t.postOnce(client, url, data, out); finalErr == nil {
+			return nil
+		}
+	}
+	return finalErr
+}
+
+func (t *HTTPTransport) postOnce(client *http.Client, url string, data []byte, out interface{}) error {
+	httpReq, err := http.NewRequest("POST", url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// ------------------------------------------------------------------------
+// In-Memory Transport (for multi-node clusters inside `go test`)
+// ------------------------------------------------------------------------
+
+// ErrUnreachable is returned by the in-memory transport when a message is dropped,
+// partitioned away, or addressed to a node that is not connected.
+var ErrUnreachable = errors.New("peer unreachable")
+
+// inmemCall is one RPC travelling over an InmemNetwork inbox channel.
+type inmemCall struct {
+	req   interface{}
+	reply chan interface{}
+}
+
+// inmemEndpoint is a connected node: its inbox and a channel closed on Disconnect.
+type inmemEndpoint struct {
+	inbox chan inmemCall
+	done  chan struct{}
+}
+
+// InmemNetwork connects RaftNodes in one process through per-node inbox channels, with
+// hooks to partition the network and drop messages.
+type InmemNetwork struct {
+	mutex    sync.Mutex
+	nodes    map[string]inmemEndpoint
+	cut      map[[2]string]bool // directed links that drop everything
+	dropRate float64
+	rng      *rand.Rand
+	timeout  time.Duration
+}
+
+// NewInmemNetwork creates an empty network; seed makes message drops reproducible.
+func NewInmemNetwork(seed int64) *InmemNetwork {
+	return &InmemNetwork{
+		nodes:   make(map[string]inmemEndpoint),
+		cut:     make(map[[2]string]bool),
+		rng:     rand.New(rand.NewSource(seed)),
+		timeout: time.Second,
+	}
+}
+
+// Connect attaches a handler at addr and starts serving its inbox.
+func (n *InmemNetwork) Connect(addr string, h RPCHandler) {
+	ep := inmemEndpoint{inbox: make(chan inmemCall, 64), done: make(chan struct{})}
+	n.mutex.Lock()
+	if old, ok := n.nodes[addr]; ok {
+		close(old.done)
+	}
+	n.nodes[addr] = ep
+	n.mutex.Unlock()
+
+	go func() {
+		for {
+			select {
+			case <-ep.done:
+				return
+			case call := <-ep.inbox:
+				switch req := call.req.(type) {
+				case VoteRequest:
+					call.reply <- h.HandleVoteRequest(req)
+				case AppendEntriesRequest:
+					call.reply <- h.HandleAppendEntries(req)
+				case InstallSnapshotRequest:
+					call.reply <- h.HandleInstallSnapshot(req)
+				case TimeoutNowRequest:
+					call.reply <- h.HandleTimeoutNow(req)
+				case JobForwardRequest:
+					// Waits for a commit, which needs this inbox to keep moving.
+					go func(call inmemCall) { call.reply <- h.HandleForwardJob(req) }(call)
+				}
+			}
+		}
+	}()
+}
+
+// Disconnect detaches addr, as if the node had crashed.
+func (n *InmemNetwork) Disconnect(addr string) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if ep, ok := n.nodes[addr]; ok {
+		close(ep.done)
+		delete(n.nodes, addr)
+	}
+}
+
+// Partition splits the given addresses into groups that cannot reach each other.
+// Addresses not listed keep their existing links.
+func (n *InmemNetwork) Partition(groups ...[]string) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	for i, a := range groups {
+		for j, b := range groups {
+			if i == j {
+				continue
+			}
+			for _, from := range a {
+				for _, to := range b {
+					n.cut[[2]string{from, to}] = true
+				}
+			}
+		}
+	}
+}
+
+// Cut drops all traffic from one address to another (a one-way partition).
+func (n *InmemNetwork) Cut(from, to string) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.cut[[2]string{from, to}] = true
+}
+
+// Heal removes all partitions and cuts.
+func (n *InmemNetwork) Heal() {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.cut = make(map[[2]string]bool)
+}
+
+// SetDropRate makes each request (and each reply) be lost with probability p.
+func (n *InmemNetwork) SetDropRate(p float64) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.dropRate = p
+}
+
+// Transport returns the Transport a node at addr uses to reach the rest of the network.
+func (n *InmemNetwork) Transport(addr string) Transport {
+	return &InmemTransport{network: n, local: addr}
+}
+
+// route returns the endpoint for a message from -> to, or false if it should be lost.
+func (n *InmemNetwork) route(from, to string) (inmemEndpoint, bool) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	ep, ok := n.nodes[to]
+	if !ok || n.cut[[2]string{from, to}] || n.drop() {
+		return inmemEndpoint{}, false
+	}
+	return ep, true
+}
+
+// delivered reports whether a reply from -> to survives. Caller does not hold n.mutex.
+func (n *InmemNetwork) delivered(from, to string) bool {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return !n.cut[[2]string{from, to}] && !n.drop()
+}
+
+// drop rolls the dice for a lossy link. Caller holds n.mutex.
+func (n *InmemNetwork) drop() bool {
+	return n.dropRate > 0 && n.rng.Float64() < n.dropRate
+}
+
+// call delivers req from -> to and waits for the handler's reply.
+func (n *InmemNetwork) call(from, to string, req interface{}) (interface{}, error) {
+	ep, ok := n.route(from, to)
+	if !ok {
+		return nil, ErrUnreachable
+	}
+	timeout := time.NewTimer(n.timeout)
+	defer timeout.Stop()
+
+	c := inmemCall{req: req, reply: make(chan interface{}, 1)}
+	select {
+	case ep.inbox <- c:
+	case <-ep.done:
+		return nil, ErrUnreachable
+	case <-timeout.C:
+		return nil, ErrUnreachable
+	}
+	select {
+	case resp := <-c.reply:
+		if !n.delivered(to, from) {
+			return nil, ErrUnreachable
+		}
+		return resp, nil
+	case <-ep.done:
+		return nil, ErrUnreachable
+	case <-timeout.C:
+		return nil, ErrUnreachable
+	}
+}
+
+// InmemTransport is one node's view of an InmemNetwork.
+type InmemTransport struct {
+	network *InmemNetwork
+	local   string
+}
+
+// RequestVote sends a vote request to peer over the in-memory network.
+func (t *InmemTransport) RequestVote(peer string, req VoteRequest) (VoteResponse, error) {
+	resp, err := t.network.call(t.local, peer, req)
+	if err != nil {
+		return VoteResponse{}, err
+	}
+	return resp.(VoteResponse), nil
+}
+
+// AppendEntries sends an AppendEntries request to peer over the in-memory network.
+func (t *InmemTransport) AppendEntries(peer string, req AppendEntriesRequest) (AppendEntriesResponse, error) {
+	resp, err := t.network.call(t.local, peer, req)
+	if err != nil {
+		return AppendEntriesResponse{}, err
+	}
+	return resp.(AppendEntriesResponse), nil
+}
+
+// InstallSnapshot sends a snapshot to peer over the in-memory network.
+func (t *InmemTransport) InstallSnapshot(peer string, req InstallSnapshotRequest) (InstallSnapshotResponse, error) {
+	resp, err := t.network.call(t.local, peer, req)
+	if err != nil {
+		return InstallSnapshotResponse{}, err
+	}
+	return resp.(InstallSnapshotResponse), nil
+}
+
+// TimeoutNow asks peer to start an election over the in-memory network.
+func (t *InmemTransport) TimeoutNow(peer string, req TimeoutNowRequest) (TimeoutNowResponse, error) {
+	resp, err := t.network.call(t.local, peer, req)
+	if err != nil {
+		return TimeoutNowResponse{}, err
+	}
+	return resp.(TimeoutNowResponse), nil
+}
+
+// ForwardJob hands a job transition to the leader at peer over the in-memory network.
+func (t *InmemTransport) ForwardJob(peer string, req JobForwardRequest) (JobForwardResponse, error) {
+	resp, err := t.network.call(t.local, peer, req)
+	if err != nil {
+		return JobForwardResponse{}, err
+	}
+	return resp.(JobForwardResponse), nil
+}
@@ -0,0 +1,231 @@
+// -------------------- raft/transport_test.go --------------------
+package raft
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCluster is a cluster of started RaftNodes on an InmemNetwork, each proving its
+// identity to the others with signed consensus proofs. Node IDs double as addresses.
+type testCluster struct {
+	t     *testing.T
+	net   *InmemNetwork
+	ids   []string // the nodes the cluster was bootstrapped with
+	nodes map[string]*RaftNode
+	dir   string
+	dims  []IBTDimension
+}
+
+// newTestCluster creates and starts a cluster of the given nodes, stopping them when
+// the test ends. configure, if set, runs on each node before it starts.
+func newTestCluster(t *testing.T, ids []string, dims []IBTDimension, configure func(rn *RaftNode)) *testCluster {
+	t.Helper()
+	c := &testCluster{t: t, net: NewInmemNetwork(1), ids: ids, nodes: make(map[string]*RaftNode), dir: t.TempDir(), dims: dims}
+	for _, id := range ids {
+		c.newNode(id, ids)
+	}
+	for _, id := range ids {
+		if configure != nil {
+			configure(c.nodes[id])
+		}
+		c.nodes[id].Start()
+	}
+	t.Cleanup(func() {
+		for _, rn := range c.nodes {
+			rn.Stop()
+		}
+	})
+	return c
+}
+
+// newNode creates node id, bootstrapped with peers, on the cluster's network and makes
+// it and the other nodes trust each other's keys. The node is stopped with the cluster.
+func (c *testCluster) newNode(id string, peers []string) *RaftNode {
+	c.t.Helper()
+	rn, err := NewRaftNode(id, peers, filepath.Join(c.dir, id+".db"), nil, c.dims, false)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	rn.SetTransport(c.net.Transport(id))
+	rn.SetConsensusIdentity(testHash("cloudstorm-test-service"), testHash(id))
+	c.net.Connect(id, rn)
+	c.nodes[id] = rn
+	for _, other := range c.nodes {
+		rn.SetPeerKey(other.id, other.PublicKey())
+		other.SetPeerKey(id, rn.PublicKey())
+	}
+	return rn
+}
+
+func testHash(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// waitFor polls cond until it holds, failing the test after timeout.
+func waitFor(t *testing.T, timeout time.Duration, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// leader waits until the given nodes (all of them if none) agree on a leader among
+// themselves and returns it.
+func (c *testCluster) leader(ids ...string) *RaftNode {
+	c.t.Helper()
+	if len(ids) == 0 {
+		ids = c.ids
+	}
+	var leader *RaftNode
+	waitFor(c.t, 5*time.Second, "a leader", func() bool {
+		leader = nil
+		for _, id := range ids {
+			if rn := c.nodes[id]; rn.getState() == Leader {
+				leader = rn
+			}
+		}
+		if leader == nil {
+			return false
+		}
+		for _, id := range ids {
+			if c.nodes[id].Leader() != leader.id {
+				return false
+			}
+		}
+		return true
+	})
+	return leader
+}
+
+// hasJob reports whether every one of the given nodes has applied job jobID.
+func (c *testCluster) hasJob(jobID string, ids ...string) bool {
+	for _, id := range ids {
+		if _, ok := c.nodes[id].GetJob(jobID); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// TestInmemCluster elects a leader, replicates through it, partitions it into a minority
+// and checks that the majority moves on and the cluster converges once healed.
+func TestInmemCluster(t *testing.T) {
+	ids := []string{"n1", "n2", "n3", "n4", "n5"}
+	c := newTestCluster(t, ids, nil, nil)
+
+	old := c.leader()
+	if err := old.PostJob(Job{ID: "before"}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, 5*time.Second, "replication to every node", func() bool { return c.hasJob("before", ids...) })
+
+	// Cut the leader and one follower off from the other three.
+	var minority, majority []string
+	minority = append(minority, old.id)
+	for _, id := range ids {
+		if id == old.id {
+			continue
+		}
+		if len(minority) < 2 {
+			minority = append(minority, id)
+		} else {
+			majority = append(majority, id)
+		}
+	}
+	c.net.Partition(minority, majority)
+
+	if _, err := old.Propose(CmdPostJob, Job{ID: "lost", Status: JobQueued}, 500*time.Millisecond).Wait(); err == nil {
+		t.Fatal("a leader cut off from the majority committed an entry")
+	}
+	next := c.leader(majority...)
+	if next.Status().Term <= old.Status().Term {
+		t.Fatalf("new leader %s has term %d, not above the old leader's %d", next.id, next.Status().Term, old.Status().Term)
+	}
+	if err := next.PostJob(Job{ID: "during"}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, 5*time.Second, "replication within the majority", func() bool { return c.hasJob("during", majority...) })
+	if c.hasJob("during", minority[1]) {
+		t.Fatal("an entry crossed the partition")
+	}
+
+	c.net.Heal()
+	healed := c.leader()
+	if err := healed.PostJob(Job{ID: "after"}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, 5*time.Second, "convergence after healing", func() bool {
+		return c.hasJob("during", ids...) && c.hasJob("after", ids...)
+	})
+	for _, id := range ids {
+		if _, ok := c.nodes[id].GetJob("lost"); ok {
+			t.Fatalf("%s applied the entry its partitioned leader never committed", id)
+		}
+	}
+}
+
+// TestPartitionedNodeKeepsTerm isolates a follower for many election timeouts and checks
+// that pre-vote keeps it from raising its term, so healing the partition leaves the
+// leader and term alone.
+func TestPartitionedNodeKeepsTerm(t *testing.T) {
+	c := newTestCluster(t, []string{"n1", "n2", "n3"}, nil, nil)
+	leader := c.leader()
+	f := c.follower(leader)
+	term := leader.Status().Term
+	var rest []string
+	for _, id := range c.ids {
+		if id != f.id {
+			rest = append(rest, id)
+		}
+	}
+
+	c.net.Partition([]string{f.id}, rest)
+	time.Sleep(10 * f.electionTimeout)
+	if got := f.Status().Term; got != term {
+		t.Fatalf("isolated follower moved from term %d to %d", term, got)
+	}
+	c.net.Heal()
+	time.Sleep(5 * f.electionTimeout)
+	if next := c.leader(); next != leader {
+		t.Fatalf("leadership moved from %s to %s after healing", leader.id, next.id)
+	}
+	for _, rn := range c.nodes {
+		if got := rn.Status().Term; got != term {
+			t.Fatalf("%s is at term %d after healing, want %d", rn.id, got, term)
+		}
+	}
+}
+
+// TestInmemDrops checks that every job posted over a lossy network reaches every node,
+// retrying posts whose outcome the loss left open.
+func TestInmemDrops(t *testing.T) {
+	ids := []string{"n1", "n2", "n3"}
+	c := newTestCluster(t, ids, nil, nil)
+	c.net.SetDropRate(0.2)
+	jobs := []string{"a", "b", "c", "d"}
+	for _, id := range jobs {
+		waitFor(t, 20*time.Second, "post of "+id, func() bool {
+			err := c.leader().PostJob(Job{ID: id})
+			return err == nil || errors.Is(err, ErrJobExists)
+		})
+	}
+	c.net.SetDropRate(0)
+	waitFor(t, 5*time.Second, "replication after losses", func() bool {
+		for _, id := range jobs {
+			if !c.hasJob(id, ids...) {
+				return false
+			}
+		}
+		return true
+	})
+}
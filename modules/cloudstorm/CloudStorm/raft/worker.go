@@ -0,0 +1,515 @@
+// -------------------- raft/worker.go --------------------
+package raft
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultWorkerConcurrency is how many jobs a Worker runs at once unless configured.
+	defaultWorkerConcurrency = 4
+	// workerPollInterval is how often a Worker rescans the jobs besides reacting to
+	// EventJobUpdated, which catches retries whose backoff has passed, jobs restored from
+	// a snapshot and events dropped from a full buffer.
+	workerPollInterval = time.Second
+	// jobHeartbeatInterval is how often a running job's lease is renewed.
+	jobHeartbeatInterval = jobLease / 3
+
+	proofForwardJob = "forward_job"
+)
+
+// ErrNotForwardable is returned by a leader for a forwarded command other than a
+// worker's job transition, or one made on behalf of another worker.
+var ErrNotForwardable = errors.New("command cannot be forwarded")
+
+// JobHandler runs a job and returns a reference to its result, such as an IPFS CID. ctx
+// is canceled when the worker loses the job's lease or stops; the handler should give up
+// then, since the job is or will be retried elsewhere.
+type JobHandler func(ctx context.Context, job Job) (resultCID string, err error)
+
+// ------------------------------------------------------------------------
+// Job Worker
+// ------------------------------------------------------------------------
+//
+// A Worker runs the jobs assigned to its node (Job.AssignedTo) and reports the node's
+// capacity for the scheduler (see capacity.go). It watches the applied
+// jobs and, for each queued job it has a handler for, accepts the job, marks it running,
+// keeps its lease alive with heartbeats while the handler runs, and reports the outcome
+// with CompleteJob or FailJob. Every step goes through the log, so the leader's
+// lease-expiry scan (see jobs.go) returns the job to the queue if this node dies midway.
+//
+// Proposals only succeed on the leader, so a worker on a follower forwards its
+// transitions there (see HandleForwardJob). Concurrency is bounded in total and,
+// optionally, per job type; jobs over the limits wait in the queue for a free slot.
+//
+// A job the log shows as held by this node but that no handler is running, because the
+// node restarted, is failed right away rather than left to its lease.
+
+// Worker runs the jobs assigned to a node.
+type Worker struct {
+	rn *RaftNode
+
+	mutex      sync.Mutex
+	handlers   map[string]JobHandler
+	limit      int
+	typeLimits map[string]int
+	running    map[string]string             // job ID -> type, for every job being handled
+	cancels    map[string]context.CancelFunc // job ID -> cancels its handler
+	probe      CapacityProbe
+	started    bool
+	stopChan   chan struct{}
+	wg         sync.WaitGroup
+}
+
+// NewWorker creates a worker for rn's jobs. Register handlers with Handle, then Start it.
+func NewWorker(rn *RaftNode) *Worker {
+	return &Worker{
+		rn:         rn,
+		handlers:   make(map[string]JobHandler),
+		limit:      defaultWorkerConcurrency,
+		typeLimits: make(map[string]int),
+		running:    make(map[string]string),
+		cancels:    make(map[string]context.CancelFunc),
+		probe:      SystemCapacity,
+		stopChan:   make(chan struct{}),
+	}
+}
+
+// Handle registers the handler for jobs of the given type, replacing any earlier one.
+func (w *Worker) Handle(jobType string, h JobHandler) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.handlers[jobType] = h
+}
+
+// SetConcurrency sets how many jobs the worker runs at once.
+func (w *Worker) SetConcurrency(n int) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.limit = n
+}
+
+// SetTypeConcurrency limits how many jobs of one type run at once, within the overall
+// limit. Zero removes the limit.
+func (w *Worker) SetTypeConcurrency(jobType string, n int) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.typeLimits[jobType] = n
+}
+
+// Start begins watching for jobs.
+func (w *Worker) Start() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.started {
+		return
+	}
+	w.started = true
+	events, cancel := w.rn.Subscribe(64)
+	w.wg.Add(2)
+	go func() {
+		defer w.wg.Done()
+		defer cancel()
+		w.run(events)
+	}()
+	go func() {
+		defer w.wg.Done()
+		w.runReports()
+	}()
+}
+
+// Stop cancels the running handlers and waits for them to return. Their jobs are not
+// reported; the leases run out and the jobs are retried.
+func (w *Worker) Stop() {
+	w.mutex.Lock()
+	select {
+	case <-w.stopChan:
+	default:
+		close(w.stopChan)
+	}
+	for _, cancel := range w.cancels {
+		cancel()
+	}
+	w.mutex.Unlock()
+	w.wg.Wait()
+}
+
+func (w *Worker) run(events <-chan Event) {
+	ticker := time.NewTicker(workerPollInterval)
+	defer ticker.Stop()
+	w.poll()
+	for {
+		select {
+		case <-w.stopChan:
+			return
+		case ev := <-events:
+			if ev.Type != EventJobUpdated {
+				continue
+			}
+		case <-ticker.C:
+		}
+		w.poll()
+	}
+}
+
+// runReports reports the node's capacity until the worker stops, retrying a failed
+// report (e.g. while no leader is known) at the poll interval.
+func (w *Worker) runReports() {
+	for {
+		wait := capacityReportInterval
+		if !w.reportCapacity() {
+			wait = workerPollInterval
+		}
+		select {
+		case <-w.stopChan:
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// poll starts every job that is ready and fits the limits, and gives up the jobs this
+// node holds without running them.
+func (w *Worker) poll() {
+	id := w.rn.id
+	now := w.rn.clock().UnixNano()
+	jobs := w.rn.ListJobs()
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].ID < jobs[j].ID })
+
+	for _, job := range jobs {
+		switch {
+		case job.Status == JobQueued && job.AssignedTo == id && job.NotBefore <= now:
+			if h, ok := w.reserve(job); ok {
+				w.spawn(job, func() { w.execute(job, h) })
+			}
+		case jobActive(job) && job.Worker == id:
+			if w.reserveOrphan(job) {
+				w.spawn(job, func() { w.abandon(job) })
+			}
+		}
+	}
+}
+
+// reserve claims a slot for job if the worker handles its type and has room.
+func (w *Worker) reserve(job Job) (JobHandler, bool) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	h, ok := w.handlers[job.Type]
+	_, busy := w.running[job.ID]
+	if !ok || busy || len(w.running) >= w.limit {
+		return nil, false
+	}
+	if n := w.typeLimits[job.Type]; n > 0 && w.countType(job.Type) >= n {
+		return nil, false
+	}
+	w.running[job.ID] = job.Type
+	return h, true
+}
+
+// reserveOrphan claims a job held by this node that no handler is running.
+func (w *Worker) reserveOrphan(job Job) bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if _, ok := w.handlers[job.Type]; !ok {
+		return false // accepted by hand, not by a worker
+	}
+	if _, ok := w.running[job.ID]; ok {
+		return false
+	}
+	w.running[job.ID] = job.Type
+	return true
+}
+
+// countType returns how many jobs of jobType are running. Caller holds w.mutex.
+func (w *Worker) countType(jobType string) int {
+	n := 0
+	for _, t := range w.running {
+		if t == jobType {
+			n++
+		}
+	}
+	return n
+}
+
+// spawn runs fn for a reserved job and releases the reservation when it returns.
+func (w *Worker) spawn(job Job, fn func()) {
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		defer func() {
+			w.mutex.Lock()
+			delete(w.running, job.ID)
+			delete(w.cancels, job.ID)
+			w.mutex.Unlock()
+		}()
+		fn()
+	}()
+}
+
+// execute runs one attempt at job: accept, start, run the handler while heartbeating,
+// then report the outcome.
+func (w *Worker) execute(job Job, h JobHandler) {
+	rn, id := w.rn, w.rn.id
+	if err := rn.submit(CmdAcceptJob, rn.jobTransition(job.ID, id)); err != nil {
+		if !errors.Is(err, ErrJobNotQueued) { // our view of the job was stale
+			log.Printf("Worker %s could not accept job %s: %v", id, job.ID, err)
+		}
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	w.mutex.Lock()
+	select {
+	case <-w.stopChan:
+		w.mutex.Unlock()
+		return
+	default:
+		w.cancels[job.ID] = cancel
+	}
+	w.mutex.Unlock()
+
+	if err := rn.StartJob(job.ID, id); err != nil {
+		log.Printf("Worker %s could not start job %s: %v", id, job.ID, err)
+		return
+	}
+	log.Printf("Worker %s running job %s (%s, attempt %d)", id, job.ID, job.Type, job.Attempts+1)
+
+	lost := make(chan struct{})
+	go w.heartbeat(ctx, job.ID, cancel, lost)
+	resultCID, err := runHandler(ctx, h, job)
+	if ctx.Err() != nil {
+		select {
+		case <-lost:
+			log.Printf("Worker %s lost the lease on job %s", id, job.ID)
+		default:
+			// Stopped: leave the job to lease expiry.
+		}
+		return
+	}
+	cancel() // ends the heartbeats before the outcome is reported
+
+	if err != nil {
+		log.Printf("Worker %s: job %s failed: %v", id, job.ID, err)
+		err = rn.FailJob(job.ID, id, err.Error())
+	} else {
+		err = rn.CompleteJob(job.ID, id, resultCID)
+	}
+	if err != nil {
+		log.Printf("Worker %s could not report the outcome of job %s: %v", id, job.ID, err)
+	}
+}
+
+// heartbeat renews the lease on a job until ctx is done, closing lost and canceling the
+// handler if the lease turns out to be gone.
+func (w *Worker) heartbeat(ctx context.Context, jobID string, cancel context.CancelFunc, lost chan struct{}) {
+	ticker := time.NewTicker(jobHeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		err := w.rn.HeartbeatJob(jobID, w.rn.id)
+		if errors.Is(err, ErrNotJobWorker) || errors.Is(err, ErrJobNotActive) {
+			close(lost)
+			cancel()
+			return
+		}
+		if err != nil {
+			log.Printf("Worker %s could not renew the lease on job %s: %v", w.rn.id, jobID, err)
+		}
+	}
+}
+
+// runHandler calls h, turning a panic into an error.
+func runHandler(ctx context.Context, h JobHandler, job Job) (resultCID string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("job handler panicked: %v", r)
+		}
+	}()
+	return h(ctx, job)
+}
+
+// abandon fails a job this node holds but does not run, so it is retried without
+// waiting for its lease.
+func (w *Worker) abandon(job Job) {
+	err := w.rn.submit(CmdFailJob, JobTransition{
+		JobID: job.ID, Worker: w.rn.id, At: w.rn.clock().UnixNano(), Error: "worker restarted",
+	})
+	if err != nil && !errors.Is(err, ErrJobNotActive) && !errors.Is(err, ErrNotJobWorker) {
+		log.Printf("Worker %s could not give up job %s: %v", w.rn.id, job.ID, err)
+	}
+}
+
+// ------------------------------------------------------------------------
+// Forwarding Worker Commands to the Leader
+// ------------------------------------------------------------------------
+
+// JobForwardRequest carries a worker's command (a job transition or capacity report) to
+// the leader, which proposes it. ClientID and Sequence tag it with one of the sending
+// node's sessions, so a retry is applied only once.
+type JobForwardRequest struct {
+	Term          int             `json:"term"`
+	NodeID        string          `json:"node_id"`
+	Type          string          `json:"type"`
+	Command       json.RawMessage `json:"command"`
+	ClientID      string          `json:"client_id,omitempty"`
+	Sequence      uint64          `json:"sequence,omitempty"`
+	ServiceID     string          `json:"service_id"`
+	ProofKeyHash  string          `json:"proof_key_hash"`
+	CombinedProof string          `json:"combined_proof"`
+	GroupID       string          `json:"group_id,omitempty"`
+}
+
+// JobForwardResponse reports the outcome of applying a forwarded transition. Code names
+// the sentinel error, if any, so the worker can tell which it got.
+type JobForwardResponse struct {
+	Index int    `json:"index,omitempty"` // log index the command was applied at
+	Error string `json:"error,omitempty"`
+	Code  string `json:"code,omitempty"`
+}
+
+// forwardedErrors are the errors a forwarded transition may fail with that workers
+// check for.
+var forwardedErrors = []error{
+	ErrNotLeader, ErrLeadershipTransferInProgress, ErrLeadershipLost, ErrProposalTimeout,
+	ErrJobNotFound, ErrJobNotQueued, ErrJobNotActive, ErrNotJobWorker, ErrJobBackoff,
+	ErrNotForwardable, ErrSessionExpired, ErrStaleSequence,
+}
+
+// forwardedError is an error returned by the leader, wrapping the matching local sentinel.
+type forwardedError struct {
+	msg      string
+	sentinel error
+}
+
+func (e forwardedError) Error() string { return e.msg }
+func (e forwardedError) Unwrap() error { return e.sentinel }
+
+// forwardResponse encodes err for a JobForwardResponse.
+func forwardResponse(err error) JobForwardResponse {
+	if err == nil {
+		return JobForwardResponse{}
+	}
+	resp := JobForwardResponse{Error: err.Error()}
+	for _, s := range forwardedErrors {
+		if errors.Is(err, s) {
+			resp.Code = s.Error()
+			break
+		}
+	}
+	return resp
+}
+
+// err decodes the error of a JobForwardResponse.
+func (resp JobForwardResponse) err() error {
+	if resp.Error == "" {
+		return nil
+	}
+	for _, s := range forwardedErrors {
+		if resp.Code == s.Error() {
+			return forwardedError{msg: resp.Error, sentinel: s}
+		}
+	}
+	return errors.New(resp.Error)
+}
+
+// forwardedFor returns the node a forwardable command acts for, or false if the command
+// may not be proposed on a worker's behalf.
+func forwardedFor(cmdType string, command json.RawMessage) (string, bool) {
+	switch cmdType {
+	case CmdAcceptJob, CmdStartJob, CmdHeartbeatJob, CmdCompleteJob, CmdFailJob:
+		var tr JobTransition
+		if err := json.Unmarshal(command, &tr); err != nil {
+			return "", false
+		}
+		return tr.Worker, true
+	case CmdNodeCapacity:
+		var c NodeCapacity
+		if err := json.Unmarshal(command, &c); err != nil {
+			return "", false
+		}
+		return c.NodeID, true
+	case CmdJoinIBT, CmdLeaveIBT:
+		var p IBTPlacement
+		if err := json.Unmarshal(command, &p); err != nil {
+			return "", false
+		}
+		return p.NodeID, true
+	case EntryRegisterClient:
+		var r clientRegistration
+		if err := json.Unmarshal(command, &r); err != nil {
+			return "", false
+		}
+		return r.NodeID, true
+	}
+	return "", false
+}
+
+// submit proposes a worker's command through one of the node's sessions and waits for
+// it to be applied, forwarding it to the leader when this node is not the leader.
+func (rn *RaftNode) submit(cmdType string, command interface{}) error {
+	return rn.proposeAsClient(cmdType, command, true)
+}
+
+// HandleForwardJob implements the receiver side of ForwardJob: the leader proposes a
+// worker's command for the worker itself and answers once it is applied.
+func (rn *RaftNode) HandleForwardJob(req JobForwardRequest) JobForwardResponse {
+	rn.mutex.Lock()
+	if err := rn.checkProof(proofForwardJob, req.NodeID, req.Term, req.ServiceID, req.ProofKeyHash, req.CombinedProof); err != nil {
+		rn.mutex.Unlock()
+		rn.rejectRPC(proofForwardJob, req.NodeID, err)
+		return forwardResponse(err)
+	}
+	if node, ok := forwardedFor(req.Type, req.Command); !ok || node != req.NodeID {
+		rn.mutex.Unlock()
+		return forwardResponse(fmt.Errorf("%w: %s for %q from %s", ErrNotForwardable, req.Type, node, req.NodeID))
+	}
+	f := rn.proposeClientCommand(req.ClientID, req.Sequence, req.Type, req.Command)
+	rn.mutex.Unlock()
+	_, err := f.Wait()
+	resp := forwardResponse(err)
+	resp.Index = f.Index()
+	return resp
+}
+
+// proposeClientCommand proposes a node's own command on the leader, for the node's
+// session clientID if set. It stamps capacity reports and job transitions with the
+// leader's clock, which leases are expired against, and drops a join's address unless
+// the leader's configuration includes it.
+// Caller holds rn.mutex.
+func (rn *RaftNode) proposeClientCommand(clientID string, seq uint64, cmdType string, data json.RawMessage) *ApplyFuture {
+	switch cmdType {
+	case CmdNodeCapacity:
+		var c NodeCapacity
+		if err := json.Unmarshal(data, &c); err == nil {
+			c.At = rn.clock().UnixNano()
+			data, _ = json.Marshal(c)
+		}
+	case CmdAcceptJob, CmdStartJob, CmdHeartbeatJob, CmdCompleteJob, CmdFailJob:
+		var tr JobTransition
+		if err := json.Unmarshal(data, &tr); err == nil {
+			tr.At = rn.clock().UnixNano()
+			data, _ = json.Marshal(tr)
+		}
+	case CmdJoinIBT:
+		var p IBTPlacement
+		if err := json.Unmarshal(data, &p); err == nil && p.Addr != "" && !rn.config.includes(p.Addr) {
+			p.Addr = ""
+			data, _ = json.Marshal(p)
+		}
+	}
+	if clientID == "" {
+		return rn.propose(cmdType, data, rn.proposalTimeout)
+	}
+	return rn.proposeAs(clientID, seq, cmdType, data, rn.proposalTimeout)
+}
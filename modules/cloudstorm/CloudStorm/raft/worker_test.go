@@ -0,0 +1,204 @@
+// -------------------- raft/worker_test.go --------------------
+package raft
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// follower returns a node of the cluster other than leader.
+func (c *testCluster) follower(leader *RaftNode) *RaftNode {
+	for _, id := range c.ids {
+		if id != leader.id {
+			return c.nodes[id]
+		}
+	}
+	return nil
+}
+
+func TestForwardedFor(t *testing.T) {
+	tests := []struct {
+		cmdType string
+		command interface{}
+		node    string
+		ok      bool
+	}{
+		{CmdAcceptJob, JobTransition{JobID: "j", Worker: "n2"}, "n2", true},
+		{CmdHeartbeatJob, JobTransition{JobID: "j", Worker: "n3"}, "n3", true},
+		{CmdNodeCapacity, NodeCapacity{NodeID: "n1"}, "n1", true},
+		{CmdJoinIBT, IBTPlacement{NodeID: "n4"}, "n4", true},
+		{CmdPostJob, Job{ID: "j"}, "", false},
+		{CmdExpireJobLease, JobTransition{JobID: "j", Worker: "n2"}, "", false},
+	}
+	for _, tt := range tests {
+		data, _ := json.Marshal(tt.command)
+		if node, ok := forwardedFor(tt.cmdType, data); node != tt.node || ok != tt.ok {
+			t.Errorf("%s: got (%q, %v), want (%q, %v)", tt.cmdType, node, ok, tt.node, tt.ok)
+		}
+	}
+	if _, ok := forwardedFor(CmdStartJob, json.RawMessage(`{"worker": 1}`)); ok {
+		t.Error("a malformed transition was forwardable")
+	}
+}
+
+// TestForwardedJobLifecycle drives a job through accept, start, heartbeat and complete
+// from a follower, whose transitions are forwarded to the leader.
+func TestForwardedJobLifecycle(t *testing.T) {
+	c := newTestCluster(t, []string{"n1", "n2", "n3"}, nil, nil)
+	leader := c.leader()
+	f := c.follower(leader)
+	if err := leader.PostJob(Job{ID: "j", Type: "Test", AssignedTo: f.id}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, 5*time.Second, "the job on the follower", func() bool { return c.hasJob("j", f.id) })
+
+	if err := f.submit(CmdAcceptJob, f.jobTransition("j", f.id)); err != nil {
+		t.Fatalf("accept: %v", err)
+	}
+	if err := f.StartJob("j", "someone-else"); !errors.Is(err, ErrNotForwardable) {
+		t.Fatalf("start on behalf of another worker: got %v, want ErrNotForwardable", err)
+	}
+	if err := f.StartJob("j", f.id); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	started, _ := leader.GetJob("j")
+	time.Sleep(10 * time.Millisecond)
+	if err := f.HeartbeatJob("j", f.id); err != nil {
+		t.Fatalf("heartbeat: %v", err)
+	}
+	renewed, _ := leader.GetJob("j")
+	if renewed.LeaseExpires <= started.LeaseExpires {
+		t.Fatalf("heartbeat left the lease at %d (was %d)", renewed.LeaseExpires, started.LeaseExpires)
+	}
+	if err := f.CompleteJob("j", f.id, "cid-1"); err != nil {
+		t.Fatalf("complete: %v", err)
+	}
+	waitFor(t, 5*time.Second, "completion on every node", func() bool {
+		for _, rn := range c.nodes {
+			job, _ := rn.GetJob("j")
+			if job.Status != JobCompleted || job.ResultCID != "cid-1" || job.Worker != f.id || job.Attempts != 1 {
+				return false
+			}
+		}
+		return true
+	})
+	if err := f.HeartbeatJob("j", f.id); !errors.Is(err, ErrJobNotActive) {
+		t.Fatalf("heartbeat after completion: got %v, want ErrJobNotActive", err)
+	}
+}
+
+// TestJobTransitionsStampedByLeader sends transitions from a worker whose clock is off by
+// an hour and checks that leases and retry backoffs are measured on the leader's clock.
+func TestJobTransitionsStampedByLeader(t *testing.T) {
+	c := newTestCluster(t, []string{"n1", "n2", "n3"}, nil, nil)
+	leader := c.leader()
+	f := c.follower(leader)
+	if err := leader.PostJob(Job{ID: "j", Type: "Test", AssignedTo: f.id}); err != nil {
+		t.Fatal(err)
+	}
+	skewed := func(skew time.Duration) JobTransition {
+		return JobTransition{JobID: "j", Worker: f.id, At: time.Now().Add(skew).UnixNano()}
+	}
+	// leaseFromLeader checks that the lease runs for jobLease from the leader's time
+	// between before and now.
+	leaseFromLeader := func(what string, before int64) {
+		t.Helper()
+		job, _ := leader.GetJob("j")
+		if lo, hi := before+int64(jobLease), time.Now().UnixNano()+int64(jobLease); job.LeaseExpires < lo || job.LeaseExpires > hi {
+			t.Fatalf("%s: lease expires at %d, outside the leader's [%d, %d]", what, job.LeaseExpires, lo, hi)
+		}
+	}
+
+	// A worker running behind would have its lease expired on the next scan.
+	before := time.Now().UnixNano()
+	if err := f.submit(CmdAcceptJob, skewed(-time.Hour)); err != nil {
+		t.Fatalf("accept: %v", err)
+	}
+	leaseFromLeader("accept", before)
+	time.Sleep(2 * leaseScanInterval)
+	if job, _ := leader.GetJob("j"); job.Status != JobAccepted || job.Attempts != 1 {
+		t.Fatalf("job after a lease scan: %+v", job)
+	}
+
+	// A worker running ahead would hold its lease for an hour past its last heartbeat.
+	before = time.Now().UnixNano()
+	if err := f.submit(CmdHeartbeatJob, skewed(time.Hour)); err != nil {
+		t.Fatalf("heartbeat: %v", err)
+	}
+	leaseFromLeader("heartbeat", before)
+
+	// ... and would skip the backoff before its next attempt.
+	before = time.Now().UnixNano()
+	if err := f.submit(CmdFailJob, skewed(-time.Hour)); err != nil {
+		t.Fatalf("fail: %v", err)
+	}
+	job, _ := leader.GetJob("j")
+	if lo, hi := before+int64(retryBackoff(1)), time.Now().UnixNano()+int64(retryBackoff(1)); job.NotBefore < lo || job.NotBefore > hi {
+		t.Fatalf("retry not before %d, outside the leader's [%d, %d]", job.NotBefore, lo, hi)
+	}
+	if err := f.submit(CmdAcceptJob, skewed(time.Hour)); !errors.Is(err, ErrJobBackoff) {
+		t.Fatalf("accept during the backoff: got %v, want ErrJobBackoff", err)
+	}
+}
+
+// TestWorkerRunsAssignedJobs runs a worker on every node and checks that each job is run
+// by the node it was assigned to, with a failed first attempt retried.
+func TestWorkerRunsAssignedJobs(t *testing.T) {
+	ids := []string{"n1", "n2", "n3"}
+	var mutex sync.Mutex
+	ranOn := make(map[string][]string) // job -> nodes that ran an attempt
+	c := newTestCluster(t, ids, nil, nil)
+	for _, id := range ids {
+		w := NewWorker(c.nodes[id])
+		w.SetCapacityProbe(func() (NodeCapacity, error) { return NodeCapacity{CPUCores: 1}, nil })
+		w.Handle("Test", func(ctx context.Context, job Job) (string, error) {
+			mutex.Lock()
+			ranOn[job.ID] = append(ranOn[job.ID], id)
+			attempts := len(ranOn[job.ID])
+			mutex.Unlock()
+			if job.ID == "flaky" && attempts == 1 {
+				return "", errors.New("first attempt fails")
+			}
+			return "cid-" + job.ID, nil
+		})
+		w.Start()
+		t.Cleanup(w.Stop)
+	}
+
+	leader := c.leader()
+	f := c.follower(leader)
+	jobs := map[string]string{"on-leader": leader.id, "on-follower": f.id, "flaky": f.id}
+	for id, node := range jobs {
+		if err := leader.PostJob(Job{ID: id, Type: "Test", AssignedTo: node}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, 10*time.Second, "every job to complete", func() bool {
+		for id := range jobs {
+			if job, _ := leader.GetJob(id); job.Status != JobCompleted {
+				return false
+			}
+		}
+		return true
+	})
+	mutex.Lock()
+	defer mutex.Unlock()
+	for id, node := range jobs {
+		job, _ := leader.GetJob(id)
+		if job.Worker != node || job.ResultCID != "cid-"+id {
+			t.Errorf("job %s completed by %s with %q, want %s", id, job.Worker, job.ResultCID, node)
+		}
+		for _, ran := range ranOn[id] {
+			if ran != node {
+				t.Errorf("job %s ran on %s, assigned to %s", id, ran, node)
+			}
+		}
+	}
+	if job, _ := leader.GetJob("flaky"); job.Attempts != 2 || len(ranOn["flaky"]) != 2 {
+		t.Errorf("flaky job took %d attempts (%d runs), want 2", job.Attempts, len(ranOn["flaky"]))
+	}
+}